@@ -0,0 +1,173 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+)
+
+var ErrAPIKeyExpired = ErrInvalidCode("api_key_expired", "That API key has expired.")
+
+const apiKeyLength = 40
+
+// APIKey is a long lived credential for service integrations, only a hash of the key itself is stored.
+type APIKey struct {
+	Id       int64  `json:"id"`
+	UserId   int64  `json:"user_id"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"` // Last successful AuthenticateAPIKey, zero if never.
+	Expires  int64  `json:"expires"`   // Milliseconds, zero never expires.
+}
+
+// CreateAPIKey issues the user a named key which expires after APIKeyExpiry. The key is only returned here.
+func (us *Users) CreateAPIKey(userId int64, name string) (string, error) {
+	return us.CreateAPIKeyContext(context.Background(), userId, name)
+}
+
+func (us *Users) CreateAPIKeyContext(ctx context.Context, userId int64, name string) (string, error) {
+	if len(name) > 128 {
+		return "", ErrInvalid("'name' can't be longer than 128 chars.")
+	}
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+	if u.Suspended {
+		return "", ErrNotAuth
+	}
+	stmt, err := us.prepare(ctx, "INSERT INTO api_keys (user_id, name, key_hash, created, last_used, expires, revoked) values (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return "", err
+	}
+	key := randomToken(apiKeyLength)
+	now := Milliseconds(us.Clock.Now())
+	var expires int64
+	if us.APIKeyExpiry > 0 {
+		expires = now + us.APIKeyExpiry*1000
+	}
+	_, err = stmt.ExecContext(ctx, userId, name, hashToken(key), now, 0, expires, 0)
+	if err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// AuthenticateAPIKey returns the key's user and records its use. Like SignIn it returns ErrNotAuth for an unknown
+// or revoked key and for suspended, passive or org suspended users, and ErrAPIKeyExpired once the key has expired.
+func (us *Users) AuthenticateAPIKey(key string) (*UserWithClaims, error) {
+	return us.AuthenticateAPIKeyContext(context.Background(), key)
+}
+
+func (us *Users) AuthenticateAPIKeyContext(ctx context.Context, key string) (*UserWithClaims, error) {
+	stmt, err := us.prepare(ctx, "SELECT id, user_id, expires FROM api_keys WHERE key_hash = ? AND revoked = 0")
+	if err != nil {
+		return nil, err
+	}
+	var id, userId, expires int64
+	err = stmt.QueryRowContext(ctx, hashToken(key)).Scan(&id, &userId, &expires)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := Milliseconds(us.Clock.Now())
+	if expires > 0 && now >= expires {
+		return nil, ErrAPIKeyExpired
+	}
+	u, _, err := us.getWithClaims(ctx, "u.id = ?", userId)
+	if err == ErrNotFound {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Suspended || u.OrgSuspended || u.Passive {
+		return nil, ErrNotAuth
+	}
+	// Usage is informational so a failure doesn't reject the key
+	stmt, err = us.prepare(ctx, "UPDATE api_keys SET last_used = ? WHERE id = ?")
+	if err == nil {
+		_, err = stmt.ExecContext(ctx, now, id)
+	}
+	if err != nil {
+		us.log().Error("recording api key use", "error", err, "user_id", userId)
+	}
+	return u, nil
+}
+
+// ClaimsForAPIKey returns just the claims of the key's user with a single joined query, e.g. for an API gateway.
+// It returns the same errors as AuthenticateAPIKey except that an org suspended user's claims are returned with
+// OrgSuspended set, which Authorize rejects. Roles isn't loaded and the key's use isn't recorded.
+func (us *Users) ClaimsForAPIKey(key string) (*Claims, error) {
+	return us.ClaimsForAPIKeyContext(context.Background(), key)
+}
+
+func (us *Users) ClaimsForAPIKeyContext(ctx context.Context, key string) (*Claims, error) {
+	_, orgSuspendedCol, orgJoin := us.orgColumns()
+	stmt, err := us.prepare(ctx, "SELECT k.expires, u.role, u.org_id, "+orgSuspendedCol+", u.suspended, u.passive "+
+		"FROM api_keys k JOIN users u ON u.id = k.user_id"+orgJoin+" WHERE k.key_hash = ? AND k.revoked = 0 AND u.deleted = 0")
+	if err != nil {
+		return nil, err
+	}
+	var expires int64
+	var suspended, passive bool
+	c := &Claims{}
+	err = stmt.QueryRowContext(ctx, hashToken(key)).Scan(&expires, &c.Role, &c.OrgId, &c.OrgSuspended, &suspended, &passive)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expires > 0 && Milliseconds(us.Clock.Now()) >= expires {
+		return nil, ErrAPIKeyExpired
+	}
+	if suspended || passive {
+		return nil, ErrNotAuth
+	}
+	return c, nil
+}
+
+// ListAPIKeys returns the user's unrevoked keys, oldest first.
+func (us *Users) ListAPIKeys(userId int64) ([]*APIKey, error) {
+	return us.ListAPIKeysContext(context.Background(), userId)
+}
+
+func (us *Users) ListAPIKeysContext(ctx context.Context, userId int64) ([]*APIKey, error) {
+	stmt, err := us.prepare(ctx, "SELECT id, user_id, name, created, last_used, expires FROM api_keys WHERE user_id = ? AND revoked = 0 ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		k := &APIKey{}
+		var name sql.NullString
+		err = rows.Scan(&k.Id, &k.UserId, &name, &k.Created, &k.LastUsed, &k.Expires)
+		if err != nil {
+			return nil, err
+		}
+		k.Name = name.String
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey stops the user's key with the given id from authenticating. It returns ErrNotFound if the user has
+// no such unrevoked key.
+func (us *Users) RevokeAPIKey(userId int64, id int64) error {
+	return us.RevokeAPIKeyContext(context.Background(), userId, id)
+}
+
+func (us *Users) RevokeAPIKeyContext(ctx context.Context, userId int64, id int64) error {
+	stmt, err := us.prepare(ctx, "UPDATE api_keys SET revoked = ? WHERE id = ? AND user_id = ? AND revoked = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.ExecContext(ctx, Milliseconds(us.Clock.Now()), id, userId))
+}
@@ -0,0 +1,60 @@
+package gus
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BreachChecker reports whether a password is known to be compromised, see UserOpts.BreachChecker.
+type BreachChecker interface {
+	IsBreached(password string) (bool, error)
+}
+
+// HIBPChecker checks passwords against the HaveIBeenPwned range API. Only the first 5 characters of the password's
+// SHA-1 hash are sent, the match is made locally.
+type HIBPChecker struct {
+	Client *http.Client // Defaults to a client with a 5 second timeout.
+	URL    string       // Defaults to https://api.pwnedpasswords.com/range/
+}
+
+var hibpClient = &http.Client{Timeout: 5 * time.Second}
+
+func (h HIBPChecker) IsBreached(password string) (bool, error) {
+	client, url := h.Client, h.URL
+	if client == nil {
+		client = hibpClient
+	}
+	if url == "" {
+		url = "https://api.pwnedpasswords.com/range/"
+	}
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	req, err := http.NewRequest(http.MethodGet, url+hash[:5], nil)
+	if err != nil {
+		return false, err
+	}
+	// Padding hides the number of suffixes in the response from anyone watching the traffic.
+	req.Header.Set("Add-Padding", "true")
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("gus: pwnedpasswords returned %s", res.Status)
+	}
+	// Each line is SUFFIX:COUNT, padding lines have a count of 0.
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) == 2 && parts[0] == hash[5:] && parts[1] != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
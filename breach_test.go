@@ -0,0 +1,41 @@
+package gus
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHIBPChecker(t *testing.T) {
+	// SHA-1 of 'password' is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		assert.Equal(t, "true", r.Header.Get("Add-Padding"))
+		fmt.Fprint(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493\r\n"+
+			"0000000000000000000000000000000000A:0\r\n")
+	}))
+	defer srv.Close()
+	c := HIBPChecker{URL: srv.URL + "/range/"}
+
+	breached, err := c.IsBreached("password")
+	assert.Nil(t, err)
+	assert.True(t, breached)
+	assert.Equal(t, "/range/5BAA6", path)
+
+	breached, err = c.IsBreached("M0nk3yNutz5")
+	assert.Nil(t, err)
+	assert.False(t, breached)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	_, err = HIBPChecker{URL: unavailable.URL + "/range/"}.IsBreached("password")
+	assert.Error(t, err)
+	srv.Close()
+	_, err = c.IsBreached("password")
+	assert.Error(t, err)
+}
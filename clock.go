@@ -0,0 +1,15 @@
+package gus
+
+import "time"
+
+// Clock tells the time for timestamps, lockouts and token expiry, tests can replace it to move time deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the real time, the default Clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
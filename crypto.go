@@ -6,6 +6,9 @@
 package gus
 
 import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/rand"
 	"time"
 )
@@ -48,3 +51,28 @@ func RandStringBytesMaskImprSrc(n int64) string {
 	}
 	return string(b)
 }
+
+// randomToken returns n letterBytes read from crypto/rand, unlike the PassGen hook its output is unpredictable so it
+// is used for the bearer credentials: API keys, session ids, recovery codes, device tokens and invite codes.
+func randomToken(n int64) string {
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for int64(len(b)) < n {
+		if _, err := crand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, r := range buf {
+			// Masking to 6 bits and rejecting the indexes past letterBytes keeps every letter equally likely
+			if idx := int(r & letterIdxMask); idx < len(letterBytes) && int64(len(b)) < n {
+				b = append(b, letterBytes[idx])
+			}
+		}
+	}
+	return string(b)
+}
+
+// hashToken returns the hex sha256 digest of a token, a fast hash is sufficient since tokens are high entropy.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,21 @@
+package gus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestRandomToken(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		token := randomToken(40)
+		assert.Equal(t, 40, len(token))
+		for _, r := range token {
+			assert.True(t, strings.ContainsRune(letterBytes, r), string(r))
+		}
+		assert.False(t, seen[token])
+		seen[token] = true
+	}
+	assert.Equal(t, "", randomToken(0))
+}
@@ -1,6 +1,7 @@
 package gus
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -20,6 +21,11 @@ func Milliseconds(t time.Time) int64 {
 	return u
 }
 
+// FromMilliseconds is the inverse of Milliseconds, returning the local time.
+func FromMilliseconds(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
 type DbOpts struct {
 	DriverName     string   // Optional will use sqlite3 by default.
 	DataSourceName string   // Optional will use './gus.db' by default.
@@ -35,6 +41,12 @@ var (
 		"mysql":   SeedMySql,
 		"sqlite3": SeedSqlLite,
 	}
+
+	// txRetryBackoff is the wait before TxWithRetry's first retry, it doubles with each retry.
+	txRetryBackoff = 10 * time.Millisecond
+
+	// '!' is used as the escape character since the default differs between MySQL and SQLite.
+	likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
 )
 
 // Gets the sql database handle for the database specified in the DriverName options parameter.
@@ -113,7 +125,8 @@ func (p *ListArgs) ApplyDefaults() {
 
 // ApplyUpdates will apply updates to an 'original' struct and update fields based on an 'updates' struct
 // The 'updates' struct should have point fields and should also serialize to and from json the same as the
-// Intended destination fields.
+// Intended destination fields. A nil pointer leaves the field unchanged, any other pointer is applied even when it
+// points to a zero value, e.g. "" clears a string.
 func ApplyUpdates(original interface{}, updates interface{}) error {
 	p, err := json.Marshal(updates)
 	if err != nil {
@@ -126,13 +139,66 @@ func ApplyUpdates(original interface{}, updates interface{}) error {
 // GetRows returns a *sql.Rows iterator after adding limit and offset, results are sorted by default 'updated' desc.
 // Sql added sample: + ' ORDER by updated DESC LIMIT 20 OFFSET 1'
 func GetRows(db *sql.DB, query string, lp *ListArgs, args ...interface{}) (*sql.Rows, error) {
+	return GetRowsContext(context.Background(), db, query, lp, args...)
+}
+
+func GetRowsContext(ctx context.Context, db *sql.DB, query string, lp *ListArgs, args ...interface{}) (*sql.Rows, error) {
+	query, args, err := pageQuery(query, lp, args)
+	if err != nil {
+		return nil, err
+	}
+	return queryRows(ctx, db, query, args...)
+}
+
+// pageQuery adds the ORDER BY, LIMIT and OFFSET clauses for lp to the query and args.
+func pageQuery(query string, lp *ListArgs, args []interface{}) (string, []interface{}, error) {
+	lp.ApplyDefaults()
+	dir, ok := sortDirection(lp.Direction)
+	if !sqlCheck.MatchString(lp.OrderBy) || !ok {
+		return "", nil, sqlErr
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s LIMIT ? OFFSET ?", lp.OrderBy, dir)
+	return query, append(args, lp.Size, lp.Page*lp.Size), nil
+}
+
+// sortedPageQuery is pageQuery restricted to the comma separated OrderBy names in columns,
+// which maps each name to the column it sorts by.
+func sortedPageQuery(query string, lp *ListArgs, columns map[string]string, args []interface{}) (string, []interface{}, error) {
 	lp.ApplyDefaults()
-	if !sqlCheck.MatchString(lp.OrderBy) || !sqlCheck.MatchString(string(lp.Direction)) {
-		return nil, sqlErr
+	dir, ok := sortDirection(lp.Direction)
+	if !ok {
+		return "", nil, sqlErr
+	}
+	names := strings.Split(lp.OrderBy, ",")
+	cols := make([]string, len(names))
+	for i, name := range names {
+		col, ok := columns[strings.TrimSpace(name)]
+		if !ok {
+			return "", nil, sqlErr
+		}
+		cols[i] = col
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s LIMIT ? OFFSET ?", strings.Join(cols, ", "), dir)
+	return query, append(args, lp.Size, lp.Page*lp.Size), nil
+}
+
+// sortDirection returns d as DirectionAsc or DirectionDesc, ok is false for anything else.
+func sortDirection(d SortDir) (SortDir, bool) {
+	switch strings.ToUpper(string(d)) {
+	case string(DirectionAsc):
+		return DirectionAsc, true
+	case string(DirectionDesc):
+		return DirectionDesc, true
 	}
-	query += fmt.Sprintf(" ORDER BY %s %s LIMIT ? OFFSET ?", lp.OrderBy, lp.Direction)
-	args = append(args, lp.Size, lp.Page*lp.Size)
-	stmt, err := db.Prepare(query)
+	return "", false
+}
+
+type preparer interface {
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func queryRows(ctx context.Context, db preparer, query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
 		if err.Error() == ErrStringNoSuchColumn {
 			return nil, ErrInvalid(fmt.Sprintf(err.Error()))
@@ -140,15 +206,57 @@ func GetRows(db *sql.DB, query string, lp *ListArgs, args ...interface{}) (*sql.
 		return nil, err
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query(args...)
+	rows, err := stmt.QueryContext(ctx, args...)
 	if err != nil {
 		return nil, err
 	}
 	return rows, err
 }
 
-func Tx(db *sql.DB, txFunc func(*sql.Tx) error) (err error) {
-	tx, err := db.Begin()
+// likeEscape escapes LIKE wildcards in s so it is matched literally, the clause must specify ESCAPE '!'.
+func likeEscape(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// TxWithRetry is Tx which re-runs txFunc in a new transaction, up to retries times with exponential backoff, while
+// it fails with an error isRetryable accepts, e.g. Dialect.IsRetryable. txFunc must be safe to re-run.
+func TxWithRetry(db *sql.DB, retries int, isRetryable func(error) bool, txFunc func(*sql.Tx) error) error {
+	return TxWithRetryContext(context.Background(), db, retries, isRetryable, txFunc)
+}
+
+func TxWithRetryContext(ctx context.Context, db *sql.DB, retries int, isRetryable func(error) bool, txFunc func(*sql.Tx) error) error {
+	backoff := txRetryBackoff
+	for i := 0; ; i++ {
+		err := TxContext(ctx, db, txFunc)
+		if err == nil || i >= retries || !isRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func Tx(db *sql.DB, txFunc func(*sql.Tx) error) error {
+	return TxContext(context.Background(), db, txFunc)
+}
+
+// TxContext runs txFunc in a transaction which is rolled back if txFunc errors or panics, or if ctx is cancelled.
+func TxContext(ctx context.Context, db *sql.DB, txFunc func(*sql.Tx) error) error {
+	return txOpts(ctx, db, nil, txFunc)
+}
+
+// snapshotTx runs txFunc in a read only, repeatable read transaction so all its queries see the db as it was at the
+// first one, e.g. a page of results and their total.
+func snapshotTx(ctx context.Context, db *sql.DB, txFunc func(*sql.Tx) error) error {
+	return txOpts(ctx, db, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, txFunc)
+}
+
+func txOpts(ctx context.Context, db *sql.DB, opts *sql.TxOptions, txFunc func(*sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, opts)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,87 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTxWithRetry(t *testing.T) {
+	deadlock := errors.New("Error 1213: Deadlock found when trying to get lock; try restarting transaction")
+	failing := func(n int, err error, runs *int) func(*sql.Tx) error {
+		return func(tx *sql.Tx) error {
+			*runs++
+			var one int
+			if e := tx.QueryRow("SELECT 1").Scan(&one); e != nil {
+				return e
+			}
+			if *runs <= n {
+				return err
+			}
+			return nil
+		}
+	}
+
+	// Succeeds on retry
+	var runs int
+	assert.Nil(t, TxWithRetry(testDb, 3, MySqlDialect.IsRetryable, failing(1, deadlock, &runs)))
+	assert.Equal(t, 2, runs)
+
+	// Non retryable errors are returned immediately
+	runs = 0
+	other := errors.New("Error 1146: Table 'users' doesn't exist")
+	assert.Equal(t, other, TxWithRetry(testDb, 3, MySqlDialect.IsRetryable, failing(1, other, &runs)))
+	assert.Equal(t, 1, runs)
+
+	// Retries are bounded
+	runs = 0
+	assert.Equal(t, deadlock, TxWithRetry(testDb, 2, MySqlDialect.IsRetryable, failing(10, deadlock, &runs)))
+	assert.Equal(t, 3, runs)
+
+	// A cancelled context stops the backoff
+	runs = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	err := TxWithRetryContext(ctx, testDb, 10, MySqlDialect.IsRetryable, func(tx *sql.Tx) error {
+		runs++
+		cancel()
+		return deadlock
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, runs)
+}
+
+func TestApplyUpdates(t *testing.T) {
+	type item struct {
+		Name  string `json:"name"`
+		Phone string `json:"phone"`
+		Count int64  `json:"count"`
+	}
+	type itemUpdates struct {
+		Name  *string `json:"name"`
+		Phone *string `json:"phone"`
+		Count *int64  `json:"count"`
+	}
+	name, empty, zero := "new", "", int64(0)
+	i := item{Name: "old", Phone: "+61400000000", Count: 3}
+	assert.Nil(t, ApplyUpdates(&i, itemUpdates{}))
+	assert.Equal(t, item{Name: "old", Phone: "+61400000000", Count: 3}, i)
+	assert.Nil(t, ApplyUpdates(&i, itemUpdates{Name: &name}))
+	assert.Equal(t, item{Name: "new", Phone: "+61400000000", Count: 3}, i)
+	assert.Nil(t, ApplyUpdates(&i, itemUpdates{Phone: &empty, Count: &zero}))
+	assert.Equal(t, item{Name: "new"}, i)
+}
+
+func TestFromMilliseconds(t *testing.T) {
+	now := time.Now()
+	ms := Milliseconds(now)
+	assert.Equal(t, now.Truncate(time.Millisecond).UnixNano(), FromMilliseconds(ms).UnixNano())
+	assert.Equal(t, ms, Milliseconds(FromMilliseconds(ms)))
+	assert.True(t, time.Unix(0, 0).Equal(FromMilliseconds(0)))
+
+	u := User{Created: ms, Updated: ms + 1500}
+	assert.Equal(t, ms, Milliseconds(u.CreatedTime()))
+	assert.Equal(t, 1500*time.Millisecond, u.UpdatedTime().Sub(u.CreatedTime()))
+}
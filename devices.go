@@ -0,0 +1,119 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+)
+
+const deviceTokenLength = 40
+
+// TrustedDevice is a browser or device on which the user has passed the second factor, see TrustDevice. Only a hash
+// of its token is stored.
+type TrustedDevice struct {
+	Id       int64  `json:"id"`
+	UserId   int64  `json:"user_id"`
+	Name     string `json:"name"` // e.g. the browser and OS.
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"last_used"` // Last sign in with the device's token, zero if never.
+	Expires  int64  `json:"expires"`
+}
+
+// TrustDevice returns a token for the device on which the user has just passed the second factor, e.g. for a
+// long lived cookie. Signing in with it as SignInParams.DeviceToken sets TrustedDevice so the second factor can be
+// skipped until TrustedDeviceExpiry. ChangePassword revokes all the user's devices.
+func (us *Users) TrustDevice(userId int64, name string) (string, error) {
+	return us.TrustDeviceContext(context.Background(), userId, name)
+}
+
+func (us *Users) TrustDeviceContext(ctx context.Context, userId int64, name string) (string, error) {
+	if len(name) > 128 {
+		return "", ErrInvalid("'name' can't be longer than 128 chars.")
+	}
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+	if u.Suspended {
+		return "", ErrNotAuth
+	}
+	stmt, err := us.prepare(ctx, "INSERT INTO trusted_devices (user_id, name, token_hash, created, last_used, expires, revoked) values (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return "", err
+	}
+	token := randomToken(deviceTokenLength)
+	now := Milliseconds(us.Clock.Now())
+	_, err = stmt.ExecContext(ctx, userId, name, hashToken(token), now, 0, now+us.TrustedDeviceExpiry*1000, 0)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// trustedDevice reports whether token is an unexpired, unrevoked device token of the user and records its use.
+// Errors are logged and treated as untrusted so the second factor is required.
+func (us *Users) trustedDevice(ctx context.Context, userId int64, token string) bool {
+	if token == "" {
+		return false
+	}
+	stmt, err := us.prepare(ctx, "UPDATE trusted_devices SET last_used = ? WHERE user_id = ? AND token_hash = ? AND revoked = 0 AND expires > ?")
+	if err != nil {
+		us.log().Error("checking trusted device", "error", err, "user_id", userId)
+		return false
+	}
+	now := Milliseconds(us.Clock.Now())
+	err = CheckUpdated(stmt.ExecContext(ctx, now, userId, hashToken(token), now))
+	if err != nil && err != ErrNotFound {
+		us.log().Error("checking trusted device", "error", err, "user_id", userId)
+	}
+	return err == nil
+}
+
+// ListTrustedDevices returns the user's unrevoked and unexpired devices, oldest first.
+func (us *Users) ListTrustedDevices(userId int64) ([]*TrustedDevice, error) {
+	return us.ListTrustedDevicesContext(context.Background(), userId)
+}
+
+func (us *Users) ListTrustedDevicesContext(ctx context.Context, userId int64) ([]*TrustedDevice, error) {
+	stmt, err := us.prepare(ctx, "SELECT id, user_id, name, created, last_used, expires FROM trusted_devices WHERE user_id = ? AND revoked = 0 AND expires > ? ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userId, Milliseconds(us.Clock.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	devices := []*TrustedDevice{}
+	for rows.Next() {
+		d := &TrustedDevice{}
+		var name sql.NullString
+		err = rows.Scan(&d.Id, &d.UserId, &name, &d.Created, &d.LastUsed, &d.Expires)
+		if err != nil {
+			return nil, err
+		}
+		d.Name = name.String
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// RevokeTrustedDevice makes the user's device with the given id require the second factor again. It returns
+// ErrNotFound if the user has no such unrevoked device.
+func (us *Users) RevokeTrustedDevice(userId int64, id int64) error {
+	return us.RevokeTrustedDeviceContext(context.Background(), userId, id)
+}
+
+func (us *Users) RevokeTrustedDeviceContext(ctx context.Context, userId int64, id int64) error {
+	stmt, err := us.prepare(ctx, "UPDATE trusted_devices SET revoked = ? WHERE id = ? AND user_id = ? AND revoked = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.ExecContext(ctx, Milliseconds(us.Clock.Now()), id, userId))
+}
+
+// revokeTrustedDevices revokes all the user's devices with q, e.g. the tx changing their password.
+func (us *Users) revokeTrustedDevices(ctx context.Context, q execer, userId int64) error {
+	_, err := q.ExecContext(ctx, us.rebind("UPDATE trusted_devices SET revoked = ? WHERE user_id = ? AND revoked = 0"),
+		Milliseconds(us.Clock.Now()), userId)
+	return err
+}
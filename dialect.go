@@ -0,0 +1,102 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Dialect adapts the SQL run by Users to a database. Queries are written with '?' placeholders.
+type Dialect interface {
+	// Rebind rewrites the '?' placeholders in query to the dialect's placeholders.
+	Rebind(query string) string
+	// IsDuplicate reports whether err is a unique constraint violation.
+	IsDuplicate(err error) bool
+	// IsRetryable reports whether err is a deadlock or serialization failure which may succeed if the transaction
+	// is retried, see TxWithRetry.
+	IsRetryable(err error) bool
+	// InsertId runs an INSERT written with '?' placeholders and returns the id of the new row.
+	InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error)
+}
+
+var (
+	MySqlDialect    Dialect = mySqlDialect{} // The default, also suitable for sqlite3.
+	PostgresDialect Dialect = postgresDialect{}
+)
+
+type mySqlDialect struct{}
+
+func (mySqlDialect) Rebind(query string) string {
+	return query
+}
+
+func (mySqlDialect) IsDuplicate(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "Duplicate entry") ||
+		strings.Contains(err.Error(), "UNIQUE constraint failed"))
+}
+
+// IsRetryable matches MySQL deadlocks (1213) and lock wait timeouts (1205), and a busy sqlite3 database.
+func (mySqlDialect) IsRetryable(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "Deadlock found") ||
+		strings.Contains(err.Error(), "Lock wait timeout exceeded") ||
+		strings.Contains(err.Error(), "database is locked"))
+}
+
+func (mySqlDialect) InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+type postgresDialect struct{}
+
+// Rebind replaces each '?' outside of a quoted string with $1, $2...
+func (postgresDialect) Rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (postgresDialect) IsDuplicate(err error) bool {
+	if err == nil {
+		return false
+	}
+	// Both lib/pq and pgx errors expose the SQLSTATE, 23505 is unique_violation.
+	if e, ok := err.(interface{ SQLState() string }); ok {
+		return e.SQLState() == "23505"
+	}
+	return strings.Contains(err.Error(), "duplicate key value violates unique constraint")
+}
+
+func (postgresDialect) IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	// 40001 is serialization_failure and 40P01 deadlock_detected.
+	if e, ok := err.(interface{ SQLState() string }); ok {
+		return e.SQLState() == "40001" || e.SQLState() == "40P01"
+	}
+	return strings.Contains(err.Error(), "could not serialize access") ||
+		strings.Contains(err.Error(), "deadlock detected")
+}
+
+func (d postgresDialect) InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, d.Rebind(query)+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
@@ -0,0 +1,91 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDialect_Rebind(t *testing.T) {
+	q := "SELECT id FROM users WHERE email = ? AND name like ? ESCAPE '?' LIMIT ? OFFSET ?"
+	assert.Equal(t, q, MySqlDialect.Rebind(q))
+	assert.Equal(t, "SELECT id FROM users WHERE email = $1 AND name like $2 ESCAPE '?' LIMIT $3 OFFSET $4",
+		PostgresDialect.Rebind(q))
+}
+
+type sqlStateErr string
+
+func (e sqlStateErr) Error() string    { return "pq: error" }
+func (e sqlStateErr) SQLState() string { return string(e) }
+
+func TestDialect_IsDuplicate(t *testing.T) {
+	assert.True(t, MySqlDialect.IsDuplicate(errors.New("Error 1062: Duplicate entry 'a@b.com' for key 'email'")))
+	assert.True(t, MySqlDialect.IsDuplicate(errors.New("UNIQUE constraint failed: users.email")))
+	assert.False(t, MySqlDialect.IsDuplicate(errors.New("Error 1146: Table 'users' doesn't exist")))
+	assert.False(t, MySqlDialect.IsDuplicate(nil))
+
+	assert.True(t, PostgresDialect.IsDuplicate(sqlStateErr("23505")))
+	assert.False(t, PostgresDialect.IsDuplicate(sqlStateErr("42P01")))
+	assert.True(t, PostgresDialect.IsDuplicate(errors.New(`duplicate key value violates unique constraint "uc_email"`)))
+	assert.False(t, PostgresDialect.IsDuplicate(nil))
+}
+
+func TestDialect_IsRetryable(t *testing.T) {
+	assert.True(t, MySqlDialect.IsRetryable(errors.New("Error 1213: Deadlock found when trying to get lock; try restarting transaction")))
+	assert.True(t, MySqlDialect.IsRetryable(errors.New("Error 1205: Lock wait timeout exceeded; try restarting transaction")))
+	assert.True(t, MySqlDialect.IsRetryable(errors.New("database is locked")))
+	assert.False(t, MySqlDialect.IsRetryable(errors.New("Error 1062: Duplicate entry 'a@b.com' for key 'email'")))
+	assert.False(t, MySqlDialect.IsRetryable(nil))
+
+	assert.True(t, PostgresDialect.IsRetryable(sqlStateErr("40001")))
+	assert.True(t, PostgresDialect.IsRetryable(sqlStateErr("40P01")))
+	assert.False(t, PostgresDialect.IsRetryable(sqlStateErr("23505")))
+	assert.True(t, PostgresDialect.IsRetryable(errors.New("pq: could not serialize access due to concurrent update")))
+	assert.False(t, PostgresDialect.IsRetryable(nil))
+}
+
+func TestDialect_ListQuery(t *testing.T) {
+	p := ListUsersParams{
+		ListArgs:    ListArgs{Size: 10, Page: 2, OrderBy: "id", Direction: DirectionAsc},
+		UserFilters: UserFilters{OrgId: 3, Email: "mail"},
+	}
+	selectq := "SELECT u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone, u.org_id, " +
+		"o.name as org_name, u.created, u.updated, u.role_updated, u.status_updated, COALESCE(u.last_login, 0), u.last_login_ip, u.role, u.suspended, u.passive, u.activated, u.verified, u.metadata, " +
+		"COALESCE(u.must_change_password, 0) " +
+		"From users u left join orgs o on u.org_id = o.id WHERE 1=1"
+
+	q, countq, args, err := NewUsers(nil, UserOpts{}).listQuery(&p)
+	assert.Nil(t, err)
+	assert.Equal(t, selectq+" AND u.deleted = 0 AND u.org_id = ? AND u.email like ? ORDER BY u.id ASC LIMIT ? OFFSET ?", q)
+	assert.Equal(t, "SELECT count(u.id) FROM users u WHERE 1=1 AND u.deleted = 0 AND u.org_id = ? AND u.email like ?", countq)
+	assert.Equal(t, []interface{}{int64(3), "%mail%", 10, 20}, args)
+
+	q, countq, args, err = NewUsers(nil, UserOpts{Dialect: PostgresDialect}).listQuery(&p)
+	assert.Nil(t, err)
+	assert.Equal(t, selectq+" AND u.deleted = 0 AND u.org_id = $1 AND u.email like $2 ORDER BY u.id ASC LIMIT $3 OFFSET $4", q)
+	assert.Equal(t, "SELECT count(u.id) FROM users u WHERE 1=1 AND u.deleted = 0 AND u.org_id = $1 AND u.email like $2", countq)
+	assert.Equal(t, []interface{}{int64(3), "%mail%", 10, 20}, args)
+}
+
+type queryRecorder []string
+
+func (qr *queryRecorder) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	*qr = append(*qr, query)
+	return driver.RowsAffected(1), nil
+}
+
+func TestDialect_Suspender(t *testing.T) {
+	su := &Suspender{table: "users", updatedColumn: "status_updated", clock: &fakeClock{now: time.Unix(100, 0)},
+		dialect: PostgresDialect}
+	var qr queryRecorder
+	assert.Nil(t, su.suspend(context.Background(), &qr, 2))
+	assert.Nil(t, su.exec(context.Background(), &qr, "UPDATE users SET deleted = 1, updated = ? WHERE id = ?", 2))
+	assert.Equal(t, queryRecorder{
+		"UPDATE users SET suspended = 1, status_updated = $1 WHERE id = $2 AND deleted = 0",
+		"UPDATE users SET deleted = 1, updated = $1 WHERE id = $2",
+	}, qr)
+}
@@ -0,0 +1,58 @@
+package gus
+
+import "strings"
+
+var ErrDisposableEmail = ErrInvalidCode("disposable_email", "Emails from disposable email providers aren't accepted.")
+
+// DisposableDomainChecker reports whether an email domain belongs to a throwaway email provider, see
+// UserOpts.DisposableDomainChecker.
+type DisposableDomainChecker interface {
+	IsDisposable(domain string) bool
+}
+
+// DisposableDomains is a DisposableDomainChecker of lower case domains, their subdomains match too.
+type DisposableDomains map[string]bool
+
+// DefaultDisposableDomains is a small list of well known disposable email providers, extend it with With.
+var DefaultDisposableDomains = DisposableDomains{
+	"10minutemail.com": true, "dispostable.com": true, "getnada.com": true, "guerrillamail.com": true,
+	"mailinator.com": true, "maildrop.cc": true, "sharklasers.com": true, "temp-mail.org": true,
+	"tempmail.com": true, "throwawaymail.com": true, "trashmail.com": true, "yopmail.com": true,
+}
+
+// With returns a copy of d which also contains domains.
+func (d DisposableDomains) With(domains ...string) DisposableDomains {
+	c := make(DisposableDomains, len(d)+len(domains))
+	for domain := range d {
+		c[domain] = true
+	}
+	for _, domain := range domains {
+		c[strings.ToLower(domain)] = true
+	}
+	return c
+}
+
+func (d DisposableDomains) IsDisposable(domain string) bool {
+	domain = strings.ToLower(domain)
+	for {
+		if d[domain] {
+			return true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// checkDisposable returns ErrDisposableEmail if the DisposableDomainChecker matches the email's domain.
+func (us *Users) checkDisposable(email string) error {
+	if us.DisposableDomainChecker == nil {
+		return nil
+	}
+	if us.DisposableDomainChecker.IsDisposable(email[strings.LastIndex(email, "@")+1:]) {
+		return ErrDisposableEmail
+	}
+	return nil
+}
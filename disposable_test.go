@@ -0,0 +1,19 @@
+package gus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDisposableDomains(t *testing.T) {
+	assert.True(t, DefaultDisposableDomains.IsDisposable("mailinator.com"))
+	assert.True(t, DefaultDisposableDomains.IsDisposable("Spam.MAILINATOR.com"))
+	assert.False(t, DefaultDisposableDomains.IsDisposable("mail.com"))
+	assert.False(t, DefaultDisposableDomains.IsDisposable("notmailinator.com"))
+	assert.False(t, DefaultDisposableDomains.IsDisposable(""))
+
+	d := DefaultDisposableDomains.With("Burner.example")
+	assert.True(t, d.IsDisposable("burner.example"))
+	assert.True(t, d.IsDisposable("yopmail.com"))
+	assert.False(t, DefaultDisposableDomains.IsDisposable("burner.example"))
+}
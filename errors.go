@@ -5,9 +5,9 @@ import "strings"
 var (
 	ErrNotAuth         = &NotAuthenticatedError{}
 	ErrNotFound        = &NotFoundError{}
-	ErrCantDeleteSelf  = ErrInvalid("You can't delete yourself.")
-	ErrCantSuspendSelf = ErrInvalid("You can't suspend yourself.")
-	ErrTokenExpired = ErrInvalid("That access token has expired.")
+	ErrCantDeleteSelf  = ErrInvalidCode("cant_delete_self", "You can't delete yourself.")
+	ErrCantSuspendSelf = ErrInvalidCode("cant_suspend_self", "You can't suspend yourself.")
+	ErrTokenExpired = ErrInvalidCode("token_expired", "That access token has expired.")
 )
 
 type NotAuthenticatedError struct {
@@ -18,7 +18,8 @@ func (n *NotAuthenticatedError) Error() string {
 }
 
 type RateLimitExceededError struct {
-	Messages []string `json:"messages"`
+	Messages   []string `json:"messages"`
+	RetryAfter int64    `json:"retry_after,omitempty"` // Seconds until the next attempt is allowed, if known.
 }
 
 func (rl *RateLimitExceededError) Error() string {
@@ -36,10 +37,29 @@ func ErrInvalid(messages ...string) error {
 	return &ValidationError{Messages: messages}
 }
 
+// ErrInvalidCode is ErrInvalid with a stable code which a Translator can localize.
+func ErrInvalidCode(code string, messages ...string) error {
+	return &ValidationError{Code: code, Messages: messages}
+}
+
+// Translator returns the localized message for an error code, or "" to keep the English messages.
+type Translator func(code string) string
+
 type ValidationError struct {
+	Code     string   `json:"code,omitempty"` // e.g. 'email_taken', doesn't change with the language.
 	Messages []string `json:"messages"`
 }
 
 func (v *ValidationError) Error() string {
 	return strings.Join(v.Messages, "\n- ")
 }
+
+// Localize returns the message translated by t, or Error() if there's no code or translation.
+func (v *ValidationError) Localize(t Translator) string {
+	if v.Code != "" && t != nil {
+		if msg := t(v.Code); msg != "" {
+			return msg
+		}
+	}
+	return v.Error()
+}
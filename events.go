@@ -0,0 +1,74 @@
+package gus
+
+// EventSink is notified of user lifecycle events, e.g. to send a welcome email or sync a CRM. Events are sent
+// after the change is committed. Embed NopEventSink to only handle some events.
+type EventSink interface {
+	OnSignUp(u *User)
+	OnSignIn(u *UserWithClaims)
+	OnPasswordChanged(userId int64)
+	OnSuspended(userId int64)
+	OnDeleted(userId int64)
+	// OnLockout is sent when sign in is locked for a username after too many attempts, e.g. to alert the owner.
+	OnLockout(username string, attempts int64)
+}
+
+// NopEventSink ignores all events.
+type NopEventSink struct{}
+
+func (NopEventSink) OnSignUp(u *User)                          {}
+func (NopEventSink) OnSignIn(u *UserWithClaims)                {}
+func (NopEventSink) OnPasswordChanged(userId int64)            {}
+func (NopEventSink) OnSuspended(userId int64)                  {}
+func (NopEventSink) OnDeleted(userId int64)                    {}
+func (NopEventSink) OnLockout(username string, attempts int64) {}
+
+// eventSinks sends each event to all the sinks.
+type eventSinks []EventSink
+
+func (s eventSinks) OnSignUp(u *User) {
+	for _, sink := range s {
+		sink.OnSignUp(u)
+	}
+}
+
+func (s eventSinks) OnSignIn(u *UserWithClaims) {
+	for _, sink := range s {
+		sink.OnSignIn(u)
+	}
+}
+
+func (s eventSinks) OnPasswordChanged(userId int64) {
+	for _, sink := range s {
+		sink.OnPasswordChanged(userId)
+	}
+}
+
+func (s eventSinks) OnSuspended(userId int64) {
+	for _, sink := range s {
+		sink.OnSuspended(userId)
+	}
+}
+
+func (s eventSinks) OnDeleted(userId int64) {
+	for _, sink := range s {
+		sink.OnDeleted(userId)
+	}
+}
+
+func (s eventSinks) OnLockout(username string, attempts int64) {
+	for _, sink := range s {
+		sink.OnLockout(username, attempts)
+	}
+}
+
+// events returns the configured EventSink or a NopEventSink, along with the webhooks if there are any.
+func (us *Users) events() EventSink {
+	var sink EventSink = NopEventSink{}
+	if us.EventSink != nil {
+		sink = us.EventSink
+	}
+	if us.webhooks != nil {
+		return eventSinks{sink, us.webhooks}
+	}
+	return sink
+}
@@ -0,0 +1,98 @@
+package gus
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Formats of Export.
+const (
+	ExportCSV  = "csv"
+	ExportJSON = "json" // One json User per line.
+)
+
+// exportColumns is the header of ExportCSV.
+var exportColumns = []string{"id", "uid", "username", "email", "first_name", "last_name", "phone", "org_id",
+	"org_name", "role", "created", "updated", "last_login", "suspended", "passive", "activated", "verified", "metadata"}
+
+// Export writes the live users matching f to w in the ExportCSV or ExportJSON format, e.g. for backups. Users are
+// read a page of MaxPageSize at a time in id order, so the full result is never held in memory. Each page starts
+// after the last id written rather than at an offset, so users added or deleted meanwhile don't shift the pages and
+// cause others to be skipped or repeated. Password hashes aren't exported.
+func (us *Users) Export(w io.Writer, f UserFilters, format string) error {
+	return us.ExportContext(context.Background(), w, f, format)
+}
+
+func (us *Users) ExportContext(ctx context.Context, w io.Writer, f UserFilters, format string) error {
+	var write func(u *User) error
+	flush := func() error { return nil }
+	switch format {
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(exportColumns)
+		if err != nil {
+			return err
+		}
+		write = func(u *User) error {
+			record, err := exportRecord(u)
+			if err != nil {
+				return err
+			}
+			return cw.Write(record)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		write = func(u *User) error {
+			return enc.Encode(u)
+		}
+	default:
+		return ErrInvalid("'format' must be csv or json.")
+	}
+	where, args := f.where(false)
+	q := us.rebind(us.listSelect() + where + " AND u.id > ? ORDER BY u.id LIMIT ?")
+	var lastId int64
+	for {
+		rows, err := queryRows(ctx, us.db, q, append(args[:len(args):len(args)], lastId, us.MaxPageSize)...)
+		if err != nil {
+			return err
+		}
+		page, err := scanListedUsers(rows)
+		if err != nil {
+			return err
+		}
+		for _, u := range page {
+			err = write(u)
+			if err != nil {
+				return err
+			}
+			lastId = u.Id
+		}
+		// Flushed each page so the output streams
+		err = flush()
+		if err != nil || len(page) < us.MaxPageSize {
+			return err
+		}
+	}
+}
+
+func exportRecord(u *User) ([]string, error) {
+	metadata, err := marshalMetadata(u.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := metadata.(string)
+	return []string{
+		strconv.FormatInt(u.Id, 10), u.Uid, u.Username, u.Email, u.FirstName, u.LastName, u.Phone,
+		strconv.FormatInt(u.OrgId, 10), u.OrgName, strconv.FormatInt(int64(u.Role), 10),
+		strconv.FormatInt(u.Created, 10), strconv.FormatInt(u.Updated, 10), strconv.FormatInt(u.LastLogin, 10),
+		strconv.FormatBool(u.Suspended), strconv.FormatBool(u.Passive), strconv.FormatBool(u.Activated),
+		strconv.FormatBool(u.Verified), m,
+	}, nil
+}
@@ -0,0 +1,49 @@
+package gus
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// PasswordHasher hashes passwords for storage and compares them at sign-in. Hashes should be self-describing,
+// e.g. bcrypt's '$2a$' or the PHC '$argon2id$' prefix, so hashes from different implementations can coexist.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(hash, password string) error
+}
+
+// BcryptHasher is the default PasswordHasher.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (b BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b BcryptHasher) Compare(hash, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+// MigrationHasher hashes new passwords with Hasher while still accepting hashes created by Legacy. Hashes starting
+// with Prefix (e.g. '$argon2id$') are compared with Hasher, everything else with Legacy.
+type MigrationHasher struct {
+	Prefix string
+	Hasher PasswordHasher
+	Legacy PasswordHasher
+}
+
+func (m MigrationHasher) Hash(password string) (string, error) {
+	return m.Hasher.Hash(password)
+}
+
+func (m MigrationHasher) Compare(hash, password string) error {
+	if strings.HasPrefix(hash, m.Prefix) {
+		return m.Hasher.Compare(hash, password)
+	}
+	return m.Legacy.Compare(hash, password)
+}
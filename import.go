@@ -0,0 +1,208 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"github.com/asaskevich/govalidator"
+	"strings"
+)
+
+// importBatchSize keeps each multi-row INSERT within sqlite's default limit of 999 placeholders.
+const importBatchSize = 50
+
+const importColumns = "username, uid, email, first_name, last_name, phone, password_hash, org_id, updated, created, " +
+	"deleted, role, suspended, passive, activated, verified, password_changed"
+
+// ImportUser is a user migrated from another system by BulkImport.
+type ImportUser struct {
+	Email        string `json:"email"`
+	Username     string `json:"username"` // Defaults to the email, always the email when UsernameIsEmail.
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Phone        string `json:"phone"`
+	PasswordHash string `json:"password_hash"` // Stored as is so it must suit the Hasher, e.g. a bcrypt hash.
+	OrgId        int64  `json:"org_id"`
+	Role         Role   `json:"role"` // Defaults like SignUp's, to the org's default_role then UserOpts.DefaultRole.
+	Verified     bool   `json:"verified"`
+	Created      int64  `json:"created"` // Milliseconds, defaults to now.
+}
+
+// BulkImport inserts users migrated from another system with their existing password hashes, using multi-row
+// INSERTs in batches which each run in a transaction. It returns the number imported and, unless all were
+// imported, the error of each user by index, e.g. ErrEmailInvalid or ErrEmailTaken, nil for those imported. A
+// failing user doesn't stop the others. Unlike SignUp no events are sent.
+func (us *Users) BulkImport(users []ImportUser) (int64, []error) {
+	return us.BulkImportContext(context.Background(), users)
+}
+
+func (us *Users) BulkImportContext(ctx context.Context, users []ImportUser) (int64, []error) {
+	rows := make([]ImportUser, len(users))
+	copy(rows, users)
+	errs := make([]error, len(users))
+	emails := map[string]bool{}
+	usernames := map[string]bool{}
+	roles := map[int64]Role{}
+	orgs := map[int64]error{}
+	var valid []int
+	for i := range rows {
+		u := &rows[i]
+		u.Email = NormalizeEmail(u.Email)
+		u.Username = us.normalizeUsername(u.Username)
+		if *us.UsernameIsEmail || u.Username == "" {
+			u.Username = u.Email
+		}
+		switch {
+		case !govalidator.IsEmail(u.Email):
+			errs[i] = ErrEmailInvalid
+		case u.PasswordHash == "":
+			errs[i] = ErrPasswordRequired
+		case emails[u.Email]:
+			errs[i] = ErrEmailTaken
+		case usernames[u.Username]:
+			errs[i] = ErrUsernameTaken
+		}
+		if errs[i] != nil {
+			continue
+		}
+		orgErr, ok := orgs[u.OrgId]
+		if !ok {
+			orgErr = us.checkOrg(ctx, us.db, u.OrgId)
+			orgs[u.OrgId] = orgErr
+		}
+		if orgErr != nil {
+			errs[i] = orgErr
+			continue
+		}
+		emails[u.Email] = true
+		usernames[u.Username] = true
+		if u.Role == 0 {
+			role, ok := roles[u.OrgId]
+			if !ok {
+				var err error
+				role, err = us.defaultRole(ctx, us.db, u.OrgId)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				roles[u.OrgId] = role
+			}
+			u.Role = role
+		}
+		valid = append(valid, i)
+	}
+	var imported int64
+	for start := 0; start < len(valid); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+		batch := valid[start:end]
+		n, err := us.importBatch(ctx, rows, batch, errs)
+		if err != nil {
+			// Retried a row at a time so one failing row, e.g. taken by a concurrent sign up, doesn't fail the others
+			n = us.importRows(ctx, rows, batch, errs)
+		}
+		imported += n
+	}
+	if imported == int64(len(users)) {
+		return imported, nil
+	}
+	return imported, errs
+}
+
+// importBatch inserts the rows at the batch indexes, setting errs for those whose email or username is taken.
+func (us *Users) importBatch(ctx context.Context, rows []ImportUser, batch []int, errs []error) (int64, error) {
+	var imported int64
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		emails, usernames, err := us.importTaken(ctx, tx, rows, batch)
+		if err != nil {
+			return err
+		}
+		now := Milliseconds(us.Clock.Now())
+		var values []string
+		var args []interface{}
+		var inserted []interface{}
+		for _, i := range batch {
+			u := rows[i]
+			if emails[u.Email] {
+				errs[i] = ErrEmailTaken
+				continue
+			}
+			if usernames[u.Username] {
+				errs[i] = ErrUsernameTaken
+				continue
+			}
+			created := u.Created
+			if created == 0 {
+				created = now
+			}
+			values = append(values, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			args = append(args, u.Username, us.UidGen(), u.Email, u.FirstName, u.LastName, u.Phone, u.PasswordHash, u.OrgId,
+				created, created, 0, u.Role, 0, false, true, u.Verified, created)
+			inserted = append(inserted, u.Email)
+		}
+		if len(inserted) == 0 {
+			return nil
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO users ("+importColumns+") VALUES "+strings.Join(values, ", ")), args...)
+		if err != nil {
+			return err
+		}
+		// The same memberships SignUp records
+		in := "(?" + strings.Repeat(", ?", len(inserted)-1) + ")"
+		_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO user_orgs (user_id, org_id, created) SELECT id, org_id, ? FROM users "+
+			"WHERE deleted = 0 AND org_id > 0 AND email IN "+in), append([]interface{}{now}, inserted...)...)
+		if err != nil {
+			return err
+		}
+		imported = int64(len(inserted))
+		return nil
+	})
+	return imported, err
+}
+
+// importRows imports the batch one row at a time after it failed as a whole, setting errs for the rows which fail.
+func (us *Users) importRows(ctx context.Context, rows []ImportUser, batch []int, errs []error) int64 {
+	var imported int64
+	for _, i := range batch {
+		errs[i] = nil
+		n, err := us.importBatch(ctx, rows, []int{i}, errs)
+		if us.Dialect.IsDuplicate(err) {
+			err = us.taken(ctx, 0, rows[i].Email, rows[i].Username)
+		}
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		imported += n
+	}
+	return imported
+}
+
+// importTaken returns which of the batch's emails and usernames live users already have.
+func (us *Users) importTaken(ctx context.Context, tx *sql.Tx, rows []ImportUser, batch []int) (map[string]bool, map[string]bool, error) {
+	var emailArgs, usernameArgs []interface{}
+	for _, i := range batch {
+		emailArgs = append(emailArgs, rows[i].Email)
+		usernameArgs = append(usernameArgs, rows[i].Username)
+	}
+	in := "(?" + strings.Repeat(", ?", len(batch)-1) + ")"
+	res, err := tx.QueryContext(ctx, us.rebind("SELECT email, username FROM users WHERE deleted = 0 AND (email IN "+in+
+		" OR username IN "+in+")"), append(emailArgs, usernameArgs...)...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Close()
+	emails := map[string]bool{}
+	usernames := map[string]bool{}
+	for res.Next() {
+		var email, username sql.NullString
+		err = res.Scan(&email, &username)
+		if err != nil {
+			return nil, nil, err
+		}
+		emails[strings.ToLower(email.String)] = true
+		usernames[username.String] = true
+	}
+	return emails, usernames, res.Err()
+}
@@ -0,0 +1,127 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+)
+
+var (
+	ErrInviteRequired  = ErrInvalidCode("invite_required", "'invite_code' required.")
+	ErrInviteInvalid   = ErrInvalidCode("invite_invalid", "That invite code isn't valid.")
+	ErrInviteExpired   = ErrInvalidCode("invite_expired", "That invite code has expired.")
+	ErrInviteExhausted = ErrInvalidCode("invite_exhausted", "That invite code has been used up.")
+	ErrInviteCodeTaken = ErrInvalidCode("invite_code_taken", "That invite code is taken.")
+)
+
+const inviteCodeLength = 20
+
+// Invite lets users SignUp when UserOpts.RequireInvite is set.
+type Invite struct {
+	Id      int64  `json:"id"`
+	Code    string `json:"code"`
+	OrgId   int64  `json:"org_id"`   // Org given to users signing up with the invite, zero keeps SignUpParams.OrgId.
+	Role    Role   `json:"role"`     // Role given to users signing up with the invite, zero keeps SignUpParams.Role.
+	MaxUses int64  `json:"max_uses"` // Zero is unlimited.
+	Uses    int64  `json:"uses"`
+	Expires int64  `json:"expires"` // Milliseconds, zero never expires.
+	Created int64  `json:"created"`
+}
+
+type CreateInviteParams struct {
+	Code            string `json:"code"` // Optional, a random code is generated when empty.
+	OrgId           int64  `json:"org_id"`
+	Role            Role   `json:"role"`
+	MaxUses         int64  `json:"max_uses"`
+	Expires         int64  `json:"expires"`
+	CustomValidator `json:"-"`
+}
+
+func (va *CreateInviteParams) Validate() error {
+	if va.CustomValidator != nil {
+		return va.CustomValidator()
+	}
+	if len(va.Code) > 30 {
+		return ErrInvalid("'code' can't be longer than 30 chars.")
+	}
+	if va.MaxUses < 0 {
+		return ErrInvalid("'max_uses' can't be negative.")
+	}
+	if va.Expires < 0 {
+		return ErrInvalid("'expires' can't be negative.")
+	}
+	return nil
+}
+
+// CreateInvite adds an invite code, optionally binding the users who sign up with it to an org and role. It returns
+// ErrUnknownOrg if the org doesn't exist.
+func (us *Users) CreateInvite(p CreateInviteParams) (*Invite, error) {
+	return us.CreateInviteContext(context.Background(), p)
+}
+
+func (us *Users) CreateInviteContext(ctx context.Context, p CreateInviteParams) (*Invite, error) {
+	if p.Code == "" {
+		p.Code = randomToken(inviteCodeLength)
+	}
+	i := &Invite{Code: p.Code, OrgId: p.OrgId, Role: p.Role, MaxUses: p.MaxUses, Expires: p.Expires,
+		Created: Milliseconds(us.Clock.Now())}
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := us.checkOrg(ctx, tx, i.OrgId)
+		if err != nil {
+			return err
+		}
+		id, err := us.Dialect.InsertId(ctx, tx, "INSERT INTO invites (code, org_id, role, max_uses, uses, expires, "+
+			"created, deleted) values (?, ?, ?, ?, ?, ?, ?, ?)", i.Code, i.OrgId, i.Role, i.MaxUses, 0, i.Expires, i.Created, 0)
+		i.Id = id
+		return err
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return nil, ErrInviteCodeTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// RevokeInvite stops an invite code from being used for further sign ups.
+func (us *Users) RevokeInvite(code string) error {
+	return us.RevokeInviteContext(context.Background(), code)
+}
+
+func (us *Users) RevokeInviteContext(ctx context.Context, code string) error {
+	stmt, err := us.prepare(ctx, "UPDATE invites SET deleted = 1 WHERE code = ? AND deleted = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.ExecContext(ctx, code))
+}
+
+// useInvite counts a use of the invite code in tx and returns the invite. The use is only counted while the invite
+// has uses remaining so concurrent sign ups can't exceed MaxUses.
+func (us *Users) useInvite(ctx context.Context, tx *sql.Tx, code string) (*Invite, error) {
+	if code == "" {
+		return nil, ErrInviteRequired
+	}
+	i := &Invite{Code: code}
+	err := tx.QueryRowContext(ctx, us.rebind("SELECT id, org_id, role, max_uses, uses, expires, created FROM invites "+
+		"WHERE code = ? AND deleted = 0"), code).Scan(&i.Id, &i.OrgId, &i.Role, &i.MaxUses, &i.Uses, &i.Expires, &i.Created)
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i.Expires > 0 && Milliseconds(us.Clock.Now()) >= i.Expires {
+		return nil, ErrInviteExpired
+	}
+	err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE invites SET uses = uses + 1 WHERE id = ? AND "+
+		"(max_uses = 0 OR uses < max_uses)"), i.Id))
+	if err == ErrNotFound {
+		return nil, ErrInviteExhausted
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.Uses++
+	return i, nil
+}
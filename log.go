@@ -24,3 +24,26 @@ func LogErr(err error) {
 	ErrorLogger.Println(err)
 	ErrorLogger.Output(2, string(debug.Stack()))
 }
+
+// Logger receives structured log lines from Users, keyvals alternate between string keys and their values e.g.
+// Error("recording sign in attempt", "error", err, "username", "bob").
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// NopLogger discards all log lines.
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// log returns the configured Logger or a NopLogger.
+func (us *Users) log() Logger {
+	if us.Logger == nil {
+		return NopLogger{}
+	}
+	return us.Logger
+}
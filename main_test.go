@@ -1,6 +1,7 @@
 package gus
 
 import (
+	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"os"
@@ -9,14 +10,19 @@ import (
 
 var orgsv *Orgs
 var us *Users
+var testDb *sql.DB
+
+func testDsn(dbName string) string {
+	return fmt.Sprintf("%s:%s@tcp(127.0.0.1:%s)/%s?parseTime=true&multiStatements=true", "root", "rootPassword", "3306", dbName)
+}
 
 func TestMain(m *testing.M) {
-	dsn := fmt.Sprintf("%s:%s@tcp(127.0.0.1:%s)/gus_test?parseTime=true&multiStatements=true", "root", "rootPassword", "3306")
-	db, err := GetDb(DbOpts{Seed: true, DriverName: "mysql", DataSourceName: dsn})
+	db, err := GetDb(DbOpts{Seed: true, DriverName: "mysql", DataSourceName: testDsn("gus_test")})
 	defer db.Close()
 	if err != nil {
 		panic(err)
 	}
+	testDb = db
 	orgsv = NewOrgs(db)
 	us = NewUsers(db, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 1 })
 	code := m.Run()
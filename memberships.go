@@ -0,0 +1,165 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+)
+
+var ErrNotOrgMember = ErrInvalidCode("not_org_member", "This user isn't a member of that org.")
+
+// AddToOrg makes the user a member of the org, adding an existing member does nothing. It returns ErrUnknownOrg if
+// the org doesn't exist. The user's active org, OrgId, is unchanged, see SetActiveOrg.
+func (us *Users) AddToOrg(userId int64, orgId int64) error {
+	return us.AddToOrgContext(context.Background(), userId, orgId)
+}
+
+func (us *Users) AddToOrgContext(ctx context.Context, userId int64, orgId int64) error {
+	_, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, us.rebind("SELECT id FROM orgs WHERE id = ? AND deleted = 0"), orgId).Scan(&id)
+		if err == sql.ErrNoRows {
+			return ErrUnknownOrg
+		}
+		if err != nil {
+			return err
+		}
+		return us.addMembership(ctx, tx, userId, orgId)
+	})
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// addMembership makes the user a member of the org in tx unless they already are. Existing members are checked for
+// rather than ignoring the duplicate key error, as on Postgres that error aborts the whole tx.
+func (us *Users) addMembership(ctx context.Context, tx *sql.Tx, userId int64, orgId int64) error {
+	var n int
+	err := tx.QueryRowContext(ctx, us.rebind("SELECT count(*) FROM user_orgs WHERE user_id = ? AND org_id = ?"),
+		userId, orgId).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO user_orgs (user_id, org_id, created) VALUES (?, ?, ?)"),
+		userId, orgId, Milliseconds(us.Clock.Now()))
+	return err
+}
+
+// RemoveFromOrg ends the user's membership of the org, it returns ErrNotFound if they aren't a member. If it was
+// their active org they are left without one, as if by SetOrg with org 0.
+func (us *Users) RemoveFromOrg(userId int64, orgId int64) error {
+	return us.RemoveFromOrgContext(context.Background(), userId, orgId)
+}
+
+func (us *Users) RemoveFromOrgContext(ctx context.Context, userId int64, orgId int64) error {
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	var role Role
+	if !u.Passive {
+		role = us.DefaultRole
+	}
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("DELETE FROM user_orgs WHERE user_id = ? AND org_id = ?"), userId, orgId))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE users SET org_id = 0, role = ?, role_updated = ? WHERE id = ? AND org_id = ?"),
+			role, Milliseconds(us.Clock.Now()), userId, orgId)
+		return err
+	})
+}
+
+// ListOrgs returns the orgs the user is a member of, oldest membership first.
+func (us *Users) ListOrgs(userId int64) ([]*Org, error) {
+	return us.ListOrgsContext(context.Background(), userId)
+}
+
+func (us *Users) ListOrgsContext(ctx context.Context, userId int64) ([]*Org, error) {
+	stmt, err := us.prepare(ctx, "SELECT o.id, o.name, o.type, o.street, o.suburb, o.town, o.postcode, o.country, "+
+		"COALESCE(o.default_role, 0), o.created, o.updated, o.suspended FROM user_orgs m JOIN orgs o ON m.org_id = o.id "+
+		"WHERE m.user_id = ? AND o.deleted = 0 ORDER BY m.created, o.id")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orgs := []*Org{}
+	for rows.Next() {
+		o := &Org{}
+		var suspended int
+		err = rows.Scan(&o.Id, &o.Name, &o.Type, &o.Street, &o.Suburb, &o.Town, &o.Postcode, &o.Country,
+			&o.DefaultRole, &o.Created, &o.Updated, &suspended)
+		if err != nil {
+			return nil, err
+		}
+		o.Suspended = suspended > 0
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// SetActiveOrg switches the user to another org they are a member of, which then populates OrgId and the OrgId of
+// their sign in claims. Unlike SetOrg their role is kept. It returns ErrNotOrgMember if they aren't a member and
+// ErrUnknownOrg if the org is deleted.
+func (us *Users) SetActiveOrg(userId int64, orgId int64) error {
+	return us.SetActiveOrgContext(context.Background(), userId, orgId)
+}
+
+func (us *Users) SetActiveOrgContext(ctx context.Context, userId int64, orgId int64) error {
+	// In a tx so the membership and org can't be removed between being checked and set
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRowContext(ctx, us.rebind("SELECT count(*) FROM user_orgs WHERE user_id = ? AND org_id = ?"),
+			userId, orgId).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrNotOrgMember
+		}
+		err = us.checkOrg(ctx, tx, orgId)
+		if err != nil {
+			return err
+		}
+		return CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET org_id = ? WHERE id = ? AND deleted = 0"),
+			orgId, userId))
+	})
+}
+
+// SwitchOrg is SetActiveOrg for a signed in user, returning their claims for the new org, e.g. to issue a new token.
+// The claims' OrgSuspended is that of the new org. It returns ErrNotAuth if the user isn't a member of the org, the
+// org is deleted or the user is suspended or passive.
+func (us *Users) SwitchOrg(userId int64, orgId int64) (*UserWithClaims, error) {
+	return us.SwitchOrgContext(context.Background(), userId, orgId)
+}
+
+func (us *Users) SwitchOrgContext(ctx context.Context, userId int64, orgId int64) (*UserWithClaims, error) {
+	u, err := us.GetContext(ctx, userId)
+	if err == ErrNotFound {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Suspended || u.Passive {
+		return nil, ErrNotAuth
+	}
+	err = us.SetActiveOrgContext(ctx, userId, orgId)
+	if err == ErrNotOrgMember || err == ErrUnknownOrg {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	uc, _, err := us.getWithClaims(ctx, "u.id = ?", userId)
+	return uc, err
+}
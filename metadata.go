@@ -0,0 +1,103 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// ErrMetadataConflict is returned by SetMetadata when the metadata kept changing concurrently.
+var ErrMetadataConflict = errors.New("gus: metadata changed concurrently")
+
+const metadataRetries = 5
+
+// SetMetadata sets key in the user's Metadata, or deletes it when value is nil. Other keys are kept, including ones
+// set concurrently. Values are stored as JSON so e.g. numbers are read back as float64.
+func (us *Users) SetMetadata(id int64, key string, value interface{}) error {
+	return us.SetMetadataContext(context.Background(), id, key, value)
+}
+
+func (us *Users) SetMetadataContext(ctx context.Context, id int64, key string, value interface{}) error {
+	return us.updateMetadata(ctx, id, map[string]interface{}{key: value})
+}
+
+// GetMetadata returns the value of key in the user's Metadata, or nil if it isn't set.
+func (us *Users) GetMetadata(id int64, key string) (interface{}, error) {
+	return us.GetMetadataContext(context.Background(), id, key)
+}
+
+func (us *Users) GetMetadataContext(ctx context.Context, id int64, key string) (interface{}, error) {
+	u, err := us.GetContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return u.Metadata[key], nil
+}
+
+// updateMetadata merges changes into the user's metadata, nil values delete their keys. The write only succeeds if
+// the metadata hasn't changed since it was read, otherwise it's read again.
+func (us *Users) updateMetadata(ctx context.Context, id int64, changes map[string]interface{}) error {
+	return TxWithRetryContext(ctx, us.db, metadataRetries, isMetadataConflict, func(tx *sql.Tx) error {
+		return us.mergeMetadata(ctx, tx, id, changes)
+	})
+}
+
+func isMetadataConflict(err error) bool {
+	return err == ErrMetadataConflict
+}
+
+// mergeMetadata is the merge of updateMetadata in tx, it returns ErrMetadataConflict for the caller to retry.
+func (us *Users) mergeMetadata(ctx context.Context, tx *sql.Tx, id int64, changes map[string]interface{}) error {
+	var old sql.NullString
+	err := CheckNotFound(tx.QueryRowContext(ctx, us.rebind("SELECT metadata FROM users WHERE id = ? AND deleted = 0"),
+		id).Scan(&old))
+	if err != nil {
+		return err
+	}
+	m, err := parseMetadata(old)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+	metadata, err := marshalMetadata(m)
+	if err != nil {
+		return err
+	}
+	err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET metadata = ?, updated = ? "+
+		"WHERE id = ? AND deleted = 0 AND COALESCE(metadata, '') = ?"), metadata, Milliseconds(us.Clock.Now()), id, old.String))
+	if err == ErrNotFound {
+		return ErrMetadataConflict
+	}
+	return err
+}
+
+// marshalMetadata returns the JSON stored for m, or nil for NULL when m is empty.
+func marshalMetadata(m map[string]interface{}) (interface{}, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func parseMetadata(s sql.NullString) (map[string]interface{}, error) {
+	if s.String == "" {
+		return nil, nil
+	}
+	var m map[string]interface{}
+	err := json.Unmarshal([]byte(s.String), &m)
+	return m, err
+}
@@ -0,0 +1,28 @@
+package gus
+
+// Metrics counts authentication outcomes, e.g. with Prometheus counters.
+type Metrics interface {
+	IncSignUp()
+	// IncSignIn is called for each SignIn, success is false when it returns an error, including when locked.
+	IncSignIn(success bool)
+	// IncLockout is called when sign in gets locked for a username, at most once per AuthLockDuration like OnLockout.
+	IncLockout()
+	// IncPasswordReset is called when ResetPassword issues a reset token.
+	IncPasswordReset()
+}
+
+// NopMetrics ignores all counts.
+type NopMetrics struct{}
+
+func (NopMetrics) IncSignUp()             {}
+func (NopMetrics) IncSignIn(success bool) {}
+func (NopMetrics) IncLockout()            {}
+func (NopMetrics) IncPasswordReset()      {}
+
+// metrics returns the configured Metrics or NopMetrics.
+func (us *Users) metrics() Metrics {
+	if us.Metrics == nil {
+		return NopMetrics{}
+	}
+	return us.Metrics
+}
@@ -5,8 +5,8 @@ const SeedMySql = `
 DROP TABLE IF EXISTS users;
 CREATE TABLE users (
     id INT PRIMARY KEY AUTO_INCREMENT,
-    uid VARCHAR(36) NULL,
-    username VARCHAR(128) NULL,
+    uid VARCHAR(64) NULL,
+    username VARCHAR(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NULL,
     email VARCHAR(128) NULL,
     first_name VARCHAR(128) NULL,
     last_name VARCHAR(128) NULL,
@@ -16,15 +16,22 @@ CREATE TABLE users (
     org_id BIGINT,
     updated BIGINT NULL DEFAULT 0,
     created BIGINT NULL DEFAULT 0,
+    role_updated BIGINT NULL DEFAULT 0,
+    status_updated BIGINT NULL DEFAULT 0,
+    last_login BIGINT NULL DEFAULT 0,
+    last_login_ip VARCHAR(45) NULL,
     suspended tinyint(4),
     deleted tinyint(4),
     role BIGINT,
 	passive TINYINT(2) NULL,
 	activated TINYINT(2) NULL,
-    CONSTRAINT UC_Email UNIQUE (email),
-    CONSTRAINT UC_Username UNIQUE (username)
+	verified TINYINT(2) NULL,
+    must_change_password TINYINT(2) NULL DEFAULT 0,
+    password_changed BIGINT NULL,
+    token_version BIGINT NULL DEFAULT 0,
+    metadata TEXT NULL
 );
-
+` + UniqueLiveUsersMySql + `
 DROP TABLE IF EXISTS password_resets;
 CREATE TABLE password_resets (
     id INT PRIMARY KEY AUTO_INCREMENT,
@@ -35,12 +42,106 @@ CREATE TABLE password_resets (
     deleted tinyint(4)
 );
 
+DROP TABLE IF EXISTS email_changes;
+CREATE TABLE email_changes (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    email VARCHAR(128) NULL,
+    token VARCHAR(256) NULL,
+    created BIGINT NULL DEFAULT 0,
+    deleted tinyint(4)
+);
+
+DROP TABLE IF EXISTS user_orgs;
+CREATE TABLE user_orgs (
+    user_id BIGINT NOT NULL,
+    org_id BIGINT NOT NULL,
+    created BIGINT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, org_id)
+);
+
+DROP TABLE IF EXISTS user_roles;
+CREATE TABLE user_roles (
+    user_id BIGINT NOT NULL,
+    role BIGINT NOT NULL,
+    created BIGINT NULL DEFAULT 0,
+    PRIMARY KEY (user_id, role)
+);
+
+DROP TABLE IF EXISTS recovery_codes;
+CREATE TABLE recovery_codes (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    code_hash VARCHAR(256) NOT NULL,
+    created BIGINT NULL DEFAULT 0,
+    used BIGINT NULL DEFAULT 0
+);
+
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    session_hash VARCHAR(64) NOT NULL UNIQUE,
+    created BIGINT NULL DEFAULT 0,
+    last_seen BIGINT NULL DEFAULT 0,
+    expires BIGINT NULL DEFAULT 0,
+    revoked BIGINT NULL DEFAULT 0
+);
+
+DROP TABLE IF EXISTS trusted_devices;
+CREATE TABLE trusted_devices (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    name VARCHAR(128) NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created BIGINT NULL DEFAULT 0,
+    last_used BIGINT NULL DEFAULT 0,
+    expires BIGINT NULL DEFAULT 0,
+    revoked BIGINT NULL DEFAULT 0
+);
+
+DROP TABLE IF EXISTS api_keys;
+CREATE TABLE api_keys (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    user_id BIGINT NOT NULL,
+    name VARCHAR(128) NULL,
+    key_hash VARCHAR(64) NOT NULL UNIQUE,
+    created BIGINT NULL DEFAULT 0,
+    last_used BIGINT NULL DEFAULT 0,
+    expires BIGINT NULL DEFAULT 0,
+    revoked BIGINT NULL DEFAULT 0
+);
+
+DROP TABLE IF EXISTS signup_keys;
+CREATE TABLE signup_keys (
+    idempotency_key VARCHAR(64) NOT NULL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    fingerprint VARCHAR(64) NULL,
+    created BIGINT NULL DEFAULT 0
+);
+
 DROP TABLE IF EXISTS password_attempts;
 CREATE TABLE password_attempts (
+    id INT PRIMARY KEY AUTO_INCREMENT,
     username VARCHAR(250),
+    client_id VARCHAR(64) NULL,
+    ip VARCHAR(45) NULL,
     created BIGINT NULL DEFAULT 0
 );
 
+DROP TABLE IF EXISTS invites;
+CREATE TABLE invites (
+    id INT PRIMARY KEY AUTO_INCREMENT,
+    code VARCHAR(30) NOT NULL UNIQUE,
+    org_id BIGINT NULL DEFAULT 0,
+    role BIGINT NULL DEFAULT 0,
+    max_uses BIGINT NULL DEFAULT 0,
+    uses BIGINT NULL DEFAULT 0,
+    expires BIGINT NULL DEFAULT 0,
+    created BIGINT NULL DEFAULT 0,
+    deleted tinyint(4)
+);
+
 DROP TABLE IF EXISTS orgs;
 CREATE TABLE orgs (
     id INT PRIMARY KEY AUTO_INCREMENT,
@@ -51,6 +152,7 @@ CREATE TABLE orgs (
     postcode VARCHAR(512) NULL,
     country VARCHAR(512) NULL,
     type INT,
+    default_role BIGINT NULL DEFAULT 0,
     created BIGINT NULL DEFAULT 0,
     updated BIGINT NULL DEFAULT 0,
     suspended tinyint(4),
@@ -58,3 +160,14 @@ CREATE TABLE orgs (
 );
 
 `
+
+// UniqueLiveUsersMySql adds unique indexes on the email and username of users which aren't deleted, so soft deleted
+// users don't block signing up again. MySQL has no partial indexes so the indexes are on generated columns which are
+// NULL for deleted users. Violations are returned as ErrEmailTaken and ErrUsernameTaken. Usernames use a binary
+// collation, as in SeedMySql, so they are case sensitive like sqlite and postgres, see UserOpts.CaseInsensitiveUsernames.
+const UniqueLiveUsersMySql = `
+ALTER TABLE users ADD COLUMN live_email VARCHAR(128) AS (CASE WHEN deleted = 0 THEN email END) VIRTUAL;
+ALTER TABLE users ADD COLUMN live_username VARCHAR(128) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin AS (CASE WHEN deleted = 0 THEN username END) VIRTUAL;
+CREATE UNIQUE INDEX users_live_email ON users (live_email);
+CREATE UNIQUE INDEX users_live_username ON users (live_username);
+`
@@ -3,17 +3,17 @@ package gus
 import (
 	"database/sql"
 	"github.com/asaskevich/govalidator"
-	"time"
 )
 
 var (
-	ErrNameRequired error = ErrInvalid("'name' required.")
+	ErrNameRequired error = ErrInvalidCode("name_required", "'name' required.")
 )
 
 type OrgType int64
 
 func NewOrgs(db *sql.DB) *Orgs {
-	return &Orgs{db: db, Suspender: NewSuspender("orgs", db)}
+	su := NewSuspender("orgs", db)
+	return &Orgs{db: db, Clock: su.clock, Suspender: su}
 }
 
 type Org struct {
@@ -27,13 +27,18 @@ type Org struct {
 	Postcode string `json:"postcode"`
 	Country  string `json:"country"`
 
+	// DefaultRole is given to users signing up or moved into the org without a role, zero falls back to
+	// UserOpts.DefaultRole.
+	DefaultRole Role `json:"default_role"`
+
 	Updated   int64 `json:"updated"`
 	Created   int64 `json:"created"`
 	Suspended bool  `json:"suspended"`
 }
 
 type Orgs struct {
-	db *sql.DB
+	db    *sql.DB
+	Clock Clock // Time source for created and updated, defaults to SystemClock.
 	*Suspender
 }
 
@@ -47,6 +52,8 @@ type CreateOrgParams struct {
 	Postcode string `json:"postcode"`
 	Country  string `json:"country"`
 
+	DefaultRole Role `json:"default_role"`
+
 	CustomValidator `json:"-"`
 }
 
@@ -61,12 +68,12 @@ func (va CreateOrgParams) Validate() error {
 }
 
 func (us *Orgs) Create(p CreateOrgParams) (*Org, error) {
-	stmt, err := us.db.Prepare("INSERT INTO orgs(name, type, street, suburb, town, postcode , country, updated, created, deleted, suspended) values(?,?,?,?,?,?,?,?,?,?,?)")
+	stmt, err := us.db.Prepare("INSERT INTO orgs(name, type, street, suburb, town, postcode , country, default_role, updated, created, deleted, suspended) values(?,?,?,?,?,?,?,?,?,?,?,?)")
 	if err != nil {
 		return nil, err
 	}
-	u := &Org{Name: p.Name, Type: p.Type, Street: p.Street, Suburb: p.Suburb, Town: p.Town, Postcode: p.Postcode, Country: p.Country, Created: Milliseconds(time.Now()), Updated: Milliseconds(time.Now())}
-	res, err := stmt.Exec(u.Name, u.Type, u.Street, u.Suburb, u.Town, u.Postcode, u.Country, u.Updated, u.Created, 0, false)
+	u := &Org{Name: p.Name, Type: p.Type, Street: p.Street, Suburb: p.Suburb, Town: p.Town, Postcode: p.Postcode, Country: p.Country, DefaultRole: p.DefaultRole, Created: Milliseconds(us.Clock.Now()), Updated: Milliseconds(us.Clock.Now())}
+	res, err := stmt.Exec(u.Name, u.Type, u.Street, u.Suburb, u.Town, u.Postcode, u.Country, u.DefaultRole, u.Updated, u.Created, 0, false)
 	if err != nil {
 		return nil, err
 	}
@@ -79,7 +86,7 @@ func (us *Orgs) Create(p CreateOrgParams) (*Org, error) {
 }
 
 func (us *Orgs) Get(id int64) (*Org, error) {
-	stmt, err := us.db.Prepare("SELECT id, name, type, street, suburb, town, postcode, country, created, updated, suspended from orgs WHERE id = ? AND deleted = 0 LIMIT 1")
+	stmt, err := us.db.Prepare("SELECT id, name, type, street, suburb, town, postcode, country, COALESCE(default_role, 0), created, updated, suspended from orgs WHERE id = ? AND deleted = 0 LIMIT 1")
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +94,7 @@ func (us *Orgs) Get(id int64) (*Org, error) {
 	var u Org
 	var suspended int8
 	err = CheckNotFound(row.Scan(&u.Id, &u.Name, &u.Type, &u.Street, &u.Suburb, &u.Town, &u.Postcode, &u.Country,
-		&u.Created, &u.Updated, &suspended))
+		&u.DefaultRole, &u.Created, &u.Updated, &suspended))
 	if err != nil {
 		return nil, err
 	}
@@ -103,6 +110,7 @@ type UpdateOrgParams struct {
 	Town            *string `json:"town"`
 	Postcode        *string `json:"postcode"`
 	Country         *string `json:"country"`
+	DefaultRole     *Role   `json:"default_role"`
 	CustomValidator `json:"-"`
 }
 
@@ -122,17 +130,29 @@ func (us *Orgs) Update(p UpdateOrgParams) error {
 		return err
 	}
 	ApplyUpdates(o, p)
-	stmt, err := us.db.Prepare("UPDATE orgs SET name = ?, street = ?, suburb = ?, town = ?, postcode = ?, country = ?, updated = ? WHERE id = ? AND deleted = 0")
+	stmt, err := us.db.Prepare("UPDATE orgs SET name = ?, street = ?, suburb = ?, town = ?, postcode = ?, country = ?, default_role = ?, updated = ? WHERE id = ? AND deleted = 0")
 	if err != nil {
 		return err
 	}
-	err = CheckUpdated(stmt.Exec(o.Name, o.Street, o.Suburb, o.Town, o.Postcode, o.Country, Milliseconds(time.Now()), o.Id))
+	err = CheckUpdated(stmt.Exec(o.Name, o.Street, o.Suburb, o.Town, o.Postcode, o.Country, o.DefaultRole, Milliseconds(us.Clock.Now()), o.Id))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// Rename changes the org's name, which users see as OrgName.
+func (us *Orgs) Rename(id int64, name string) error {
+	if govalidator.IsNull(name) {
+		return ErrNameRequired
+	}
+	stmt, err := us.db.Prepare("UPDATE orgs SET name = ?, updated = ? WHERE id = ? AND deleted = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.Exec(name, Milliseconds(us.Clock.Now()), id))
+}
+
 type ListOrgsParams struct {
 	ListArgs
 	CustomValidator `json:"-"`
@@ -162,7 +182,7 @@ type OrgListResponse struct {
 }
 
 func (us *Orgs) List(p ListOrgsParams) (*OrgListResponse, error) {
-	q := "SELECT id, name, type, street, suburb, town, postcode, country, created, updated, suspended from orgs WHERE 1"
+	q := "SELECT id, name, type, street, suburb, town, postcode, country, COALESCE(default_role, 0), created, updated, suspended from orgs WHERE 1"
 	countq := "SELECT count(id) FROM orgs WHERE 1"
 
 	args := []interface{}{}
@@ -213,7 +233,7 @@ func (us *Orgs) List(p ListOrgsParams) (*OrgListResponse, error) {
 		u := &Org{}
 		var suspended int
 		rows.Scan(&u.Id, &u.Name, &u.Type, &u.Street, &u.Suburb, &u.Town, &u.Postcode, &u.Country,
-			&u.Created, &u.Updated, &suspended)
+			&u.DefaultRole, &u.Created, &u.Updated, &suspended)
 		u.Suspended = suspended > 0
 		ogs = append(ogs, u)
 	}
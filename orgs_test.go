@@ -3,6 +3,7 @@ package gus
 import (
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 var corg = CreateOrgParams{
@@ -33,12 +34,14 @@ func TestOrgs_Update(t *testing.T) {
 	assert.Nil(t, err)
 	name := "New Name"
 	street := "New Street"
-	up := UpdateOrgParams{Id: &u.Id, Name: &name, Street: &street}
+	role := Role(4)
+	up := UpdateOrgParams{Id: &u.Id, Name: &name, Street: &street, DefaultRole: &role}
 	err = orgsv.Update(up)
 	assert.Nil(t, err)
 	u, _ = orgsv.Get(u.Id)
 	assert.Equal(t, *up.Name, u.Name)
 	assert.Equal(t, *up.Street, u.Street)
+	assert.Equal(t, role, u.DefaultRole)
 
 	// Should not allow update of non-existing record
 	id := int64(33453453)
@@ -56,3 +59,28 @@ func TestOrgs_Delete(t *testing.T) {
 	assert.Nil(t, u)
 	assert.Error(t, err)
 }
+
+func TestOrgs_Clock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	o := NewOrgs(testDb)
+	o.Clock = clock
+	org, err := o.Create(corg)
+	assert.Nil(t, err)
+	org, _ = o.Get(org.Id)
+	assert.Equal(t, Milliseconds(clock.now), org.Created)
+	assert.Equal(t, Milliseconds(clock.now), org.Updated)
+
+	clock.advance(time.Minute)
+	name := "Clocked Inc."
+	err = o.Update(UpdateOrgParams{Id: &org.Id, Name: &name})
+	assert.Nil(t, err)
+	org, _ = o.Get(org.Id)
+	assert.Equal(t, Milliseconds(clock.now), org.Updated)
+
+	clock.advance(time.Minute)
+	err = o.Rename(org.Id, "Clock Rename Inc.")
+	assert.Nil(t, err)
+	org, _ = o.Get(org.Id)
+	assert.Equal(t, "Clock Rename Inc.", org.Name)
+	assert.Equal(t, Milliseconds(clock.now), org.Updated)
+}
@@ -0,0 +1,38 @@
+package gus
+
+// WildcardScope grants every scope to the roles given it, e.g. for a superadmin role.
+const WildcardScope = "*"
+
+// Permissions maps roles to the scopes they grant, e.g. Permissions{1: {"users:read"}, 9: {WildcardScope}}.
+type Permissions map[Role][]string
+
+// Allows reports whether the primary or any additional role in c grants scope. Claims of a suspended org are
+// never allowed.
+func (p Permissions) Allows(c *Claims, scope string) bool {
+	if c == nil || c.OrgSuspended {
+		return false
+	}
+	if p.grants(c.Role, scope) {
+		return true
+	}
+	for _, r := range c.Roles {
+		if p.grants(r, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Permissions) grants(r Role, scope string) bool {
+	for _, s := range p[r] {
+		if s == scope || s == WildcardScope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether c is allowed scope by the UserOpts.Permissions, e.g. to gate an endpoint.
+func (us *Users) HasPermission(c *Claims, scope string) bool {
+	return us.Permissions.Allows(c, scope)
+}
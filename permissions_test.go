@@ -0,0 +1,39 @@
+package gus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPermissions_Allows(t *testing.T) {
+	p := Permissions{
+		1: {"users:read"},
+		2: {"users:read", "users:write"},
+		3: {"billing:read"},
+		9: {WildcardScope},
+	}
+	assert.True(t, p.Allows(&Claims{Role: 1}, "users:read"))
+	assert.False(t, p.Allows(&Claims{Role: 1}, "users:write"))
+	assert.True(t, p.Allows(&Claims{Role: 2}, "users:write"))
+	assert.False(t, p.Allows(&Claims{Role: 4}, "users:read"))
+
+	// Additional roles add their scopes
+	assert.True(t, p.Allows(&Claims{Role: 1, Roles: []Role{3}}, "billing:read"))
+	assert.True(t, p.Allows(&Claims{Role: 4, Roles: []Role{1}}, "users:read"))
+	assert.False(t, p.Allows(&Claims{Role: 1, Roles: []Role{3}}, "users:write"))
+
+	// Wildcard
+	assert.True(t, p.Allows(&Claims{Role: 9}, "users:write"))
+	assert.True(t, p.Allows(&Claims{Role: 1, Roles: []Role{9}}, "anything"))
+
+	assert.False(t, p.Allows(nil, "users:read"))
+	assert.False(t, p.Allows(&Claims{Role: 9, OrgSuspended: true}, "users:read"))
+	assert.False(t, Permissions(nil).Allows(&Claims{Role: 9}, "users:read"))
+}
+
+func TestUsers_HasPermission(t *testing.T) {
+	pus := NewUsers(nil, UserOpts{Permissions: Permissions{1: {"users:read"}}})
+	assert.True(t, pus.HasPermission(&Claims{Role: 1}, "users:read"))
+	assert.False(t, pus.HasPermission(&Claims{Role: 1}, "users:write"))
+	assert.False(t, NewUsers(nil, UserOpts{}).HasPermission(&Claims{Role: 1}, "users:read"))
+}
@@ -0,0 +1,8 @@
+package gus
+
+// UniqueLiveUsersPostgres adds unique indexes on the email and username of users which aren't deleted, so soft
+// deleted users don't block signing up again. Violations are returned as ErrEmailTaken and ErrUsernameTaken.
+const UniqueLiveUsersPostgres = `
+CREATE UNIQUE INDEX users_live_email ON users (email) WHERE deleted = 0;
+CREATE UNIQUE INDEX users_live_username ON users (username) WHERE deleted = 0;
+`
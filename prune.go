@@ -0,0 +1,39 @@
+package gus
+
+import "context"
+
+// PruneAttempts deletes the password_attempts created before olderThan, in milliseconds, and returns how many were
+// deleted, e.g. from a cron. Attempts within AuthLockDuration are kept regardless so current lockouts still apply.
+func (us *Users) PruneAttempts(olderThan int64) (int64, error) {
+	return us.PruneAttemptsContext(context.Background(), olderThan)
+}
+
+func (us *Users) PruneAttemptsContext(ctx context.Context, olderThan int64) (int64, error) {
+	if window := Milliseconds(us.Clock.Now()) - us.AuthLockDuration*1000; olderThan > window {
+		olderThan = window
+	}
+	return us.prune(ctx, "DELETE FROM password_attempts WHERE created < ?", olderThan)
+}
+
+// PruneResets deletes the used, replaced and expired password_resets created before olderThan, in milliseconds, and
+// returns how many were deleted. Reset tokens which can still be used are kept.
+func (us *Users) PruneResets(olderThan int64) (int64, error) {
+	return us.PruneResetsContext(context.Background(), olderThan)
+}
+
+func (us *Users) PruneResetsContext(ctx context.Context, olderThan int64) (int64, error) {
+	expired := Milliseconds(us.Clock.Now()) - us.ResetTokenExpiry*1000
+	return us.prune(ctx, "DELETE FROM password_resets WHERE created < ? AND (deleted = 1 OR created < ?)", olderThan, expired)
+}
+
+func (us *Users) prune(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	stmt, err := us.prepare(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,101 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+)
+
+var (
+	ErrInvalidRecoveryCode = ErrInvalidCode("invalid_recovery_code", "Invalid recovery code.")
+	ErrNoRecoveryCodes     = ErrInvalidCode("no_recovery_codes", "All recovery codes have been used, generate new ones.")
+)
+
+const (
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// GenerateRecoveryCodes replaces the user's recovery codes with new single use ones, the backup for a lost second
+// factor. Only their hashes are stored so the returned codes can't be shown again.
+func (us *Users) GenerateRecoveryCodes(userId int64) ([]string, error) {
+	return us.GenerateRecoveryCodesContext(context.Background(), userId)
+}
+
+func (us *Users) GenerateRecoveryCodesContext(ctx context.Context, userId int64) ([]string, error) {
+	_, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, us.rebind("DELETE FROM recovery_codes WHERE user_id = ?"), userId)
+		if err != nil {
+			return err
+		}
+		stmt, err := tx.PrepareContext(ctx, us.rebind("INSERT INTO recovery_codes (user_id, code_hash, created, used) values (?, ?, ?, ?)"))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for i := range codes {
+			codes[i] = randomToken(recoveryCodeLength)
+			_, err = stmt.ExecContext(ctx, userId, hashToken(codes[i]), Milliseconds(us.Clock.Now()), 0)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the user's recovery codes, e.g. in place of a second factor code. It returns
+// ErrInvalidRecoveryCode for an unknown or used code and ErrNoRecoveryCodes once all have been used. Attempts are
+// counted with the user's sign in attempts, so too many failures return a RateLimitExceededError like SignIn.
+func (us *Users) UseRecoveryCode(userId int64, code string) error {
+	return us.UseRecoveryCodeContext(context.Background(), userId, code)
+}
+
+func (us *Users) UseRecoveryCodeContext(ctx context.Context, userId int64, code string) error {
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	var attemptId int64
+	if !us.DisableLockout {
+		var locked bool
+		attemptId, locked = us.recordAttempt(ctx, u.Username, "", "")
+		if locked {
+			// recordAttempt fails closed so report a cancelled context rather than a lock
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return &RateLimitExceededError{Messages: []string{"Too many recovery code attempts try again later."},
+				RetryAfter: us.lockRetryAfter(ctx, u.Username, "")}
+		}
+	}
+	stmt, err := us.prepare(ctx, "UPDATE recovery_codes SET used = ? WHERE user_id = ? AND code_hash = ? AND used = 0")
+	if err != nil {
+		return err
+	}
+	err = CheckUpdated(stmt.ExecContext(ctx, Milliseconds(us.Clock.Now()), userId, hashToken(code)))
+	if err == nil && !us.DisableLockout {
+		us.clearAttempt(ctx, attemptId, u.Username)
+	}
+	if err != ErrNotFound {
+		return err
+	}
+	var remaining int64
+	err = us.db.QueryRowContext(ctx, us.rebind("SELECT count(id) FROM recovery_codes WHERE user_id = ? AND used = 0"),
+		userId).Scan(&remaining)
+	if err != nil {
+		return err
+	}
+	if remaining == 0 {
+		return ErrNoRecoveryCodes
+	}
+	return ErrInvalidRecoveryCode
+}
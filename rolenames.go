@@ -0,0 +1,113 @@
+package gus
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+var ErrUnknownRole = ErrInvalidCode("unknown_role", "Unknown role.")
+
+// RoleNames names roles, e.g. map[Role]string{1: "member", 9: "admin"}, for logs and APIs which speak role names.
+// Roles are always stored, marshaled and put in tokens as numbers so renaming a role doesn't break them.
+type RoleNames struct {
+	names map[Role]string
+	roles map[string]Role
+}
+
+// NewRoleNames copies names so later changes to the map don't affect it.
+func NewRoleNames(names map[Role]string) *RoleNames {
+	rn := &RoleNames{names: make(map[Role]string, len(names)), roles: make(map[string]Role, len(names))}
+	for r, name := range names {
+		rn.names[r] = name
+		rn.roles[name] = r
+	}
+	return rn
+}
+
+// Name returns the role's name, or its number when it has none.
+func (rn *RoleNames) Name(r Role) string {
+	if rn != nil {
+		if name, ok := rn.names[r]; ok {
+			return name
+		}
+	}
+	return r.String()
+}
+
+// Parse returns the role with the name, or the role numbered by it so numeric roles keep working. It returns
+// ErrUnknownRole otherwise.
+func (rn *RoleNames) Parse(name string) (Role, error) {
+	if rn != nil {
+		if r, ok := rn.roles[name]; ok {
+			return r, nil
+		}
+	}
+	n, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return 0, ErrUnknownRole
+	}
+	return Role(n), nil
+}
+
+// String returns the role's number, see RoleNames for names.
+func (r Role) String() string {
+	return strconv.FormatInt(int64(r), 10)
+}
+
+// NamedRole is a Role for APIs which speak role names, see Users.NamedRole. It marshals to its name, or its number
+// when it has none, and unmarshals from either. Claims and tokens keep plain Roles so renaming a role doesn't
+// break them.
+type NamedRole struct {
+	Role
+	Names *RoleNames `json:"-"`
+}
+
+// String returns the role's name, or its number when it has none.
+func (nr NamedRole) String() string {
+	return nr.Names.Name(nr.Role)
+}
+
+func (nr NamedRole) MarshalJSON() ([]byte, error) {
+	if nr.Names != nil {
+		if name, ok := nr.Names.names[nr.Role]; ok {
+			return json.Marshal(name)
+		}
+	}
+	return json.Marshal(int64(nr.Role))
+}
+
+// UnmarshalJSON accepts a role name, a number or a number in a string. It returns ErrUnknownRole for names which
+// aren't in Names.
+func (nr *NamedRole) UnmarshalJSON(b []byte) error {
+	var n int64
+	if err := json.Unmarshal(b, &n); err == nil {
+		nr.Role = Role(n)
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return ErrUnknownRole
+	}
+	r, err := nr.Names.Parse(name)
+	if err != nil {
+		return err
+	}
+	nr.Role = r
+	return nil
+}
+
+// RoleName returns the role's name from UserOpts.RoleNames, or its number when it has none.
+func (us *Users) RoleName(r Role) string {
+	return us.roleNames.Name(r)
+}
+
+// NamedRole returns r named by UserOpts.RoleNames, e.g. for a json response. Unmarshal into the NamedRole of a zero
+// role to parse names.
+func (us *Users) NamedRole(r Role) NamedRole {
+	return NamedRole{Role: r, Names: us.roleNames}
+}
+
+// ParseRole returns the role named in UserOpts.RoleNames, or numbered by name. It returns ErrUnknownRole otherwise.
+func (us *Users) ParseRole(name string) (Role, error) {
+	return us.roleNames.Parse(name)
+}
@@ -0,0 +1,101 @@
+package gus
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRoleNames(t *testing.T) {
+	var none *RoleNames
+	assert.Equal(t, "9", none.Name(9))
+	r, err := none.Parse("9")
+	assert.Nil(t, err)
+	assert.Equal(t, Role(9), r)
+	_, err = none.Parse("admin")
+	assert.Equal(t, ErrUnknownRole, err)
+
+	names := map[Role]string{1: "member", 9: "admin"}
+	rn := NewRoleNames(names)
+	assert.Equal(t, "admin", rn.Name(9))
+	assert.Equal(t, "5", rn.Name(5))
+	assert.Equal(t, "9", Role(9).String())
+	r, err = rn.Parse("member")
+	assert.Nil(t, err)
+	assert.Equal(t, Role(1), r)
+	r, err = rn.Parse("5")
+	assert.Nil(t, err)
+	assert.Equal(t, Role(5), r)
+	_, err = rn.Parse("owner")
+	assert.Equal(t, ErrUnknownRole, err)
+
+	// The names are copied
+	names[9] = "owner"
+	assert.Equal(t, "admin", rn.Name(9))
+	_, err = rn.Parse("owner")
+	assert.Equal(t, ErrUnknownRole, err)
+
+	// Roles stay numbers in json, e.g. in token claims
+	b, err := json.Marshal(Claims{OrgId: 3, Role: 9, Roles: []Role{1, 5}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `{"role":9,"roles":[1,5],"org_id":3`)
+	var c Claims
+	assert.Nil(t, json.Unmarshal(b, &c))
+	assert.Equal(t, Claims{OrgId: 3, Role: 9, Roles: []Role{1, 5}}, c)
+}
+
+func TestUsers_RoleNames(t *testing.T) {
+	names := map[Role]string{2: "editor"}
+	nus := NewUsers(testDb, UserOpts{RoleNames: names})
+	names[2] = "changed"
+	assert.Equal(t, "editor", nus.RoleName(2))
+	r, err := nus.ParseRole("editor")
+	assert.Nil(t, err)
+	assert.Equal(t, Role(2), r)
+
+	b, err := json.Marshal(nus.NamedRole(2))
+	assert.Nil(t, err)
+	assert.Equal(t, `"editor"`, string(b))
+	nr := nus.NamedRole(0)
+	assert.Nil(t, json.Unmarshal([]byte(`"editor"`), &nr))
+	assert.Equal(t, Role(2), nr.Role)
+
+	// Names are per Users
+	assert.Equal(t, "2", us.RoleName(2))
+	_, err = us.ParseRole("editor")
+	assert.Equal(t, ErrUnknownRole, err)
+}
+
+func TestNamedRole_JSON(t *testing.T) {
+	rn := NewRoleNames(map[Role]string{1: "member", 9: "admin"})
+	type member struct {
+		Role NamedRole `json:"role"`
+	}
+	b, err := json.Marshal(member{Role: NamedRole{Role: 9, Names: rn}})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"role":"admin"}`, string(b))
+	assert.Equal(t, "admin", NamedRole{Role: 9, Names: rn}.String())
+
+	// Unnamed roles, or without names, are numbers
+	b, err = json.Marshal(NamedRole{Role: 5, Names: rn})
+	assert.Nil(t, err)
+	assert.Equal(t, `5`, string(b))
+	b, err = json.Marshal(NamedRole{Role: 9})
+	assert.Nil(t, err)
+	assert.Equal(t, `9`, string(b))
+	assert.Equal(t, "9", NamedRole{Role: 9}.String())
+
+	// Names and numbers, for compatibility, both unmarshal
+	for in, want := range map[string]Role{`"member"`: 1, `"admin"`: 9, `9`: 9, `5`: 5, `"5"`: 5} {
+		m := member{Role: NamedRole{Names: rn}}
+		assert.Nil(t, json.Unmarshal([]byte(`{"role":`+in+`}`), &m), in)
+		assert.Equal(t, want, m.Role.Role, in)
+	}
+
+	// Unknown roles
+	m := member{Role: NamedRole{Names: rn}}
+	assert.Equal(t, ErrUnknownRole, json.Unmarshal([]byte(`{"role":"owner"}`), &m))
+	assert.Equal(t, ErrUnknownRole, json.Unmarshal([]byte(`{"role":true}`), &m))
+	nr := NamedRole{}
+	assert.Equal(t, ErrUnknownRole, json.Unmarshal([]byte(`"admin"`), &nr))
+}
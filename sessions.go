@@ -0,0 +1,167 @@
+package gus
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+var (
+	ErrSessionInvalid  = ErrInvalidCode("session_invalid", "That session isn't valid, please sign in again.")
+	ErrSessionExpired  = ErrInvalidCode("session_expired", "That session has expired, please sign in again.")
+	ErrTooManySessions = ErrInvalidCode("too_many_sessions", "This user has too many sessions, please sign out of another.")
+)
+
+const sessionIdLength = 64
+
+// Session is a server side sign in which, unlike a token, can be revoked. Times are in milliseconds.
+type Session struct {
+	UserId   int64 `json:"user_id"`
+	Created  int64 `json:"created"`
+	LastSeen int64 `json:"last_seen"` // Last successful ValidateSession.
+	Expires  int64 `json:"expires"`
+}
+
+// CreateSession starts a session for the user which expires after SessionExpiry. Only a hash of the returned
+// session id is stored. Once the user has MaxSessions their oldest is revoked, see UserOpts.MaxSessions.
+func (us *Users) CreateSession(userId int64) (string, error) {
+	return us.CreateSessionContext(context.Background(), userId)
+}
+
+func (us *Users) CreateSessionContext(ctx context.Context, userId int64) (string, error) {
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return "", err
+	}
+	if u.Suspended {
+		return "", ErrNotAuth
+	}
+	id := randomToken(sessionIdLength)
+	now := Milliseconds(us.Clock.Now())
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		if us.MaxSessions > 0 {
+			err := us.capSessions(ctx, tx, userId, now)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, us.rebind("INSERT INTO sessions (user_id, session_hash, created, last_seen, expires, revoked) "+
+			"values (?, ?, ?, ?, ?, ?)"), userId, hashToken(id), now, now, now+us.SessionExpiry*1000, 0)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// capSessions makes room for one more of the user's live sessions under MaxSessions by revoking the oldest, or
+// returns ErrTooManySessions when RejectExtraSessions is set.
+func (us *Users) capSessions(ctx context.Context, tx *sql.Tx, userId int64, now int64) error {
+	rows, err := tx.QueryContext(ctx, us.rebind("SELECT id FROM sessions WHERE user_id = ? AND revoked = 0 AND expires > ? "+
+		"ORDER BY created, id"), userId, now)
+	if err != nil {
+		return err
+	}
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	excess := int64(len(ids)) - us.MaxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+	if us.RejectExtraSessions {
+		return ErrTooManySessions
+	}
+	in := "(?" + strings.Repeat(", ?", int(excess)-1) + ")"
+	_, err = tx.ExecContext(ctx, us.rebind("UPDATE sessions SET revoked = ? WHERE id IN "+in), append([]interface{}{now}, ids[:excess]...)...)
+	return err
+}
+
+// ValidateSession returns the session and updates its LastSeen. It returns ErrSessionInvalid for an unknown or
+// revoked session, or one whose user is deleted, suspended, passive or org suspended, and ErrSessionExpired once it
+// has expired.
+func (us *Users) ValidateSession(sessionId string) (*Session, error) {
+	return us.ValidateSessionContext(context.Background(), sessionId)
+}
+
+func (us *Users) ValidateSessionContext(ctx context.Context, sessionId string) (*Session, error) {
+	_, orgSuspendedCol, orgJoin := us.orgColumns()
+	stmt, err := us.prepare(ctx, "SELECT s.id, s.user_id, s.created, s.last_seen, s.expires, s.revoked, u.suspended, u.passive, "+
+		orgSuspendedCol+" FROM sessions s JOIN users u ON u.id = s.user_id"+orgJoin+" WHERE s.session_hash = ? AND u.deleted = 0")
+	if err != nil {
+		return nil, err
+	}
+	var id, revoked int64
+	var suspended, passive, orgSuspended bool
+	s := &Session{}
+	err = stmt.QueryRowContext(ctx, hashToken(sessionId)).Scan(&id, &s.UserId, &s.Created, &s.LastSeen, &s.Expires, &revoked,
+		&suspended, &passive, &orgSuspended)
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if revoked > 0 || suspended || passive || orgSuspended {
+		return nil, ErrSessionInvalid
+	}
+	now := Milliseconds(us.Clock.Now())
+	if now >= s.Expires {
+		return nil, ErrSessionExpired
+	}
+	stmt, err = us.prepare(ctx, "UPDATE sessions SET last_seen = ? WHERE id = ? AND revoked = 0")
+	if err != nil {
+		return nil, err
+	}
+	// A revoke since the select wins.
+	err = CheckUpdated(stmt.ExecContext(ctx, now, id))
+	if err == ErrNotFound {
+		return nil, ErrSessionInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.LastSeen = now
+	return s, nil
+}
+
+// RevokeSession ends a session, e.g. on sign out. It returns ErrNotFound for an unknown or already revoked session.
+func (us *Users) RevokeSession(sessionId string) error {
+	return us.RevokeSessionContext(context.Background(), sessionId)
+}
+
+func (us *Users) RevokeSessionContext(ctx context.Context, sessionId string) error {
+	stmt, err := us.prepare(ctx, "UPDATE sessions SET revoked = ? WHERE session_hash = ? AND revoked = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.ExecContext(ctx, Milliseconds(us.Clock.Now()), hashToken(sessionId)))
+}
+
+// RevokeAllSessions ends all of the user's sessions, ChangePassword, Suspend and Delete call it.
+func (us *Users) RevokeAllSessions(userId int64) error {
+	return us.RevokeAllSessionsContext(context.Background(), userId)
+}
+
+func (us *Users) RevokeAllSessionsContext(ctx context.Context, userId int64) error {
+	return us.revokeSessions(ctx, us.db, userId)
+}
+
+// revokeSessions is RevokeAllSessionsContext with q, e.g. a tx.
+func (us *Users) revokeSessions(ctx context.Context, q execer, userId int64) error {
+	_, err := q.ExecContext(ctx, us.rebind("UPDATE sessions SET revoked = ? WHERE user_id = ? AND revoked = 0"),
+		Milliseconds(us.Clock.Now()), userId)
+	return err
+}
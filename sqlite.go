@@ -5,7 +5,7 @@ DROP TABLE IF EXISTS users;
 
 CREATE TABLE users (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
-    uid VARCHAR(36) NULL,
+    uid VARCHAR(64) NULL,
     username VARCHAR(128) NULL,
     email VARCHAR(128) NULL,
     first_name VARCHAR(128) NULL,
@@ -16,12 +16,21 @@ CREATE TABLE users (
     org_id INT,
     updated DATE NOT NULL,
     created DATE NOT NULL,
+    role_updated INT DEFAULT 0,
+    status_updated INT DEFAULT 0,
+    last_login INT DEFAULT 0,
+    last_login_ip VARCHAR(45) NULL,
     suspended BIT,
     deleted BIT,
     role INT,
-    CONSTRAINT UC_Email UNIQUE (email),
-    CONSTRAINT UC_Username UNIQUE (username)
+    verified BIT,
+    must_change_password BIT DEFAULT 0,
+    password_changed INT NULL,
+    token_version INT DEFAULT 0,
+    metadata TEXT NULL
 );
+CREATE UNIQUE INDEX users_live_email ON users (email) WHERE deleted = 0;
+CREATE UNIQUE INDEX users_live_username ON users (username) WHERE deleted = 0;
 
 DROP TABLE IF EXISTS password_resets;
 CREATE TABLE password_resets (
@@ -33,17 +42,112 @@ CREATE TABLE password_resets (
     deleted BIT
 );
 
+DROP TABLE IF EXISTS email_changes;
+CREATE TABLE email_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL,
+    email VARCHAR(128) NULL,
+    token VARCHAR(256) NULL,
+    created DATE NOT NULL,
+    deleted BIT
+);
+
+DROP TABLE IF EXISTS user_orgs;
+CREATE TABLE user_orgs (
+    user_id INT NOT NULL,
+    org_id INT NOT NULL,
+    created INT NOT NULL,
+    PRIMARY KEY (user_id, org_id)
+);
+
+DROP TABLE IF EXISTS user_roles;
+CREATE TABLE user_roles (
+    user_id INT NOT NULL,
+    role INT NOT NULL,
+    created INT NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
+
+DROP TABLE IF EXISTS recovery_codes;
+CREATE TABLE recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL,
+    code_hash VARCHAR(256) NOT NULL,
+    created INT NOT NULL,
+    used INT DEFAULT 0
+);
+
+DROP TABLE IF EXISTS sessions;
+CREATE TABLE sessions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL,
+    session_hash VARCHAR(64) NOT NULL UNIQUE,
+    created INT NOT NULL,
+    last_seen INT NOT NULL,
+    expires INT NOT NULL,
+    revoked INT DEFAULT 0
+);
+
+DROP TABLE IF EXISTS trusted_devices;
+CREATE TABLE trusted_devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL,
+    name VARCHAR(128) NULL,
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    created INT NOT NULL,
+    last_used INT DEFAULT 0,
+    expires INT DEFAULT 0,
+    revoked INT DEFAULT 0
+);
+
+DROP TABLE IF EXISTS api_keys;
+CREATE TABLE api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INT NOT NULL,
+    name VARCHAR(128) NULL,
+    key_hash VARCHAR(64) NOT NULL UNIQUE,
+    created INT NOT NULL,
+    last_used INT DEFAULT 0,
+    expires INT DEFAULT 0,
+    revoked INT DEFAULT 0
+);
+
+DROP TABLE IF EXISTS signup_keys;
+CREATE TABLE signup_keys (
+    idempotency_key VARCHAR(64) NOT NULL PRIMARY KEY,
+    user_id INT NOT NULL,
+    fingerprint VARCHAR(64) NULL,
+    created INT NOT NULL
+);
+
 DROP TABLE IF EXISTS password_attempts;
 CREATE TABLE password_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
     username VARCHAR(250),
+    client_id VARCHAR(64) NULL,
+    ip VARCHAR(45) NULL,
     created INT NOT NULL
 );
 
+DROP TABLE IF EXISTS invites;
+CREATE TABLE invites (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    code VARCHAR(30) NOT NULL UNIQUE,
+    org_id INT DEFAULT 0,
+    role INT DEFAULT 0,
+    max_uses INT DEFAULT 0,
+    uses INT DEFAULT 0,
+    expires INT DEFAULT 0,
+    created INT NOT NULL,
+    deleted BIT
+);
+
 DROP TABLE IF EXISTS orgs;
 CREATE TABLE orgs (
     id INTEGER PRIMARY KEY AUTOINCREMENT,
     name VARCHAR(128) NOT NULL,
     type INT,
+    default_role INT,
     created DATE NOT NULL,
     updated DATE NOT NULL,
     suspended BIT,
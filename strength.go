@@ -0,0 +1,114 @@
+package gus
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// commonPasswords are matched anywhere in a password by EstimatePasswordStrength, after undoing leet substitutions.
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "abc123", "111111", "letmein", "monkey", "dragon", "iloveyou", "admin",
+	"welcome", "login", "football", "baseball", "master", "sunshine", "princess", "trustno1", "shadow", "superman",
+}
+
+var leetReplacer = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s")
+
+// EstimatePasswordStrength scores a password from 0 (trivially guessable) to 4 (very hard to guess) and suggests
+// how to improve it, e.g. for a strength meter. It doesn't decide acceptance, see UserOpts.PasswordPolicy.
+func EstimatePasswordStrength(password string) (int, []string) {
+	if password == "" {
+		return 0, []string{"Enter a password."}
+	}
+	var feedback []string
+	var lower, upper, digit, other bool
+	var effective, repeats, sequences int
+	var prev rune
+	run := 0 // length of the current repeat or sequence run
+	for i, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+		d := unicode.ToLower(r) - unicode.ToLower(prev)
+		if i > 0 && (d == 0 || ((d == 1 || d == -1) && (unicode.IsLetter(r) || unicode.IsDigit(r)))) {
+			run++
+		} else {
+			run = 0
+		}
+		prev = r
+		// The third and later chars of a run add almost nothing for a guesser
+		if run >= 2 {
+			if d == 0 {
+				repeats++
+			} else {
+				sequences++
+			}
+			continue
+		}
+		effective++
+	}
+	pool := 0
+	classes := 0
+	for _, c := range []struct {
+		has  bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if c.has {
+			pool += c.size
+			classes++
+		}
+	}
+	perChar := math.Log2(float64(pool))
+	bits := float64(effective) * perChar
+
+	lowered := strings.ToLower(password)
+	for _, s := range []string{lowered, leetReplacer.Replace(lowered)} {
+		for _, common := range commonPasswords {
+			if strings.Contains(s, common) {
+				// A guesser tries the common passwords first, leaving only the rest of the password to guess
+				bits -= float64(utf8.RuneCountInString(common))*perChar - math.Log2(float64(len(commonPasswords)))
+				feedback = append(feedback, "Avoid common passwords and words, substitutions like '0' for 'o' don't help.")
+				break
+			}
+		}
+		if feedback != nil {
+			break
+		}
+	}
+	if repeats > 0 {
+		feedback = append(feedback, "Avoid repeated chars like 'aaa'.")
+	}
+	if sequences > 0 {
+		feedback = append(feedback, "Avoid sequences like 'abc' or '123'.")
+	}
+	if utf8.RuneCountInString(password) < 12 {
+		feedback = append(feedback, "Use a longer password, a few random words are easy to remember.")
+	}
+	if classes < 3 {
+		feedback = append(feedback, "Mix upper and lower case letters, numbers and symbols.")
+	}
+
+	score := 4
+	switch {
+	case bits < 25:
+		score = 0
+	case bits < 40:
+		score = 1
+	case bits < 60:
+		score = 2
+	case bits < 80:
+		score = 3
+	}
+	if score == 4 {
+		feedback = nil
+	}
+	return score, feedback
+}
@@ -0,0 +1,31 @@
+package gus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEstimatePasswordStrength(t *testing.T) {
+	for _, pw := range []string{"", "password", "P@ssw0rd", "aaaaaaaaaaaa", "abcdefgh", "12345678", "qwerty123", "Monkey1"} {
+		score, feedback := EstimatePasswordStrength(pw)
+		assert.True(t, score <= 1, pw)
+		assert.NotEmpty(t, feedback, pw)
+	}
+	for _, pw := range []string{"correct horse battery staple", "X9#kq2!vLp7@zR", "gT8$wQ!m2Zr&Lx5p"} {
+		score, feedback := EstimatePasswordStrength(pw)
+		assert.Equal(t, 4, score, pw)
+		assert.Nil(t, feedback, pw)
+	}
+
+	_, feedback := EstimatePasswordStrength("zzzzzz")
+	assert.Contains(t, feedback, "Avoid repeated chars like 'aaa'.")
+	_, feedback = EstimatePasswordStrength("Kp9!xyz")
+	assert.Contains(t, feedback, "Avoid sequences like 'abc' or '123'.")
+
+	// Longer and more varied passwords never score lower
+	weak, _ := EstimatePasswordStrength("kpqwmz")
+	better, _ := EstimatePasswordStrength("kpqwmzRt")
+	best, _ := EstimatePasswordStrength("kpqwmzRt7!vb")
+	assert.True(t, weak <= better && better <= best)
+	assert.True(t, weak < best)
+}
@@ -1,48 +1,65 @@
 package gus
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"time"
 )
 
 func NewSuspender(table string, db *sql.DB) *Suspender {
-	return &Suspender{table: table, db: db}
+	return &Suspender{table: table, db: db, updatedColumn: "updated", clock: SystemClock{}}
 }
 
 type Suspender struct {
-	table string
-	db    *sql.DB
+	table         string
+	db            *sql.DB
+	updatedColumn string // Timestamp column set by Suspend and Restore.
+	clock         Clock
+	dialect       Dialect // Rebinds the queries' placeholders, MySqlDialect when nil.
 }
 
 func (su *Suspender) Suspend(id int64) error {
-	stmt, err := su.db.Prepare(fmt.Sprintf("UPDATE %s SET suspended = 1, updated = ? WHERE id = ? AND deleted = 0", su.table))
-	if err != nil {
-		return err
-	}
-	return CheckUpdated(stmt.Exec(Milliseconds(time.Now()), id))
+	return su.SuspendContext(context.Background(), id)
+}
+
+func (su *Suspender) SuspendContext(ctx context.Context, id int64) error {
+	return su.suspend(ctx, su.db, id)
+}
+
+// suspend is SuspendContext with q, e.g. a tx.
+func (su *Suspender) suspend(ctx context.Context, q execer, id int64) error {
+	return su.exec(ctx, q, fmt.Sprintf("UPDATE %s SET suspended = 1, %s = ? WHERE id = ? AND deleted = 0", su.table, su.updatedColumn), id)
 }
 
 func (su *Suspender) Restore(id int64) error {
-	stmt, err := su.db.Prepare(fmt.Sprintf("UPDATE %s SET suspended = 0, updated = ? WHERE id = ? AND deleted = 0", su.table))
-	if err != nil {
-		return err
-	}
-	return CheckUpdated(stmt.Exec(Milliseconds(time.Now()), id))
+	return su.RestoreContext(context.Background(), id)
+}
+
+func (su *Suspender) RestoreContext(ctx context.Context, id int64) error {
+	return su.exec(ctx, su.db, fmt.Sprintf("UPDATE %s SET suspended = 0, %s = ? WHERE id = ? AND deleted = 0", su.table, su.updatedColumn), id)
 }
 
 func (su *Suspender) Delete(id int64) error {
-	stmt, err := su.db.Prepare(fmt.Sprintf("UPDATE %s SET deleted = 1, updated = ? WHERE id = ? AND deleted = 0", su.table))
-	if err != nil {
-		return err
-	}
-	return CheckUpdated(stmt.Exec(Milliseconds(time.Now()), id))
+	return su.DeleteContext(context.Background(), id)
+}
+
+func (su *Suspender) DeleteContext(ctx context.Context, id int64) error {
+	return su.exec(ctx, su.db, fmt.Sprintf("UPDATE %s SET deleted = 1, updated = ? WHERE id = ? AND deleted = 0", su.table), id)
 }
 
 func (su *Suspender) UnDelete(id int64) error {
-	stmt, err := su.db.Prepare(fmt.Sprintf("UPDATE %s SET deleted = 0, updated = ? WHERE id = ? AND deleted = 1", su.table))
-	if err != nil {
-		return err
+	return su.UnDeleteContext(context.Background(), id)
+}
+
+func (su *Suspender) UnDeleteContext(ctx context.Context, id int64) error {
+	return su.exec(ctx, su.db, fmt.Sprintf("UPDATE %s SET deleted = 0, updated = ? WHERE id = ? AND deleted = 1", su.table), id)
+}
+
+// exec runs the query, which sets the updated timestamp of the row with the id, returning ErrNotFound if no row
+// changed.
+func (su *Suspender) exec(ctx context.Context, q execer, query string, id int64) error {
+	if su.dialect != nil {
+		query = su.dialect.Rebind(query)
 	}
-	return CheckUpdated(stmt.Exec(Milliseconds(time.Now()), id))
+	return CheckUpdated(q.ExecContext(ctx, query, Milliseconds(su.clock.Now()), id))
 }
@@ -0,0 +1,125 @@
+package gus
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TokenIssuer issues a signed token for a signed in user, see Users.SignInWithToken.
+type TokenIssuer interface {
+	Issue(u *UserWithClaims) (string, error)
+}
+
+// TokenParser verifies the tokens of a TokenIssuer and returns their claims, see Users.ValidateToken.
+type TokenParser interface {
+	Parse(token string) (*TokenClaims, error)
+}
+
+// HMACIssuer issues HS256 signed JWTs containing the user's uid and Claims.
+type HMACIssuer struct {
+	Key    []byte        // Signing key, should be at least 32 random bytes.
+	Expiry time.Duration // Lifetime of issued tokens, defaults to 1 hour.
+	Clock  Clock         // Time tokens are issued and checked at, defaults to SystemClock.
+}
+
+// TokenClaims is the JWT payload issued by HMACIssuer.
+type TokenClaims struct {
+	Claims
+	Subject  string `json:"sub"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (h HMACIssuer) Issue(u *UserWithClaims) (string, error) {
+	expiry := h.Expiry
+	if expiry == 0 {
+		expiry = time.Hour
+	}
+	now := h.now()
+	tc := TokenClaims{Subject: u.Uid, IssuedAt: now.Unix(), Expires: now.Add(expiry).Unix()}
+	if u.Claims != nil {
+		tc.Claims = *u.Claims
+	}
+	payload, err := json.Marshal(tc)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + h.sign(unsigned), nil
+}
+
+// Parse verifies a token issued by Issue and returns its claims. It returns ErrNotAuth if the token is malformed or
+// the signature doesn't match and ErrTokenExpired once it has expired.
+func (h HMACIssuer) Parse(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrNotAuth
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(h.sign(parts[0]+"."+parts[1]))) {
+		return nil, ErrNotAuth
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrNotAuth
+	}
+	var tc TokenClaims
+	if err = json.Unmarshal(payload, &tc); err != nil {
+		return nil, ErrNotAuth
+	}
+	if h.now().Unix() >= tc.Expires {
+		return nil, ErrTokenExpired
+	}
+	return &tc, nil
+}
+
+func (h HMACIssuer) now() time.Time {
+	if h.Clock == nil {
+		return time.Now()
+	}
+	return h.Clock.Now()
+}
+
+func (h HMACIssuer) sign(unsigned string) string {
+	mac := hmac.New(sha256.New, h.Key)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// statelessToken returns a token binding id to purpose until expires (unix seconds), signed with key. It needs no
+// storage, the format is "id.expires.signature".
+func statelessToken(key []byte, purpose string, id int64, expires int64) string {
+	unsigned := strconv.FormatInt(id, 10) + "." + strconv.FormatInt(expires, 10)
+	return unsigned + "." + HMACIssuer{Key: key}.sign(purpose+"."+unsigned)
+}
+
+// parseStatelessToken returns the id of a token created by statelessToken for the same key and purpose. It returns
+// ErrInvalidResetToken if the token is malformed or the signature doesn't match and ErrTokenExpired if it has
+// expired at now.
+func parseStatelessToken(key []byte, purpose string, token string, now time.Time) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalidResetToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(HMACIssuer{Key: key}.sign(purpose+"."+parts[0]+"."+parts[1]))) {
+		return 0, ErrInvalidResetToken
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidResetToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidResetToken
+	}
+	if now.Unix() >= expires {
+		return 0, ErrTokenExpired
+	}
+	return id, nil
+}
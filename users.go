@@ -1,38 +1,153 @@
 package gus
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/json"
 	"github.com/asaskevich/govalidator"
 	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
+	"math"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
-	ErrEmailTaken              = ErrInvalid("That email is taken.")
-	ErrUsernameTaken           = ErrInvalid("That username is taken.")
-	ErrEmailInvalid            = ErrInvalid("'email' invalid.")
-	ErrEmailRequired           = ErrInvalid("'email' required.")
-	ErrUsernameRequired        = ErrInvalid("'username' required.")
-	ErrUsernameOrEmailRequired = ErrInvalid("'username' or 'email' required.")
-	ErrPasswordRequired        = ErrInvalid("'password' required.")
-	ErrInvalidResetToken       = ErrInvalid("Invalid reset token.")
-	ErrPasswordInvalid         = ErrInvalid(
+	ErrNoTokenIssuer           = errors.New("gus: UserOpts.TokenIssuer is not set")
+	ErrNoTokenParser           = errors.New("gus: UserOpts.TokenIssuer is not a TokenParser")
+	ErrNoStatelessTokenKey     = errors.New("gus: UserOpts.StatelessTokenKey is not set")
+	ErrEmailTaken              = ErrInvalidCode("email_taken", "That email is taken.")
+	ErrUsernameTaken           = ErrInvalidCode("username_taken", "That username is taken.")
+	ErrEmailInvalid            = ErrInvalidCode("email_invalid", "'email' invalid.")
+	ErrEmailRequired           = ErrInvalidCode("email_required", "'email' required.")
+	ErrUsernameRequired        = ErrInvalidCode("username_required", "'username' required.")
+	ErrUsernameOrEmailRequired = ErrInvalidCode("username_or_email_required", "'username' or 'email' required.")
+	ErrUsernameIsEmail         = ErrInvalidCode("username_is_email", "The username is the email, change the email instead.")
+	ErrPasswordRequired        = ErrInvalidCode("password_required", "'password' required.")
+	ErrIdRequired              = ErrInvalidCode("id_required", "'id' required.")
+	ErrPhoneInvalid            = ErrInvalidCode("phone_invalid", "'phone' must be in E.164 format, e.g. +61400000000.")
+	ErrInvalidResetToken       = ErrInvalidCode("invalid_reset_token", "Invalid reset token.")
+	ErrPasswordUnchanged       = ErrInvalidCode("password_unchanged", "New password must differ from the current one.")
+	ErrAlreadyVerified         = ErrInvalidCode("already_verified", "That email is already verified.")
+	ErrEmailNotVerified        = ErrInvalidCode("email_not_verified", "That email has not been verified.")
+	ErrPassiveUser             = ErrInvalidCode("passive_user", "This user is passive, it can't sign in or change the password.")
+	ErrUserSuspended           = ErrInvalidCode("user_suspended", "This user is suspended.")
+	ErrOrgSuspended            = ErrInvalidCode("org_suspended", "This user's org is suspended.")
+	ErrUnknownOrg              = ErrInvalidCode("unknown_org", "Unknown org.")
+	ErrIdempotencyKeyReused    = ErrInvalidCode("idempotency_key_reused", "That idempotency key was used by a different sign up.")
+	ErrNotPassive              = ErrInvalidCode("not_passive", "This user isn't passive.")
+	ErrPasswordBreached        = ErrInvalidCode("password_breached", "That password has appeared in a data breach, please choose another.")
+	ErrPasswordChangeRequired  = ErrInvalidCode("password_change_required", "Your password must be changed before signing in.")
+	ErrPasswordInvalid         = ErrInvalidCode("password_invalid",
 		"'new_password' must contain: 1 Upper, 1 Lower, 1 Number, 1 Special and 8 Chars",
 		"OR any alphanumeric with a minimum of 15 chars.")
 )
 
+const defaultBcryptCost = 12
+
+// minGeneratedLength is the least UserOpts.GeneratedPasswordLength and ResetTokenLength.
+const minGeneratedLength = 32
+
 type Role int64
 
 type UserOpts struct {
-	AuthAttempts     int64       // Maximum amount of times a user can attempt to login with a given username.
+	// AuthAttempts is the number of failed sign ins allowed for a username within AuthLockDuration, defaults to 5.
+	// The limit is inclusive: after the 5th failure the next attempt is rejected, even with the right password.
+	AuthAttempts     int64
 	AuthLockDuration int64       // Seconds which the user will be locked out if MaxAuthAttempts has been exceeded.
 	PassGen          PasswordGen // A function used to generate passwords and reset tokens
 	// (as opposed to registered) this is the length of the generated password length.
-	UsernameIsEmail  *bool // When true (default) the username is the email address. When false the username can be specified independently. In either scenario both can be used to sign in with the password.
-	ResetTokenExpiry int64 // ResetTokenExpiry Seconds before token expired.
+	UsernameIsEmail  *bool          // When true (default) the username is the email address. When false the username can be specified independently. In either scenario both can be used to sign in with the password.
+	ResetTokenExpiry int64          // ResetTokenExpiry Seconds before token expired.
+	BcryptCost       int            // Cost used when hashing passwords, defaults to 12 if zero or outside bcrypt.MinCost and bcrypt.MaxCost.
+	Hasher           PasswordHasher // Hashes and compares passwords, defaults to a BcryptHasher using BcryptCost.
+	// MaxStoredAttempts caps the password_attempts kept per username, older rows are deleted on each attempt. Zero
+	// keeps all attempts, otherwise it is raised to at least AuthAttempts+1 so the lock can still be reached.
+	MaxStoredAttempts int64
+	// ClientAuthAttempts is the maximum amount of sign in attempts from a SignInParams.ClientId, across all
+	// usernames, within AuthLockDuration. Zero doesn't limit clients.
+	ClientAuthAttempts int64
+	// CaseInsensitiveUsernames lowercases usernames, when UsernameIsEmail is false, as they are stored and looked up
+	// so "Alice" and "alice" are the same login. Usernames stored before it was set must be lowercased to match.
+	// Otherwise usernames are case sensitive, SeedMySql gives them a binary collation so MySQL agrees with sqlite.
+	CaseInsensitiveUsernames bool
+	// ForbidEmailUsernameCollision rejects a username equal to another user's email and vice versa, so one login
+	// can't be mistaken for another.
+	ForbidEmailUsernameCollision bool
+	TokenIssuer                  TokenIssuer // Issues tokens for SignInWithToken, e.g. HMACIssuer.
+	// RequireVerifiedEmail rejects sign in until VerifyEmail has been called, SignUp then also returns an activation
+	// token when a password is given.
+	RequireVerifiedEmail bool
+	// PasswordChangeActivatesPassive allows passive users to be sent a reset token and makes them active once they
+	// use it to set a password. When false ChangePassword returns ErrPassiveUser for passive users.
+	PasswordChangeActivatesPassive bool
+	Dialect                        Dialect // SQL dialect of the db, defaults to MySqlDialect which also suits sqlite3.
+	// StatelessTokenKey signs the tokens of IssueStatelessActivationToken, which expire after ResetTokenExpiry. It
+	// should be at least 32 random bytes.
+	StatelessTokenKey []byte
+	DefaultRole       Role // Role given by SignUp and SetOrg when none is given and the org has no default_role.
+	// UseOrgs (default true) joins users to the orgs table. When false the orgs table isn't needed, OrgName and
+	// OrgSuspended are always zero and org default roles are ignored.
+	UseOrgs    *bool
+	Translator Translator // Localizes the messages of coded errors returned by Message.
+	// BreachChecker rejects compromised passwords with ErrPasswordBreached in SignUp and ChangePassword, e.g.
+	// HIBPChecker. If the check itself fails the password is accepted, unless BreachCheckFailClosed is set.
+	BreachChecker         BreachChecker
+	BreachCheckFailClosed bool
+	EventSink             EventSink   // Notified of sign ups, sign ins, password changes, suspensions, deletes and lockouts.
+	Logger                Logger      // Receives debug and error logs, they are discarded when nil.
+	Metrics               Metrics     // Counts sign ups, sign ins, lockouts and password resets.
+	Permissions           Permissions // Scopes granted by each role, see HasPermission.
+	Clock                 Clock       // Time source for timestamps, lockouts and token expiry, defaults to SystemClock.
+	// RequireInvite rejects a SignUp without a valid SignUpParams.InviteCode from CreateInvite, each sign up uses
+	// the invite once. Passive users don't need an invite.
+	RequireInvite bool
+	SessionExpiry int64 // Seconds before a session from CreateSession expires, defaults to 30 days.
+	APIKeyExpiry  int64 // Seconds before a key from CreateAPIKey expires, zero never expires.
+	// MaxSessions caps each user's live sessions, zero is unlimited. CreateSession revokes the oldest to make room,
+	// or returns ErrTooManySessions when RejectExtraSessions is set.
+	MaxSessions         int64
+	RejectExtraSessions bool
+	// TrustedDeviceExpiry is the seconds a device from TrustDevice can skip the second factor, defaults to 30 days.
+	TrustedDeviceExpiry int64
+	// PasswordPolicy rejects passwords given to SignUp, PromoteUser, ChangePassword, AdminSetPassword and
+	// ValidatePasswords, e.g. PasswordRules.Check. Defaults to ValidatePassword, returning ErrPasswordInvalid.
+	PasswordPolicy func(password string) error
+	// IdempotencyKeyExpiry is the seconds for which a SignUpParams.IdempotencyKey returns the same user, defaults to
+	// a day. The replayed SignUp doesn't return the activation token again.
+	IdempotencyKeyExpiry int64
+	// PassiveEmailDomain is the domain of the emails generated for passive users signing up without one, defaults
+	// to "passive-user.gus". The addresses are never sent to so it should be a domain which doesn't accept mail.
+	PassiveEmailDomain string
+	MaxPageSize        int // Largest ListArgs.Size returned by List, larger sizes are reduced to it. Defaults to 100.
+	// DetailedSignInErrors makes SignIn return ErrUserSuspended, ErrOrgSuspended or ErrPassiveUser instead of
+	// ErrNotAuth once the password is correct, so the user can be told why. Wrong credentials are always ErrNotAuth.
+	DetailedSignInErrors bool
+	// HideResetEnumeration makes ResetPassword return an empty token and no error for unknown emails and passive
+	// users, so callers respond the same whether or not an account exists.
+	HideResetEnumeration bool
+	// WebhookURL receives a POST of each event, as sent to EventSink, signed with WebhookSecret. See WebhookSink.
+	WebhookURL    string
+	WebhookSecret []byte
+	// DisableLockout turns off AuthAttempts and ClientAuthAttempts, e.g. for internal tools. Failed sign ins then
+	// aren't recorded, so RecentAttempts is empty and OnLockout is never sent.
+	DisableLockout bool
+	// UidGen generates the uids of SignUp and RotateUid, e.g. ULIDs or prefixed ids, defaults to a uuid v4. Uids
+	// can be up to 64 chars.
+	UidGen func() string
+	// RoleNames names roles for RoleName and ParseRole, it's copied by NewUsers.
+	RoleNames map[Role]string
+	// GeneratedPasswordLength is the length of the passwords SignUp and PromoteUser generate when none is given, and
+	// ResetTokenLength of the tokens of ResetPassword and RequestEmailChange. Both default to 128 and are raised to
+	// at least 32 so they can't be guessed.
+	GeneratedPasswordLength int64
+	ResetTokenLength        int64
+	// DisposableDomainChecker rejects the emails of SignUp and PromoteUser with ErrDisposableEmail, e.g.
+	// DefaultDisposableDomains. The emails generated for passive users aren't checked.
+	DisposableDomainChecker DisposableDomainChecker
 }
 
 type User struct {
@@ -45,23 +160,97 @@ type User struct {
 	Phone     string `json:"phone"`
 	OrgId     int64  `json:"org_id"`
 	OrgName   string `json:"org_name"`
-	Updated   int64  `json:"updated"`
+	Updated   int64  `json:"updated"` // Last profile change, see RoleUpdated and StatusUpdated for administrative ones.
 	Created   int64  `json:"created"`
-	Role      Role   `json:"role"`
-	Activated bool   `json:"activated"`
-	Passive   bool   `json:"passive"`
-	Suspended bool   `json:"suspended"`
+
+	RoleUpdated   int64 `json:"role_updated"`   // Last change of role or org.
+	StatusUpdated int64 `json:"status_updated"` // Last suspension or restore.
+
+	LastLogin   int64  `json:"last_login"`    // Last successful SignIn, zero if never.
+	LastLoginIP string `json:"last_login_ip"` // SignInParams.IP of the last successful SignIn.
+
+	Role      Role `json:"role"`
+	Activated bool `json:"activated"`
+	Verified  bool `json:"verified"`
+	Passive   bool `json:"passive"`
+	Suspended bool `json:"suspended"`
+	// MustChangePassword is set by AdminSetPassword with forceChange and by ExpirePasswords, SignIn then returns
+	// ErrPasswordChangeRequired until ChangePassword is called.
+	MustChangePassword bool `json:"must_change_password"`
+
+	Metadata map[string]interface{} `json:"metadata,omitempty"` // App defined attributes, see SetMetadata.
+}
+
+// CreatedTime returns Created as a time.Time.
+func (u *User) CreatedTime() time.Time {
+	return FromMilliseconds(u.Created)
+}
+
+// UpdatedTime returns Updated as a time.Time.
+func (u *User) UpdatedTime() time.Time {
+	return FromMilliseconds(u.Updated)
 }
 
 type UserWithClaims struct {
 	*User
 	*Claims
+	// TrustedDevice is set by SignIn when SignInParams.DeviceToken is one of the user's trusted devices, so the
+	// second factor can be skipped. It isn't part of the json.
+	TrustedDevice bool
+}
+
+// userWithClaimsJSON is the flattened json form of UserWithClaims. The claims fields are declared at the top level
+// so they take precedence over the duplicated User fields, and a nil *User is simply omitted.
+type userWithClaimsJSON struct {
+	*User
+	Role         Role   `json:"role"`
+	Roles        []Role `json:"roles,omitempty"`
+	OrgId        int64  `json:"org_id"`
+	OrgSuspended bool   `json:"org_suspended"`
+	TokenVersion int64  `json:"token_version,omitempty"`
+}
+
+func (uc UserWithClaims) MarshalJSON() ([]byte, error) {
+	j := userWithClaimsJSON{User: uc.User}
+	if uc.Claims != nil {
+		j.Role, j.Roles, j.OrgId, j.OrgSuspended = uc.Claims.Role, uc.Claims.Roles, uc.Claims.OrgId, uc.Claims.OrgSuspended
+		j.TokenVersion = uc.Claims.TokenVersion
+	} else if uc.User != nil {
+		j.Role, j.OrgId = uc.User.Role, uc.User.OrgId
+	}
+	return json.Marshal(j)
+}
+
+func (uc *UserWithClaims) UnmarshalJSON(b []byte) error {
+	var j userWithClaimsJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.User != nil {
+		j.User.Role, j.User.OrgId = j.Role, j.OrgId
+	}
+	uc.User = j.User
+	uc.Claims = &Claims{Role: j.Role, Roles: j.Roles, OrgId: j.OrgId, OrgSuspended: j.OrgSuspended,
+		TokenVersion: j.TokenVersion}
+	return nil
 }
 
 type Claims struct {
-	Role         Role  `json:"role"`
-	OrgId        int64 `json:"org_id"`
-	OrgSuspended bool  `json:"org_suspended"`
+	Role         Role   `json:"role"`            // Primary role.
+	Roles        []Role `json:"roles,omitempty"` // Additional roles, see AddRole.
+	OrgId        int64  `json:"org_id"`
+	OrgSuspended bool   `json:"org_suspended"`
+	// TokenVersion is bumped by BumpTokenVersion so ValidateToken rejects the tokens issued before.
+	TokenVersion int64 `json:"token_version,omitempty"`
+}
+
+// Authorize returns ErrNotAuth unless the claims belong to the given org, have at least minRole and the org isn't
+// suspended.
+func Authorize(c *Claims, orgId int64, minRole Role) error {
+	if c == nil || c.OrgId != orgId || c.Role < minRole || c.OrgSuspended {
+		return ErrNotAuth
+	}
+	return nil
 }
 
 type UserWithToken struct {
@@ -70,51 +259,157 @@ type UserWithToken struct {
 }
 
 func NewUsers(db *sql.DB, opt UserOpts) *Users {
+	if opt.AuthAttempts < 1 {
+		opt.AuthAttempts = 5
+	}
 	if opt.AuthLockDuration == 0 {
 		opt.AuthLockDuration = 5 * 60
 	}
 	if opt.ResetTokenExpiry == 0 {
 		opt.ResetTokenExpiry = 24 * 60 * 60 * 1000
 	}
+	if opt.MaxPageSize < 1 {
+		opt.MaxPageSize = 100
+	}
+	if opt.PassiveEmailDomain == "" {
+		opt.PassiveEmailDomain = "passive-user.gus"
+	}
+	if opt.IdempotencyKeyExpiry == 0 {
+		opt.IdempotencyKeyExpiry = 24 * 60 * 60
+	}
+	if opt.TrustedDeviceExpiry == 0 {
+		opt.TrustedDeviceExpiry = 30 * 24 * 60 * 60
+	}
+	if opt.SessionExpiry == 0 {
+		opt.SessionExpiry = 30 * 24 * 60 * 60
+	}
+	if opt.BcryptCost < bcrypt.MinCost || opt.BcryptCost > bcrypt.MaxCost {
+		opt.BcryptCost = defaultBcryptCost
+	}
+	if opt.MaxStoredAttempts > 0 && opt.MaxStoredAttempts <= opt.AuthAttempts {
+		opt.MaxStoredAttempts = opt.AuthAttempts + 1
+	}
+	if opt.Hasher == nil {
+		opt.Hasher = BcryptHasher{Cost: opt.BcryptCost}
+	}
+	if opt.Dialect == nil {
+		opt.Dialect = MySqlDialect
+	}
 	if opt.PassGen == nil {
 		opt.PassGen = RandStringBytesMaskImprSrc
 	}
+	if opt.GeneratedPasswordLength == 0 {
+		opt.GeneratedPasswordLength = 128
+	}
+	if opt.GeneratedPasswordLength < minGeneratedLength {
+		opt.GeneratedPasswordLength = minGeneratedLength
+	}
+	if opt.ResetTokenLength == 0 {
+		opt.ResetTokenLength = 128
+	}
+	if opt.ResetTokenLength < minGeneratedLength {
+		opt.ResetTokenLength = minGeneratedLength
+	}
+	if opt.UidGen == nil {
+		opt.UidGen = func() string { return uuid.NewV4().String() }
+	}
 	if opt.UsernameIsEmail == nil {
 		t := true
 		opt.UsernameIsEmail = &t
 	}
-	return &Users{
+	if opt.UseOrgs == nil {
+		t := true
+		opt.UseOrgs = &t
+	}
+	if opt.Clock == nil {
+		opt.Clock = SystemClock{}
+	}
+	if opt.PasswordPolicy == nil {
+		opt.PasswordPolicy = defaultPasswordPolicy
+	}
+	us := &Users{
 		db:        db,
-		Suspender: NewSuspender("users", db),
+		Suspender: &Suspender{table: "users", db: db, updatedColumn: "status_updated", clock: opt.Clock, dialect: opt.Dialect},
 		UserOpts:  opt,
+		roleNames: NewRoleNames(opt.RoleNames),
+	}
+	if opt.WebhookURL != "" {
+		us.webhooks = &WebhookSink{URL: opt.WebhookURL, Secret: opt.WebhookSecret, Logger: opt.Logger, Clock: opt.Clock}
 	}
+	return us
 }
 
 type Users struct {
 	db *sql.DB
 	*Suspender
 	UserOpts
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt
+
+	lockoutMu sync.Mutex
+	lockouts  map[string]time.Time // When OnLockout was last sent per username.
+
+	dummyOnce sync.Once
+	dummy     string // See dummyHash.
+
+	webhooks  *WebhookSink // From WebhookURL.
+	roleNames *RoleNames   // From RoleNames.
 }
 
-func hashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+// prepare returns a cached prepared statement for the query, preparing it on first use. Only use it for fixed
+// queries, dynamically built ones would grow the cache without bound.
+func (us *Users) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+	us.stmtMu.Lock()
+	defer us.stmtMu.Unlock()
+	if stmt, ok := us.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := us.db.PrepareContext(ctx, us.rebind(query))
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if us.stmts == nil {
+		us.stmts = map[string]*sql.Stmt{}
+	}
+	us.stmts[query] = stmt
+	return stmt, nil
+}
+
+// rebind rewrites the query's '?' placeholders for the configured Dialect.
+func (us *Users) rebind(query string) string {
+	return us.Dialect.Rebind(query)
+}
+
+// Close closes the cached prepared statements and waits for queued webhooks, it does not close the db.
+func (us *Users) Close() error {
+	var err error
+	if us.webhooks != nil {
+		err = us.webhooks.Close()
+	}
+	us.stmtMu.Lock()
+	defer us.stmtMu.Unlock()
+	for query, stmt := range us.stmts {
+		if e := stmt.Close(); e != nil {
+			err = e
+		}
+		delete(us.stmts, query)
 	}
-	return string(hash), nil
+	return err
 }
 
 type SignUpParams struct {
-	Username        string `json:"username"`
-	InviteCode      string `json:"invite_code"`
-	Password        string `json:"password"`
-	Email           string `json:"email"`
-	FirstName       string `json:"first_name"`
-	LastName        string `json:"last_name"`
-	Phone           string `json:"phone"`
-	OrgId           int64  `json:"org_id"`
-	Role            Role   `json:"role"`
-	Passive         bool   `json:"passive"`
+	Username        string                 `json:"username"`
+	InviteCode      string                 `json:"invite_code"`
+	Password        string                 `json:"password"`
+	Email           string                 `json:"email"`
+	FirstName       string                 `json:"first_name"`
+	LastName        string                 `json:"last_name"`
+	Phone           string                 `json:"phone"`
+	OrgId           int64                  `json:"org_id"`
+	Role            Role                   `json:"role"`
+	Passive         bool                   `json:"passive"`
+	IdempotencyKey  string                 `json:"idempotency_key"` // Retried SignUps with the key and same params return the first's user.
+	Metadata        map[string]interface{} `json:"metadata"`
 	CustomValidator `json:"-"`
 }
 
@@ -125,6 +420,9 @@ func (va *SignUpParams) Validate() error {
 	if !govalidator.IsEmail(va.Email) {
 		return ErrEmailRequired
 	}
+	if len(va.IdempotencyKey) > 64 {
+		return ErrInvalid("'idempotency_key' can't be longer than 64 chars.")
+	}
 	return nil
 }
 
@@ -135,9 +433,15 @@ type ExistsParams struct {
 
 // Exists returns true only if we know for certain that the email and username don't exists, otherwise we assume they might exist or they definitely exists if the error indicates as such.
 func (us *Users) Exists(p ExistsParams) (bool, error) {
+	return us.ExistsContext(context.Background(), p)
+}
+
+func (us *Users) ExistsContext(ctx context.Context, p ExistsParams) (bool, error) {
+	p.Email = NormalizeEmail(p.Email)
+	p.Username = us.normalizeUsername(p.Username)
 	var exists bool
-	err := Tx(us.db, func(tx *sql.Tx) error {
-		e, err := us.exists(tx, p)
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		e, err := us.exists(ctx, tx, p)
 		if err != nil {
 			return err
 		}
@@ -150,14 +454,14 @@ func (us *Users) Exists(p ExistsParams) (bool, error) {
 	return exists, nil
 }
 
-func (us *Users) exists(tx *sql.Tx, p ExistsParams) (bool, error) {
-	existingQ, err := tx.Prepare("SELECT username, email  FROM users WHERE deleted = 0 AND username = ? OR email = ?")
+func (us *Users) exists(ctx context.Context, tx *sql.Tx, p ExistsParams) (bool, error) {
+	existingQ, err := tx.PrepareContext(ctx, us.rebind("SELECT username, email  FROM users WHERE deleted = 0 AND (username = ? OR email = ?)"))
 	if err != nil {
 		return true, err
 	}
 
 	var username, email string
-	err = existingQ.QueryRow(p.Username, p.Email).Scan(&username, &email)
+	err = existingQ.QueryRowContext(ctx, p.Username, p.Email).Scan(&username, &email)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
@@ -174,241 +478,1120 @@ func (us *Users) exists(tx *sql.Tx, p ExistsParams) (bool, error) {
 	return false, nil
 }
 
+// normalizeUsername lowercases the username when it's the email or UserOpts.CaseInsensitiveUsernames is set.
+func (us *Users) normalizeUsername(username string) string {
+	if *us.UsernameIsEmail || us.CaseInsensitiveUsernames {
+		return NormalizeEmail(username)
+	}
+	return username
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// collides returns ErrUsernameTaken if username is another live user's email, or ErrEmailTaken if email is another
+// live user's username. excludeId is the user being updated, or zero.
+func (us *Users) collides(ctx context.Context, q rowQueryer, email string, username string, excludeId int64) error {
+	var otherEmail, otherUsername string
+	err := q.QueryRowContext(ctx, us.rebind("SELECT email, username FROM users WHERE deleted = 0 AND id <> ? AND (email = ? OR username = ?) LIMIT 1"),
+		excludeId, username, email).Scan(&otherEmail, &otherUsername)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(otherEmail) == strings.ToLower(username) {
+		return ErrUsernameTaken
+	}
+	return ErrEmailTaken
+}
+
+// checkOrg returns ErrUnknownOrg unless the org exists and isn't deleted. Zero is no org so it's always valid, as
+// is any org when UserOpts.UseOrgs is false.
+func (us *Users) checkOrg(ctx context.Context, q rowQueryer, orgId int64) error {
+	if orgId == 0 || !*us.UseOrgs {
+		return nil
+	}
+	var id int64
+	err := q.QueryRowContext(ctx, us.rebind("SELECT id FROM orgs WHERE id = ? AND deleted = 0"), orgId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return ErrUnknownOrg
+	}
+	return err
+}
+
+// defaultRole returns the default_role of the org, or UserOpts.DefaultRole if it has none or doesn't exist.
+func (us *Users) defaultRole(ctx context.Context, q rowQueryer, orgId int64) (Role, error) {
+	if !*us.UseOrgs {
+		return us.DefaultRole, nil
+	}
+	var role Role
+	err := q.QueryRowContext(ctx, us.rebind("SELECT COALESCE(default_role, 0) FROM orgs WHERE id = ? AND deleted = 0"),
+		orgId).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if role == 0 {
+		return us.DefaultRole, nil
+	}
+	return role, nil
+}
+
+// checkPassword returns the PasswordPolicy error for the password, or ErrPasswordBreached if the BreachChecker
+// knows it.
+func (us *Users) checkPassword(password string) error {
+	if us.PasswordPolicy != nil {
+		err := us.PasswordPolicy(password)
+		if err != nil {
+			return err
+		}
+	}
+	return us.checkBreached(password)
+}
+
+// ValidatePasswords checks each password against the PasswordPolicy, e.g. before a bulk import. It returns the
+// errors keyed by index, or nil when all pass.
+func (us *Users) ValidatePasswords(pws []string) map[int]error {
+	var errs map[int]error
+	for i, pw := range pws {
+		var err error
+		if pw == "" {
+			err = ErrPasswordRequired
+		} else if us.PasswordPolicy != nil {
+			err = us.PasswordPolicy(pw)
+		}
+		if err == nil {
+			continue
+		}
+		if errs == nil {
+			errs = map[int]error{}
+		}
+		errs[i] = err
+	}
+	return errs
+}
+
+// checkBreached returns ErrPasswordBreached if the BreachChecker knows the password.
+func (us *Users) checkBreached(password string) error {
+	if us.BreachChecker == nil {
+		return nil
+	}
+	breached, err := us.BreachChecker.IsBreached(password)
+	if err != nil {
+		if us.BreachCheckFailClosed {
+			return err
+		}
+		us.log().Error("checking breached password", "error", err)
+		return nil
+	}
+	if breached {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
 // SignUp returns a user, random password and [error]
 func (us *Users) SignUp(p SignUpParams) (*User, string, error) {
+	return us.SignUpContext(context.Background(), p)
+}
+
+func (us *Users) SignUpContext(ctx context.Context, p SignUpParams) (*User, string, error) {
 	var givenPassword bool
 	var activateToken = ""
 	var id int64
 	var u *User
+	p.Email = NormalizeEmail(p.Email)
+	p.Username = us.normalizeUsername(p.Username)
+	fingerprint := signUpFingerprint(p)
+	if p.IdempotencyKey != "" {
+		u, err := us.signedUp(ctx, p.IdempotencyKey, fingerprint)
+		if u != nil || err != nil {
+			return u, "", err
+		}
+	}
+	if p.Email != "" {
+		err := us.checkDisposable(p.Email)
+		if err != nil {
+			return nil, "", err
+		}
+	}
 	if p.Passive && p.Email == "" {
-		p.Email = uuid.NewV4().String() + "@passive-user.gus"
+		p.Email = uuid.NewV4().String() + "@" + us.PassiveEmailDomain
+	}
+	if p.Password != "" {
+		err := us.checkPassword(p.Password)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	err := Tx(us.db, func(tx *sql.Tx) error {
-		exists, err := us.exists(tx, ExistsParams{Username: p.Username, Email: p.Email})
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		exists, err := us.exists(ctx, tx, ExistsParams{Username: p.Username, Email: p.Email})
 		if exists {
 			return err
 		}
-		stmt, err := tx.Prepare("INSERT INTO users(" +
-			"username, uid, email, first_name, " +
-			"last_name, phone, password_hash, org_id, " +
-			"updated, created, deleted, role, " +
-			"suspended, invite_code, passive, activated) " +
-			"values(" +
-			"?,?,?,?," +
-			"?,?,?,?," +
-			"?,?,?,?," +
-			"?, ?, ?, ?)")
-		if err != nil {
-			return errors.WithStack(err)
-		}
 		if *us.UserOpts.UsernameIsEmail || p.Username == "" {
 			p.Username = p.Email
 		}
+		if us.RequireInvite && !p.Passive {
+			invite, err := us.useInvite(ctx, tx, p.InviteCode)
+			if err != nil {
+				return err
+			}
+			if invite.OrgId > 0 {
+				p.OrgId = invite.OrgId
+			}
+			if invite.Role > 0 {
+				p.Role = invite.Role
+			}
+		}
+		if us.ForbidEmailUsernameCollision {
+			err = us.collides(ctx, tx, p.Email, p.Username, 0)
+			if err != nil {
+				return err
+			}
+		}
+		err = us.checkOrg(ctx, tx, p.OrgId)
+		if err != nil {
+			return err
+		}
+		if p.Role == 0 && !p.Passive {
+			p.Role, err = us.defaultRole(ctx, tx, p.OrgId)
+			if err != nil {
+				return err
+			}
+		}
 		u = &User{
-			Uid: uuid.NewV4().String(), Username: p.Username, Email: p.Email, FirstName: p.FirstName,
-			LastName: p.LastName, Phone: p.Phone, OrgId: p.OrgId, Created: Milliseconds(time.Now()),
-			Updated: Milliseconds(time.Now()), Role: p.Role, Suspended: false, Passive: p.Passive, Activated:false}
+			Uid: us.UidGen(), Username: p.Username, Email: p.Email, FirstName: p.FirstName,
+			LastName: p.LastName, Phone: p.Phone, OrgId: p.OrgId, Created: Milliseconds(us.Clock.Now()),
+			Updated: Milliseconds(us.Clock.Now()), Role: p.Role, Suspended: false, Passive: p.Passive, Activated: false,
+			Metadata: p.Metadata}
+		metadata, err := marshalMetadata(p.Metadata)
+		if err != nil {
+			return err
+		}
 
 		if p.Password == "" {
-			p.Password = us.UserOpts.PassGen(128)
+			p.Password = us.UserOpts.PassGen(us.GeneratedPasswordLength)
 			if err != nil {
 				return err
 			}
 		} else {
 			givenPassword = true
 		}
-		hash, err := hashPassword(p.Password)
+		hash, err := us.Hasher.Hash(p.Password)
 		if err != nil {
 			return err
 		}
-		res, err := stmt.Exec(
+		lid, err := us.Dialect.InsertId(ctx, tx, "INSERT INTO users("+
+			"username, uid, email, first_name, "+
+			"last_name, phone, password_hash, org_id, "+
+			"updated, created, deleted, role, "+
+			"suspended, invite_code, passive, activated, "+
+			"metadata) "+
+			"values("+
+			"?,?,?,?,"+
+			"?,?,?,?,"+
+			"?,?,?,?,"+
+			"?, ?, ?, ?,"+
+			"?)",
 			u.Username, u.Uid, u.Email, u.FirstName,
 			u.LastName, u.Phone, hash, u.OrgId,
 			u.Updated, u.Created, 0, u.Role,
-			u.Suspended, p.InviteCode, p.Passive, false)
-		if err != nil {
+			u.Suspended, p.InviteCode, p.Passive, false,
+			metadata)
+		if us.Dialect.IsDuplicate(err) {
 			return err
 		}
-		lid, err := res.LastInsertId()
 		if err != nil {
-			return err
+			return errors.WithStack(err)
 		}
 		id = lid
+		if u.OrgId > 0 {
+			err = us.addMembership(ctx, tx, id, u.OrgId)
+			if err != nil {
+				return err
+			}
+		}
+		if p.IdempotencyKey != "" {
+			// An expired key may be reused
+			_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM signup_keys WHERE idempotency_key = ? AND created <= ?"),
+				p.IdempotencyKey, us.idempotencyKeysSince())
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO signup_keys (idempotency_key, user_id, fingerprint, created) values (?, ?, ?, ?)"),
+				p.IdempotencyKey, id, fingerprint, u.Created)
+			return err
+		}
 		return nil
 	})
+	if us.Dialect.IsDuplicate(err) {
+		// A concurrent SignUp with the same key won
+		if p.IdempotencyKey != "" {
+			u, err := us.signedUp(ctx, p.IdempotencyKey, fingerprint)
+			if u != nil || err != nil {
+				return u, "", err
+			}
+		}
+		return nil, "", us.taken(ctx, 0, p.Email, p.Username)
+	}
 	if err != nil {
 		return nil, "", err
 	}
 	u.Id = id
-	if givenPassword {
-		return u, "", nil
-	}
-
-	if !u.Passive {
-		at, err := us.ResetPassword(ResetPasswordParams{Email: p.Email})
-		if err != nil {
-			return nil, "", err
+	if !givenPassword || us.RequireVerifiedEmail {
+		if !u.Passive {
+			at, err := us.resetPassword(ctx, ResetPasswordParams{Email: p.Email})
+			if err != nil {
+				return nil, "", err
+			}
+			activateToken = at
 		}
-		activateToken = at
 	}
+	us.events().OnSignUp(u)
+	us.metrics().IncSignUp()
 	return u, activateToken, nil
 }
 
-func (us *Users) Get(id int64) (*User, error) {
-	stmt, err := us.db.Prepare("SELECT id, uid, username, email, first_name, last_name, phone, org_id, created, updated, role, suspended, passive, activated from users WHERE id =  ? AND deleted = 0 LIMIT 1")
+// signedUp returns the user created by a SignUp with the unexpired idempotency key, or nil if there isn't one. It
+// returns ErrIdempotencyKeyReused if that SignUp's params had a different fingerprint, so a replayed or guessed key
+// can't return someone else's user.
+func (us *Users) signedUp(ctx context.Context, key string, fingerprint string) (*User, error) {
+	stmt, err := us.prepare(ctx, "SELECT user_id, fingerprint FROM signup_keys WHERE idempotency_key = ? AND created > ?")
 	if err != nil {
 		return nil, err
 	}
-	return scanUser(stmt.QueryRow(id))
-}
-
-// GetByUsername returns a user by username (or email) as well as a password hash.
-func (us *Users) GetByUsername(username string) (*UserWithClaims, string, error) {
-	stmt, err := us.db.Prepare("SELECT u.password_hash, u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone, u.org_id, u.created, u.updated, u.role, u.suspended, COALESCE(o.suspended, 0), passive, activated from users u left join orgs o on u.org_id = o.id WHERE u.email = ? OR u.username = ? AND u.deleted = 0 LIMIT 1")
-	if err != nil {
-		return nil, "", err
+	var id int64
+	var stored sql.NullString
+	err = stmt.QueryRowContext(ctx, key, us.idempotencyKeysSince()).Scan(&id, &stored)
+	if err == sql.ErrNoRows {
+		return nil, nil
 	}
-	row := stmt.QueryRow(username, username)
-	var u User
-	var passwordHash string
-	var orgSuspended bool
-	var suspended int
-	var passive, activated sql.NullBool
-	err = CheckNotFound(row.Scan(&passwordHash, &u.Id, &u.Uid, &u.Username, &u.Email, &u.FirstName, &u.LastName, &u.Phone,
-		&u.OrgId, &u.Created, &u.Updated, &u.Role, &suspended, &orgSuspended, &passive, &activated))
 	if err != nil {
-		return nil, "", err
-	}
-	if passive.Valid {
-		u.Passive = passive.Bool
+		return nil, err
 	}
-	if activated.Valid {
-		u.Activated = activated.Bool
+	if stored.String != fingerprint {
+		return nil, ErrIdempotencyKeyReused
 	}
-	u.Suspended = suspended > 0
-	c := &UserWithClaims{User: &u, Claims: &Claims{OrgId: u.OrgId, Role: u.Role, OrgSuspended: orgSuspended}}
-	return c, passwordHash, err
+	return us.GetContext(ctx, id)
 }
 
-type SignInParams struct {
-	Email           string `json:"email"`
-	Username        string `json:"username"`
-	Password        string `json:"password"`
-	CustomValidator `json:"-"`
+// signUpFingerprint identifies the normalized params of a SignUp for its idempotency key. The password isn't
+// included so no fast hash of it is stored.
+func signUpFingerprint(p SignUpParams) string {
+	b, _ := json.Marshal([]interface{}{p.Email, p.Username, p.FirstName, p.LastName, p.Phone, p.OrgId, p.Role, p.Passive})
+	return hashToken(string(b))
 }
 
-func (va *SignInParams) Validate() error {
-	if va.CustomValidator != nil {
-		return va.CustomValidator()
-	}
-	if govalidator.IsNull(va.Password) {
-		return ErrPasswordRequired
-	}
-	if !govalidator.IsEmail(va.Username) && govalidator.IsNull(va.Username) {
-		return ErrUsernameOrEmailRequired
-	}
-	return nil
+// idempotencyKeysSince returns the time in milliseconds before which idempotency keys have expired.
+func (us *Users) idempotencyKeysSince() int64 {
+	return Milliseconds(us.Clock.Now()) - us.IdempotencyKeyExpiry*1000
 }
 
-func (us *Users) SignIn(p SignInParams) (*UserWithClaims, error) {
-	if p.Email != "" {
-		if *us.UsernameIsEmail {
-			p.Username = p.Email
-		}
-		if p.Username == "" {
-			p.Username = p.Email
-		}
-	}
-	if us.isLocked(p.Username) {
-		return nil, &RateLimitExceededError{Messages: []string{"Too many sign-in attempts try again later."}}
-	}
-	u, hash, err := us.GetByUsername(p.Username)
-	if err != nil {
-		_, ok := err.(*NotFoundError)
-		if ok {
-			return nil, ErrNotAuth
-		}
-		return nil, err
-	}
-	if u.Suspended || u.OrgSuspended || u.Passive {
-		Debug("FAILED ATTEMPT:", us.isLocked(p.Username))
-		return nil, ErrNotAuth
-	}
-	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(p.Password))
-	if err != nil {
-		return nil, ErrNotAuth
-	}
-	return u, nil
+// PromoteUser converts a passive user, e.g. a guest, into an active account with p's email and password as if they
+// had signed up. Empty names and phone keep the passive user's, and an activation token is returned as by SignUp.
+func (us *Users) PromoteUser(id int64, p SignUpParams) (*User, string, error) {
+	return us.PromoteUserContext(context.Background(), id, p)
 }
 
-// isLocked will prevent users from authenticating if they have attempted to or signed in more than n times
-// within the AuthLockDuration time. e.g. if the AuthLockDuration is 600 seconds and the MaxAuthAttempts is
-// 5 they will be locked out when attempting to sign in immediately after the 5th attempt. Since the lock is
-// 'sliding' they will not usually have to wait the full AuthLockDuration, just until there are no more than 5
-// attempts in last 600 seconds. The effective sign-in rate would thus be 1 'sign in' per minute or one burst of 5
-// 'sign ins' every 5 minutes.
-func (us *Users) isLocked(username string) bool {
-	stmt, err := us.db.Prepare("INSERT into password_attempts (username, created) values (?, ?)")
-	if err != nil {
-		LogErr(err)
-		return true
-	}
-	_, err = stmt.Exec(username, Milliseconds(time.Now()))
-	if err != nil {
-		LogErr(err)
-		// Lock the account regardless
-		return true
+func (us *Users) PromoteUserContext(ctx context.Context, id int64, p SignUpParams) (*User, string, error) {
+	p.Email = NormalizeEmail(p.Email)
+	p.Username = us.normalizeUsername(p.Username)
+	if !govalidator.IsEmail(p.Email) {
+		return nil, "", ErrEmailInvalid
 	}
-
-	since := (time.Now().Unix() - us.AuthLockDuration) * 1000
-	row := us.db.QueryRow("SELECT COUNT(username) FROM password_attempts WHERE created > ? AND username = ?", since, username)
-	var count int64
-	err = row.Scan(&count)
+	err := us.checkDisposable(p.Email)
 	if err != nil {
-		LogErr(err)
-		// Lock the account regardless
-		return true
-	}
-	return count > us.AuthAttempts
-}
-
-type UpdateUserParams struct {
-	Id              *int64  `json:"id"`
-	FirstName       *string `json:"first_name"`
-	LastName        *string `json:"last_name"`
-	Email           *string `json:"email"`
-	Phone           *string `json:"phone"`
-	CustomValidator `json:"-"`
-}
-
-func (va *UpdateUserParams) Validate() error {
-	if va.CustomValidator != nil {
-		return va.CustomValidator()
+		return nil, "", err
 	}
-	if *va.Email != "" && !govalidator.IsEmail(*va.Email) {
-		return ErrInvalid("'email' invalid.")
+	givenPassword := p.Password != ""
+	if givenPassword {
+		err := us.checkPassword(p.Password)
+		if err != nil {
+			return nil, "", err
+		}
+	} else {
+		p.Password = us.PassGen(us.GeneratedPasswordLength)
 	}
-	return nil
-}
-
-func (us *Users) Update(p UpdateUserParams) error {
-	u, err := us.Get(*p.Id)
+	hash, err := us.Hasher.Hash(p.Password)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		u, err := scanUser(tx.QueryRowContext(ctx, us.rebind(us.userSelect()+" WHERE u.id = ? AND u.deleted = 0"), id))
+		if err != nil {
+			return err
+		}
+		if !u.Passive {
+			return ErrNotPassive
+		}
+		if *us.UsernameIsEmail || p.Username == "" {
+			p.Username = p.Email
+		}
+		err = us.available(ctx, tx, id, p.Email, p.Username)
+		if err != nil {
+			return err
+		}
+		if us.ForbidEmailUsernameCollision {
+			err = us.collides(ctx, tx, p.Email, p.Username, id)
+			if err != nil {
+				return err
+			}
+		}
+		if p.OrgId == 0 {
+			p.OrgId = u.OrgId
+		}
+		if us.RequireInvite {
+			invite, err := us.useInvite(ctx, tx, p.InviteCode)
+			if err != nil {
+				return err
+			}
+			if invite.OrgId > 0 {
+				p.OrgId = invite.OrgId
+			}
+			if invite.Role > 0 {
+				p.Role = invite.Role
+			}
+		}
+		if p.OrgId != u.OrgId {
+			err = us.checkOrg(ctx, tx, p.OrgId)
+			if err != nil {
+				return err
+			}
+		}
+		if p.Role == 0 {
+			p.Role = u.Role
+		}
+		if p.Role == 0 {
+			p.Role, err = us.defaultRole(ctx, tx, p.OrgId)
+			if err != nil {
+				return err
+			}
+		}
+		if p.FirstName == "" {
+			p.FirstName = u.FirstName
+		}
+		if p.LastName == "" {
+			p.LastName = u.LastName
+		}
+		if p.Phone == "" {
+			p.Phone = u.Phone
+		}
+		now := Milliseconds(us.Clock.Now())
+		err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET username = ?, email = ?, first_name = ?, "+
+			"last_name = ?, phone = ?, password_hash = ?, org_id = ?, role = ?, invite_code = ?, passive = 0, "+
+			"activated = 0, updated = ?, role_updated = ?, password_changed = ? WHERE id = ? AND passive = 1 AND deleted = 0"),
+			p.Username, p.Email, p.FirstName, p.LastName, p.Phone, hash, p.OrgId, p.Role, p.InviteCode, now, now, now, id))
+		if err != nil || p.OrgId == 0 {
+			return err
+		}
+		// The same membership SignUp records
+		return us.addMembership(ctx, tx, id, p.OrgId)
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return nil, "", us.taken(ctx, id, p.Email, p.Username)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	activateToken := ""
+	if !givenPassword || us.RequireVerifiedEmail {
+		activateToken, err = us.resetPassword(ctx, ResetPasswordParams{Email: p.Email})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	u, err := us.GetContext(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	us.events().OnSignUp(u)
+	us.metrics().IncSignUp()
+	return u, activateToken, nil
+}
+
+func (us *Users) Get(id int64) (*User, error) {
+	return us.GetContext(context.Background(), id)
+}
+
+func (us *Users) GetContext(ctx context.Context, id int64) (*User, error) {
+	stmt, err := us.prepare(ctx, us.userSelect()+" WHERE u.id = ? AND u.deleted = 0 LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(stmt.QueryRowContext(ctx, id))
+}
+
+// GetMany returns the live users with the given ids in the order of ids, missing ids and repeats are skipped.
+func (us *Users) GetMany(ids []int64) ([]*User, error) {
+	return us.GetManyContext(context.Background(), ids)
+}
+
+func (us *Users) GetManyContext(ctx context.Context, ids []int64) ([]*User, error) {
+	users := []*User{}
+	if len(ids) == 0 {
+		return users, nil
+	}
+	seen := map[int64]bool{}
+	args := []interface{}{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			args = append(args, id)
+		}
+	}
+	rows, err := us.db.QueryContext(ctx, us.rebind(us.userSelect()+" WHERE u.id IN (?"+
+		strings.Repeat(", ?", len(args)-1)+") AND u.deleted = 0"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byId := map[int64]*User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		byId[u.Id] = u
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range args {
+		if u, ok := byId[id.(int64)]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+func (us *Users) GetByUid(uid string) (*User, error) {
+	return us.GetByUidContext(context.Background(), uid)
+}
+
+func (us *Users) GetByUidContext(ctx context.Context, uid string) (*User, error) {
+	stmt, err := us.prepare(ctx, us.userSelect()+" WHERE u.uid = ? AND u.deleted = 0 LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(stmt.QueryRowContext(ctx, uid))
+}
+
+// GetByEmail returns the user with the email, unlike GetByUsername it never matches a username.
+func (us *Users) GetByEmail(email string) (*User, error) {
+	return us.GetByEmailContext(context.Background(), email)
+}
+
+func (us *Users) GetByEmailContext(ctx context.Context, email string) (*User, error) {
+	stmt, err := us.prepare(ctx, us.userSelect()+" WHERE u.email = ? AND u.deleted = 0 LIMIT 1")
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(stmt.QueryRowContext(ctx, NormalizeEmail(email)))
+}
+
+// RotateUid replaces the user's uid with a newly generated one, e.g. when the uid has leaked, and returns it.
+func (us *Users) RotateUid(id int64) (string, error) {
+	return us.RotateUidContext(context.Background(), id)
+}
+
+func (us *Users) RotateUidContext(ctx context.Context, id int64) (string, error) {
+	uid := us.UidGen()
+	err := CheckUpdated(us.db.ExecContext(ctx, us.rebind("UPDATE users SET uid = ?, updated = ? WHERE id = ? AND deleted = 0"),
+		uid, Milliseconds(us.Clock.Now()), id))
+	if err != nil {
+		return "", err
+	}
+	return uid, nil
+}
+
+// idByUid resolves the internal id for the *ByUid methods.
+func (us *Users) idByUid(ctx context.Context, uid string) (int64, error) {
+	var id int64
+	err := CheckNotFound(us.db.QueryRowContext(ctx, us.rebind("SELECT id FROM users WHERE uid = ? AND deleted = 0 LIMIT 1"), uid).Scan(&id))
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Message returns the message to show for err, localized by the Translator when err is a coded ValidationError.
+func (us *Users) Message(err error) string {
+	if v, ok := err.(*ValidationError); ok {
+		return v.Localize(us.Translator)
+	}
+	return err.Error()
+}
+
+// orgColumns returns the org name and suspended columns and the join they need, see UserOpts.UseOrgs.
+func (us *Users) orgColumns() (name string, suspended string, join string) {
+	if !*us.UseOrgs {
+		return "NULL", "0", ""
+	}
+	return "o.name", "COALESCE(o.suspended, 0)", " left join orgs o on u.org_id = o.id"
+}
+
+// userSelect selects the columns read by scanUser from users u, with the org joined for OrgName.
+func (us *Users) userSelect() string {
+	orgNameCol, _, orgJoin := us.orgColumns()
+	return "SELECT u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone, u.org_id, " + orgNameCol + ", " +
+		"u.created, u.updated, u.role_updated, u.status_updated, COALESCE(u.last_login, 0), u.last_login_ip, u.role, " +
+		"u.suspended, u.passive, u.activated, u.verified, u.metadata, " +
+		"COALESCE(u.must_change_password, 0) FROM users u" + orgJoin
+}
+
+// GetByUsername returns a user by username (or email) as well as a password hash.
+func (us *Users) GetByUsername(username string) (*UserWithClaims, string, error) {
+	return us.GetByUsernameContext(context.Background(), username)
+}
+
+func (us *Users) GetByUsernameContext(ctx context.Context, username string) (*UserWithClaims, string, error) {
+	username = us.normalizeUsername(username)
+	return us.getWithClaims(ctx, "(u.email = ? OR u.username = ?)", username, username)
+}
+
+// GetWithClaims returns a user by id with their claims, e.g. for authorization middleware loading the user of a
+// token. The user, org and OrgSuspended come from one query and the additional Roles from a second.
+func (us *Users) GetWithClaims(id int64) (*UserWithClaims, error) {
+	return us.GetWithClaimsContext(context.Background(), id)
+}
+
+func (us *Users) GetWithClaimsContext(ctx context.Context, id int64) (*UserWithClaims, error) {
+	uc, _, err := us.getWithClaims(ctx, "u.id = ?", id)
+	return uc, err
+}
+
+// getWithClaims returns the live user matching the fixed where clause with their claims and password hash.
+func (us *Users) getWithClaims(ctx context.Context, where string, args ...interface{}) (*UserWithClaims, string, error) {
+	orgNameCol, orgSuspendedCol, orgJoin := us.orgColumns()
+	stmt, err := us.prepare(ctx, "SELECT u.password_hash, u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone, u.org_id, "+orgNameCol+", u.created, u.updated, u.role_updated, u.status_updated, COALESCE(u.last_login, 0), u.last_login_ip, u.role, u.suspended, "+orgSuspendedCol+", u.passive, u.activated, u.verified, u.metadata, COALESCE(u.must_change_password, 0), COALESCE(u.token_version, 0) from users u"+orgJoin+" WHERE "+where+" AND u.deleted = 0 LIMIT 1")
+	if err != nil {
+		return nil, "", err
+	}
+	row := stmt.QueryRowContext(ctx, args...)
+	var u User
+	var orgSuspended bool
+	var suspended int
+	var tokenVersion int64
+	var passive, activated, verified sql.NullBool
+	var orgName, lastLoginIP, metadata sql.NullString
+	var uid, username, email, firstName, lastName, phone, passwordHash sql.NullString
+	err = CheckNotFound(row.Scan(&passwordHash, &u.Id, &uid, &username, &email, &firstName, &lastName, &phone,
+		&u.OrgId, &orgName, &u.Created, &u.Updated, &u.RoleUpdated, &u.StatusUpdated, &u.LastLogin, &lastLoginIP, &u.Role, &suspended, &orgSuspended, &passive, &activated, &verified, &metadata, &u.MustChangePassword, &tokenVersion))
+	if err != nil {
+		return nil, "", err
+	}
+	u.Uid, u.Username, u.Email, u.FirstName, u.LastName, u.Phone = uid.String, username.String, email.String, firstName.String, lastName.String, phone.String
+	u.Metadata, err = parseMetadata(metadata)
+	if err != nil {
+		return nil, "", err
+	}
+	if passive.Valid {
+		u.Passive = passive.Bool
+	}
+	if activated.Valid {
+		u.Activated = activated.Bool
+	}
+	if verified.Valid {
+		u.Verified = verified.Bool
+	}
+	u.OrgName = orgName.String
+	u.Suspended = suspended > 0
+	u.LastLoginIP = lastLoginIP.String
+	roles, err := us.GetRolesContext(ctx, u.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	c := &UserWithClaims{User: &u, Claims: &Claims{OrgId: u.OrgId, Role: u.Role, Roles: roles, OrgSuspended: orgSuspended,
+		TokenVersion: tokenVersion}}
+	return c, passwordHash.String, err
+}
+
+type SignInParams struct {
+	Email           string `json:"email"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	ClientId        string `json:"-"` // Identifies the client, e.g. its IP, for ClientAuthAttempts. Set by the server.
+	IP              string `json:"-"` // Client IP recorded as the user's LastLoginIP. Set by the server.
+	DeviceToken     string `json:"device_token"`
+	CustomValidator `json:"-"`
+}
+
+func (va *SignInParams) Validate() error {
+	if va.CustomValidator != nil {
+		return va.CustomValidator()
+	}
+	if govalidator.IsNull(va.Password) {
+		return ErrPasswordRequired
+	}
+	if !govalidator.IsEmail(va.Username) && govalidator.IsNull(va.Username) {
+		return ErrUsernameOrEmailRequired
+	}
+	return nil
+}
+
+func (us *Users) SignIn(p SignInParams) (*UserWithClaims, error) {
+	return us.SignInContext(context.Background(), p)
+}
+
+func (us *Users) SignInContext(ctx context.Context, p SignInParams) (*UserWithClaims, error) {
+	u, err := us.signIn(ctx, p)
+	// Checked here rather than in signIn so ChangePassword can still verify the existing password
+	if err == nil && u.MustChangePassword {
+		u, err = nil, ErrPasswordChangeRequired
+	}
+	us.metrics().IncSignIn(err == nil)
+	if err != nil {
+		return nil, err
+	}
+	us.recordLogin(ctx, u.Id, p.IP)
+	u.TrustedDevice = us.trustedDevice(ctx, u.Id, p.DeviceToken)
+	us.events().OnSignIn(u)
+	return u, nil
+}
+
+// recordLogin sets the user's last_login and last_login_ip, failures are only logged so they don't fail the sign in.
+func (us *Users) recordLogin(ctx context.Context, id int64, ip string) {
+	stmt, err := us.prepare(ctx, "UPDATE users SET last_login = ?, last_login_ip = ? WHERE id = ?")
+	if err == nil {
+		_, err = stmt.ExecContext(ctx, Milliseconds(us.Clock.Now()), ip, id)
+	}
+	if err != nil {
+		us.log().Error("recording last login", "error", err, "user_id", id)
+	}
+}
+
+// signIn is SignIn without the OnSignIn event or last login, for checking a password.
+func (us *Users) signIn(ctx context.Context, p SignInParams) (*UserWithClaims, error) {
+	p.Email = NormalizeEmail(p.Email)
+	p.Username = us.normalizeUsername(p.Username)
+	if p.Email != "" {
+		if *us.UsernameIsEmail {
+			p.Username = p.Email
+		}
+		if p.Username == "" {
+			p.Username = p.Email
+		}
+	}
+	var attemptId int64
+	if !us.DisableLockout {
+		var locked bool
+		attemptId, locked = us.recordAttempt(ctx, p.Username, p.ClientId, p.IP)
+		if locked {
+			// recordAttempt fails closed so report a cancelled context rather than a lock
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, &RateLimitExceededError{Messages: []string{"Too many sign-in attempts try again later."},
+				RetryAfter: us.lockRetryAfter(ctx, p.Username, p.ClientId)}
+		}
+	}
+	failed := func(err error) (*UserWithClaims, error) {
+		us.log().Debug("sign in failed", "username", p.Username)
+		return nil, err
+	}
+	u, hash, err := us.GetByUsernameContext(ctx, p.Username)
+	if err != nil {
+		_, ok := err.(*NotFoundError)
+		if ok {
+			// Compare anyway so unknown usernames take as long as wrong passwords
+			us.Hasher.Compare(us.dummyHash(), p.Password)
+			return failed(ErrNotAuth)
+		}
+		return nil, err
+	}
+	err = us.Hasher.Compare(hash, p.Password)
+	if err != nil {
+		return failed(ErrNotAuth)
+	}
+	// Only checked after the password so the detailed errors don't reveal the status of other people's accounts
+	if u.Suspended || u.OrgSuspended || u.Passive {
+		switch {
+		case !us.DetailedSignInErrors:
+			return failed(ErrNotAuth)
+		case u.Suspended:
+			return failed(ErrUserSuspended)
+		case u.OrgSuspended:
+			return failed(ErrOrgSuspended)
+		default:
+			return failed(ErrPassiveUser)
+		}
+	}
+	if attemptId > 0 {
+		us.clearAttempt(ctx, attemptId, p.Username)
+	}
+	if us.RequireVerifiedEmail && !u.Verified {
+		return nil, ErrEmailNotVerified
+	}
+	return u, nil
+}
+
+// dummyHash returns the hash of a random password, made once with the Hasher so comparing against it costs the same
+// as comparing against a user's hash.
+func (us *Users) dummyHash() string {
+	us.dummyOnce.Do(func() {
+		hash, err := us.Hasher.Hash(us.PassGen(32))
+		if err != nil {
+			us.log().Error("hashing dummy password", "error", err)
+		}
+		us.dummy = hash
+	})
+	return us.dummy
+}
+
+// SignInWithToken signs in the same as SignIn and issues a token for the user with the configured TokenIssuer.
+func (us *Users) SignInWithToken(p SignInParams) (*UserWithToken, error) {
+	return us.SignInWithTokenContext(context.Background(), p)
+}
+
+func (us *Users) SignInWithTokenContext(ctx context.Context, p SignInParams) (*UserWithToken, error) {
+	if us.TokenIssuer == nil {
+		return nil, ErrNoTokenIssuer
+	}
+	u, err := us.SignInContext(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	token, err := us.TokenIssuer.Issue(u)
+	if err != nil {
+		return nil, err
+	}
+	return &UserWithToken{User: *u.User, Token: token}, nil
+}
+
+// ValidateToken parses a token from SignInWithToken with the TokenIssuer, which must be a TokenParser such as
+// HMACIssuer. Unlike parsing alone it returns ErrNotAuth for the tokens of deleted or suspended users, and for those
+// issued before BumpTokenVersion, e.g. before a suspension even once the user is restored.
+func (us *Users) ValidateToken(token string) (*TokenClaims, error) {
+	return us.ValidateTokenContext(context.Background(), token)
+}
+
+func (us *Users) ValidateTokenContext(ctx context.Context, token string) (*TokenClaims, error) {
+	if us.TokenIssuer == nil {
+		return nil, ErrNoTokenIssuer
+	}
+	parser, ok := us.TokenIssuer.(TokenParser)
+	if !ok {
+		return nil, ErrNoTokenParser
+	}
+	tc, err := parser.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := us.prepare(ctx, "SELECT suspended, COALESCE(token_version, 0) FROM users WHERE uid = ? AND deleted = 0")
+	if err != nil {
+		return nil, err
+	}
+	var suspended bool
+	var version int64
+	err = stmt.QueryRowContext(ctx, tc.Subject).Scan(&suspended, &version)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotAuth
+	}
+	if err != nil {
+		return nil, err
+	}
+	if suspended || version != tc.TokenVersion {
+		return nil, ErrNotAuth
+	}
+	return tc, nil
+}
+
+// BumpTokenVersion makes ValidateToken reject all the tokens issued to the user so far, e.g. to sign them out
+// everywhere. Suspend and ChangePassword bump it too.
+func (us *Users) BumpTokenVersion(userId int64) error {
+	return us.BumpTokenVersionContext(context.Background(), userId)
+}
+
+func (us *Users) BumpTokenVersionContext(ctx context.Context, userId int64) error {
+	// Incremented in place so concurrent bumps can't be lost
+	stmt, err := us.prepare(ctx, "UPDATE users SET token_version = COALESCE(token_version, 0) + 1 WHERE id = ? AND deleted = 0")
+	if err != nil {
+		return err
+	}
+	return CheckUpdated(stmt.ExecContext(ctx, userId))
+}
+
+// recordAttempt records a sign in attempt and returns its id and whether the username is locked. Users are locked
+// out of authenticating once they have tried to sign in more than AuthAttempts times within AuthLockDuration, e.g.
+// if the AuthLockDuration is 600 seconds and the AuthAttempts is 5 they will be locked out when attempting to sign
+// in immediately after the 5th failure. Since the lock is 'sliding' they will not usually have to wait the full
+// AuthLockDuration, just until there are fewer than 5 failed attempts in last 600 seconds. The effective failure
+// rate would thus be 1 per 2 minutes or one burst of 5 every 10 minutes. Successful sign ins aren't counted as
+// their attempt is removed by clearAttempt.
+//
+// The attempt is recorded before counting so parallel guesses each see the others and can't all slip under the
+// limit. If recording or counting fails the username is treated as locked.
+//
+// When ClientAuthAttempts is set the clientId is limited the same way across all usernames, so spraying many
+// usernames from one client is also throttled.
+func (us *Users) recordAttempt(ctx context.Context, username string, clientId string, ip string) (int64, bool) {
+	var id int64
+	// InsertId as not every driver supports LastInsertId, e.g. Postgres returns the id instead
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		var err error
+		id, err = us.Dialect.InsertId(ctx, tx, "INSERT INTO password_attempts (username, client_id, ip, created) "+
+			"values (?, ?, ?, ?)", username, clientId, ip, Milliseconds(us.Clock.Now()))
+		return err
+	})
+	if err != nil {
+		us.log().Error("recording sign in attempt", "error", err, "username", username)
+		return 0, true
+	}
+	if us.MaxStoredAttempts > 0 {
+		// The derived table is required as MySQL can't select from the table being deleted from.
+		_, err = us.db.ExecContext(ctx, us.rebind("DELETE FROM password_attempts WHERE username = ? AND id <= "+
+			"(SELECT id FROM (SELECT id FROM password_attempts WHERE username = ? ORDER BY id DESC LIMIT 1 OFFSET ?) a)"),
+			username, username, us.MaxStoredAttempts)
+		if err != nil {
+			// Trimming is housekeeping so don't lock the account
+			us.log().Error("trimming sign in attempts", "error", err, "username", username)
+		}
+	}
+	since := (us.Clock.Now().Unix() - us.AuthLockDuration) * 1000
+	if attempts := us.attemptsSince(ctx, "username", username, since); attempts > us.AuthAttempts {
+		if attempts != math.MaxInt64 {
+			us.lockedOut(username, attempts)
+		}
+		return id, true
+	}
+	if us.ClientAuthAttempts > 0 && clientId != "" {
+		return id, us.attemptsSince(ctx, "client_id", clientId, since) > us.ClientAuthAttempts
+	}
+	return id, false
+}
+
+// clearAttempt removes the attempt of a successful sign in so it isn't counted by recordAttempt.
+func (us *Users) clearAttempt(ctx context.Context, id int64, username string) {
+	stmt, err := us.prepare(ctx, "DELETE FROM password_attempts WHERE id = ?")
+	if err == nil {
+		_, err = stmt.ExecContext(ctx, id)
+	}
+	if err != nil {
+		us.log().Error("clearing sign in attempt", "error", err, "username", username)
+	}
+}
+
+// lockRetryAfter returns the seconds until isLocked will next allow the username and clientId.
+func (us *Users) lockRetryAfter(ctx context.Context, username string, clientId string) int64 {
+	retry := us.retryAfter(ctx, "username", username, us.AuthAttempts)
+	if us.ClientAuthAttempts > 0 && clientId != "" {
+		if r := us.retryAfter(ctx, "client_id", clientId, us.ClientAuthAttempts); r > retry {
+			retry = r
+		}
+	}
+	return retry
+}
+
+// retryAfter returns the seconds until the limit'th most recent attempt with the column equal to value leaves the
+// AuthLockDuration window, after which the next attempt is within the limit. Errors return the whole duration.
+func (us *Users) retryAfter(ctx context.Context, column string, value string, limit int64) int64 {
+	if limit < 1 {
+		return us.AuthLockDuration
+	}
+	stmt, err := us.prepare(ctx, "SELECT created FROM password_attempts WHERE "+column+" = ? ORDER BY created DESC LIMIT 1 OFFSET ?")
+	if err != nil {
+		us.log().Error("finding sign in retry time", "error", err, column, value)
+		return us.AuthLockDuration
+	}
+	var created int64
+	err = stmt.QueryRowContext(ctx, value, limit-1).Scan(&created)
+	if err == sql.ErrNoRows {
+		return 0
+	}
+	if err != nil {
+		us.log().Error("finding sign in retry time", "error", err, column, value)
+		return us.AuthLockDuration
+	}
+	wait := created + us.AuthLockDuration*1000 - Milliseconds(us.Clock.Now())
+	if wait <= 0 {
+		return 0
+	}
+	return (wait + 999) / 1000
+}
+
+// lockedOut sends OnLockout when the username crosses the AuthAttempts threshold, at most once per AuthLockDuration
+// so an attack hovering around the threshold doesn't send one per attempt.
+func (us *Users) lockedOut(username string, attempts int64) {
+	now := us.Clock.Now()
+	window := time.Duration(us.AuthLockDuration) * time.Second
+	us.lockoutMu.Lock()
+	if us.lockouts == nil {
+		us.lockouts = map[string]time.Time{}
+	}
+	if last, ok := us.lockouts[username]; ok && now.Sub(last) < window {
+		us.lockoutMu.Unlock()
+		return
+	}
+	for u, last := range us.lockouts {
+		if now.Sub(last) >= window {
+			delete(us.lockouts, u)
+		}
+	}
+	us.lockouts[username] = now
+	us.lockoutMu.Unlock()
+	us.events().OnLockout(username, attempts)
+	us.metrics().IncLockout()
+}
+
+// attemptsSince counts the password_attempts with the column equal to value since the time in milliseconds. Errors
+// are counted as too many attempts so the caller fails closed.
+func (us *Users) attemptsSince(ctx context.Context, column string, value string, since int64) int64 {
+	countStmt, err := us.prepare(ctx, "SELECT COUNT(id) FROM password_attempts WHERE created > ? AND "+column+" = ?")
+	if err != nil {
+		us.log().Error("counting sign in attempts", "error", err, column, value)
+		return math.MaxInt64
+	}
+	var count int64
+	err = countStmt.QueryRowContext(ctx, since, value).Scan(&count)
+	if err != nil {
+		us.log().Error("counting sign in attempts", "error", err, column, value)
+		return math.MaxInt64
+	}
+	return count
+}
+
+// Attempt is a failed or locked sign in.
+type Attempt struct {
+	Username string `json:"username"`
+	ClientId string `json:"client_id"`
+	IP       string `json:"ip"`      // SignInParams.IP of the attempt.
+	Created  int64  `json:"created"` // Milliseconds.
+}
+
+// RecentAttempts returns the failed and locked sign ins with the username since the time in milliseconds, newest
+// first, e.g. so the user can check whether they were theirs. Only MaxStoredAttempts are kept when it's set.
+func (us *Users) RecentAttempts(username string, since int64) ([]Attempt, error) {
+	return us.RecentAttemptsContext(context.Background(), username, since)
+}
+
+func (us *Users) RecentAttemptsContext(ctx context.Context, username string, since int64) ([]Attempt, error) {
+	username = us.normalizeUsername(username)
+	stmt, err := us.prepare(ctx, "SELECT username, client_id, ip, created FROM password_attempts WHERE username = ? AND created > ? ORDER BY created DESC, id DESC")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, username, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attempts := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		var clientId, ip sql.NullString
+		err = rows.Scan(&a.Username, &clientId, &ip, &a.Created)
+		if err != nil {
+			return nil, err
+		}
+		a.ClientId = clientId.String
+		a.IP = ip.String
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+type UpdateUserParams struct {
+	Id        *int64  `json:"id"`
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Phone     *string `json:"phone"`
+	Username  *string `json:"username"` // Only when UsernameIsEmail is false.
+	// Metadata keys are merged into the user's Metadata, a nil value deletes its key.
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	CustomValidator `json:"-"`
+}
+
+func (va *UpdateUserParams) Validate() error {
+	if va.CustomValidator != nil {
+		return va.CustomValidator()
+	}
+	if va.Email != nil && *va.Email == "" {
+		return ErrEmailRequired
+	}
+	if va.Email != nil && !govalidator.IsEmail(*va.Email) {
+		return ErrInvalid("'email' invalid.")
+	}
+	if va.Username != nil && *va.Username == "" {
+		return ErrUsernameRequired
+	}
+	if va.Phone != nil && *va.Phone != "" && !Rgx_E164.MatchString(*va.Phone) {
+		return ErrPhoneInvalid
+	}
+	return nil
+}
+
+// Update changes the user's profile fields which are set in p, nil fields are left unchanged and "" clears the
+// names and phone.
+func (us *Users) Update(p UpdateUserParams) error {
+	return us.UpdateContext(context.Background(), p)
+}
+
+func (us *Users) UpdateContext(ctx context.Context, p UpdateUserParams) error {
+	if p.Id == nil {
+		return ErrIdRequired
+	}
+	if p.Username != nil && *us.UsernameIsEmail {
+		return ErrUsernameIsEmail
+	}
+	if p.Username != nil {
+		username := us.normalizeUsername(*p.Username)
+		if username == "" {
+			return ErrUsernameRequired
+		}
+		p.Username = &username
+	}
+	if p.Email != nil {
+		email := NormalizeEmail(*p.Email)
+		// Unlike the names and phone, which are cleared by "", the email identifies the user
+		if email == "" {
+			return ErrEmailRequired
+		}
+		p.Email = &email
+	}
+	u, err := us.GetContext(ctx, *p.Id)
+	if err != nil {
+		return err
 	}
 	_ = ApplyUpdates(u, p)
 	if p.Email != nil && us.UsernameIsEmail != nil && *us.UsernameIsEmail {
 		u.Username = *p.Email
 	}
-	stmt, err := us.db.Prepare("UPDATE users SET first_name = ?, last_name = ?, email = ?, username = ?, phone = ?, updated = ? WHERE id = ? AND deleted = 0")
+	// The profile and metadata change together, the whole tx is retried if the metadata changed meanwhile
+	err = TxWithRetryContext(ctx, us.db, metadataRetries, isMetadataConflict, func(tx *sql.Tx) error {
+		err := us.available(ctx, tx, u.Id, u.Email, u.Username)
+		if err != nil {
+			return err
+		}
+		err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET first_name = ?, last_name = ?, email = ?, "+
+			"username = ?, phone = ?, updated = ? WHERE id = ? AND deleted = 0"),
+			u.FirstName, u.LastName, u.Email, u.Username, u.Phone, Milliseconds(us.Clock.Now()), u.Id))
+		if err != nil || len(p.Metadata) == 0 {
+			return err
+		}
+		return us.mergeMetadata(ctx, tx, u.Id, p.Metadata)
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return us.taken(ctx, u.Id, u.Email, u.Username)
+	}
+	return err
+}
+
+// UpdateByUid is the same as Update but addresses the user by uid, p.Id is ignored.
+func (us *Users) UpdateByUid(uid string, p UpdateUserParams) error {
+	return us.UpdateByUidContext(context.Background(), uid, p)
+}
+
+func (us *Users) UpdateByUidContext(ctx context.Context, uid string, p UpdateUserParams) error {
+	id, err := us.idByUid(ctx, uid)
 	if err != nil {
 		return err
 	}
-	err = CheckUpdated(stmt.Exec(u.FirstName, u.LastName, u.Email, u.Username, u.Phone, Milliseconds(time.Now()), u.Id))
-	if err != nil && strings.Contains(err.Error(), "Duplicate entry") { // ERR_STRING_EMAIL_CONSTRAINT) {
-		return ErrEmailTaken
-	}
-	return err
+	p.Id = &id
+	return us.UpdateContext(ctx, p)
 }
 
 type AssignRoleParams struct {
@@ -427,32 +1610,377 @@ func (va *AssignRoleParams) Validate() error {
 	return nil
 }
 
+// AssignRole sets the user's primary role, assigning the role the user already has does nothing.
 func (us *Users) AssignRole(p AssignRoleParams) error {
-	u, err := us.Get(*p.Id)
+	return us.AssignRoleContext(context.Background(), p)
+}
+
+func (us *Users) AssignRoleContext(ctx context.Context, p AssignRoleParams) error {
+	u, err := us.GetContext(ctx, *p.Id)
 	if err != nil {
 		return err
 	}
 	if u.Passive {
 		return ErrInvalid("This user is passive, cannot assign a role")
 	}
-	stmt, err := us.db.Prepare("UPDATE users SET role = ?, updated = ? WHERE id = ? AND deleted = 0")
+	var role Role
+	if p.Role != nil {
+		role = *p.Role
+	}
+	// MySQL reports no affected rows for an unchanged row, so reassigning the role is a success without a write
+	if role == u.Role {
+		return nil
+	}
+	stmt, err := us.prepare(ctx, "UPDATE users SET role = ?, role_updated = ? WHERE id = ? AND deleted = 0")
 	if err != nil {
 		return err
 	}
-	if p.Role == nil {
-		u.Role = 0
-	} else {
-		u.Role = *p.Role
+	return CheckUpdated(stmt.ExecContext(ctx, role, Milliseconds(us.Clock.Now()), u.Id))
+}
+
+// AddRole gives the user r in addition to their primary Role, adding a role the user already has does nothing.
+func (us *Users) AddRole(userId int64, r Role) error {
+	return us.AddRoleContext(context.Background(), userId, r)
+}
+
+func (us *Users) AddRoleContext(ctx context.Context, userId int64, r Role) error {
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if u.Passive {
+		return ErrInvalid("This user is passive, cannot assign a role")
+	}
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET role_updated = ? WHERE id = ? AND deleted = 0"),
+			Milliseconds(us.Clock.Now()), userId))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO user_roles (user_id, role, created) VALUES (?, ?, ?)"),
+			userId, r, Milliseconds(us.Clock.Now()))
+		return err
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return nil
+	}
+	return err
+}
+
+// RemoveRole takes r from the user's additional roles, it returns ErrNotFound if they don't have it. The primary
+// Role is unchanged, use AssignRole for that.
+func (us *Users) RemoveRole(userId int64, r Role) error {
+	return us.RemoveRoleContext(context.Background(), userId, r)
+}
+
+func (us *Users) RemoveRoleContext(ctx context.Context, userId int64, r Role) error {
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("DELETE FROM user_roles WHERE user_id = ? AND role = ?"), userId, r))
+		if err != nil {
+			return err
+		}
+		return CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET role_updated = ? WHERE id = ? AND deleted = 0"),
+			Milliseconds(us.Clock.Now()), userId))
+	})
+}
+
+// GetRoles returns the user's additional roles in ascending order, or nil if they have none. The primary Role isn't
+// included.
+func (us *Users) GetRoles(userId int64) ([]Role, error) {
+	return us.GetRolesContext(context.Background(), userId)
+}
+
+func (us *Users) GetRolesContext(ctx context.Context, userId int64) ([]Role, error) {
+	stmt, err := us.prepare(ctx, "SELECT role FROM user_roles WHERE user_id = ? ORDER BY role")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.QueryContext(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var roles []Role
+	for rows.Next() {
+		var r Role
+		if err := rows.Scan(&r); err != nil {
+			return nil, err
+		}
+		roles = append(roles, r)
+	}
+	return roles, rows.Err()
+}
+
+// AssignRoleByUid is the same as AssignRole but addresses the user by uid, p.Id is ignored.
+func (us *Users) AssignRoleByUid(uid string, p AssignRoleParams) error {
+	return us.AssignRoleByUidContext(context.Background(), uid, p)
+}
+
+func (us *Users) AssignRoleByUidContext(ctx context.Context, uid string, p AssignRoleParams) error {
+	id, err := us.idByUid(ctx, uid)
+	if err != nil {
+		return err
+	}
+	p.Id = &id
+	return us.AssignRoleContext(ctx, p)
+}
+
+type SetOrgParams struct {
+	Id              *int64 `json:"id"`
+	OrgId           *int64 `json:"org_id"`
+	Role            *Role  `json:"role"` // Defaults to the org's default_role, then UserOpts.DefaultRole.
+	CustomValidator `json:"-"`
+}
+
+func (va *SetOrgParams) Validate() error {
+	if va.CustomValidator != nil {
+		return va.CustomValidator()
+	}
+	if va.OrgId == nil {
+		return ErrInvalid("An 'org_id' is required. Supply '0' for no org.")
+	}
+	return nil
+}
+
+// SetOrg moves the user into an org, making them a member of it, and sets their role for it. It returns
+// ErrUnknownOrg if the org doesn't exist.
+func (us *Users) SetOrg(p SetOrgParams) error {
+	return us.SetOrgContext(context.Background(), p)
+}
+
+func (us *Users) SetOrgContext(ctx context.Context, p SetOrgParams) error {
+	u, err := us.GetContext(ctx, *p.Id)
+	if err != nil {
+		return err
+	}
+	if p.Role != nil && u.Passive {
+		return ErrInvalid("This user is passive, cannot assign a role")
 	}
-	return CheckUpdated(stmt.Exec(u.Role, Milliseconds(time.Now()), u.Id))
+	// In a tx so the org can't be deleted between being checked and set
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := us.checkOrg(ctx, tx, *p.OrgId)
+		if err != nil {
+			return err
+		}
+		var role Role
+		if p.Role != nil {
+			role = *p.Role
+		} else if !u.Passive {
+			role, err = us.defaultRole(ctx, tx, *p.OrgId)
+			if err != nil {
+				return err
+			}
+		}
+		err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET org_id = ?, role = ?, role_updated = ? "+
+			"WHERE id = ? AND deleted = 0"), *p.OrgId, role, Milliseconds(us.Clock.Now()), u.Id))
+		if err != nil || *p.OrgId == 0 {
+			return err
+		}
+		return us.addMembership(ctx, tx, u.Id, *p.OrgId)
+	})
 }
 
+// Delete soft deletes the user and revokes their sessions.
 func (us *Users) Delete(id int64) error {
-	stmt, err := us.db.Prepare("UPDATE users SET deleted = 1, updated = ? WHERE id = ? AND deleted = 0")
+	return us.DeleteContext(context.Background(), id)
+}
+
+func (us *Users) DeleteContext(ctx context.Context, id int64) error {
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		now := Milliseconds(us.Clock.Now())
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET deleted = 1, updated = ? WHERE id = ? AND deleted = 0"), now, id))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE sessions SET revoked = ? WHERE user_id = ? AND revoked = 0"), now, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	us.events().OnDeleted(id)
+	return nil
+}
+
+// Suspend stops the user signing in and revokes their sessions and the tokens ValidateToken accepts.
+func (us *Users) Suspend(id int64) error {
+	return us.SuspendContext(context.Background(), id)
+}
+
+func (us *Users) SuspendContext(ctx context.Context, id int64) error {
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := us.Suspender.suspend(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE users SET token_version = COALESCE(token_version, 0) + 1 "+
+			"WHERE id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE sessions SET revoked = ? WHERE user_id = ? AND revoked = 0"),
+			Milliseconds(us.Clock.Now()), id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	us.events().OnSuspended(id)
+	return nil
+}
+
+// SuspendByOrg suspends, or restores when suspended is false, all the org's users and returns how many changed.
+// Suspending also revokes their sessions and tokens. OnSuspended isn't sent for each user.
+func (us *Users) SuspendByOrg(orgId int64, suspended bool) (int64, error) {
+	return us.SuspendByOrgContext(context.Background(), orgId, suspended)
+}
+
+func (us *Users) SuspendByOrgContext(ctx context.Context, orgId int64, suspended bool) (int64, error) {
+	var affected int64
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		now := Milliseconds(us.Clock.Now())
+		res, err := tx.ExecContext(ctx, us.rebind("UPDATE users SET suspended = ?, status_updated = ? "+
+			"WHERE org_id = ? AND deleted = 0 AND suspended = ?"), suspended, now, orgId, !suspended)
+		if err != nil {
+			return err
+		}
+		affected, err = res.RowsAffected()
+		if err != nil || !suspended {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE users SET token_version = COALESCE(token_version, 0) + 1 "+
+			"WHERE org_id = ? AND deleted = 0"), orgId)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE sessions SET revoked = ? WHERE revoked = 0 AND user_id IN "+
+			"(SELECT id FROM users WHERE org_id = ? AND deleted = 0)"), now, orgId)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return affected, nil
+}
+
+func (us *Users) DeleteByUid(uid string) error {
+	return us.DeleteByUidContext(context.Background(), uid)
+}
+
+func (us *Users) DeleteByUidContext(ctx context.Context, uid string) error {
+	id, err := us.idByUid(ctx, uid)
 	if err != nil {
 		return err
 	}
-	return CheckUpdated(stmt.Exec(Milliseconds(time.Now()), id))
+	return us.DeleteContext(ctx, id)
+}
+
+// UnDelete restores a soft deleted user. It returns ErrNotFound unless the user is deleted and ErrEmailTaken or
+// ErrUsernameTaken if a live user has since taken the email or username.
+func (us *Users) UnDelete(id int64) error {
+	return us.UnDeleteContext(context.Background(), id)
+}
+
+func (us *Users) UnDeleteContext(ctx context.Context, id int64) error {
+	var email, username string
+	err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := CheckNotFound(tx.QueryRowContext(ctx, us.rebind("SELECT email, username FROM users WHERE id = ? AND deleted = 1"),
+			id).Scan(&email, &username))
+		if err != nil {
+			return err
+		}
+		exists, err := us.exists(ctx, tx, ExistsParams{Username: username, Email: email})
+		if exists {
+			return err
+		}
+		if us.ForbidEmailUsernameCollision {
+			err = us.collides(ctx, tx, email, username, id)
+			if err != nil {
+				return err
+			}
+		}
+		return CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET deleted = 0, updated = ? WHERE id = ? AND deleted = 1"),
+			Milliseconds(us.Clock.Now()), id))
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return us.taken(ctx, id, email, username)
+	}
+	return err
+}
+
+// PurgeMode selects how Purge erases a user.
+type PurgeMode int
+
+const (
+	PurgeDelete    PurgeMode = iota // Removes the user row.
+	PurgeAnonymize                  // Keeps the row for auditing but blanks its personal data.
+)
+
+// purged marks an anonymized user in the deleted column so UnDelete can't restore it.
+const purged = 2
+
+// Purge erases a user's personal data, e.g. for an erasure request, and removes their password resets, attempts,
+// additional roles, recovery codes and pending email changes. Unlike Delete it can't be undone.
+func (us *Users) Purge(id int64, mode PurgeMode) error {
+	return us.PurgeContext(context.Background(), id, mode)
+}
+
+func (us *Users) PurgeContext(ctx context.Context, id int64, mode PurgeMode) error {
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		var email, username string
+		err := CheckNotFound(tx.QueryRowContext(ctx, us.rebind("SELECT email, username FROM users WHERE id = ?"),
+			id).Scan(&email, &username))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM password_resets WHERE user_id = ? OR email = ?"), id, email)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM email_changes WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM user_roles WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM user_orgs WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM recovery_codes WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM sessions WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM api_keys WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM trusted_devices WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM signup_keys WHERE user_id = ?"), id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("DELETE FROM password_attempts WHERE username = ? OR username = ?"),
+			username, email)
+		if err != nil {
+			return err
+		}
+		if mode == PurgeAnonymize {
+			return CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET username = '', email = '', "+
+				"first_name = '', last_name = '', phone = '', password_hash = '', invite_code = '', last_login_ip = '', metadata = NULL, deleted = ?, "+
+				"updated = ? WHERE id = ?"), purged, Milliseconds(us.Clock.Now()), id))
+		}
+		return CheckUpdated(tx.ExecContext(ctx, us.rebind("DELETE FROM users WHERE id = ?"), id))
+	})
 }
 
 type ListUsersParams struct {
@@ -468,6 +1996,23 @@ type UserFilters struct {
 	Email     string `schema:"email"`
 	Suspended *bool  `schema:"suspended"`
 	Phone     string `schema:"phone"`
+	Query     string `schema:"query"` // matches any of userQueryColumns
+	// InactiveSince matches users whose last sign in was before this time in milliseconds, including users who have
+	// never signed in.
+	InactiveSince int64 `schema:"inactive_since"`
+}
+
+// userQueryColumns are the columns matched by UserFilters.Query.
+var userQueryColumns = []string{"u.email", "u.username", "u.first_name", "u.last_name", "u.phone"}
+
+// userSortColumns are the ListArgs.OrderBy names accepted by List and the columns they sort by.
+var userSortColumns = map[string]string{
+	"id":         "u.id",
+	"created":    "u.created",
+	"updated":    "u.updated",
+	"email":      "u.email",
+	"first_name": "u.first_name",
+	"org_name":   "org_name",
 }
 
 type UserListResponse struct {
@@ -477,91 +2022,171 @@ type UserListResponse struct {
 }
 
 func (va *ListUsersParams) Validate() error {
-	if va.CustomValidator != nil {
-		return va.CustomValidator()
-	}
-	return nil
-}
-
-func (us *Users) List(p ListUsersParams) (*UserListResponse, error) {
-	q := "SELECT u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone," +
-		" u.org_id, o.name as org_name, u.created, u.updated, u.role, u.suspended, u.passive, u.activated " +
-		"From users u left join orgs o on u.org_id = o.id WHERE 1"
-	countq := "SELECT count(u.id) FROM users u WHERE 1"
-
-	args := []interface{}{}
-	if !p.Deleted {
-		q += " AND u.deleted = 0"
-		countq += " AND u.deleted = 0"
-	}
-	if p.OrgId > 0 {
-		q, countq, args = addClause(q, countq, " AND u.org_id = ?", args, p.OrgId)
-	}
-	if p.Role > 0 {
-		q, countq, args = addClause(q, countq, " AND u.role = ?", args, p.Role)
-	}
-	if p.Suspended != nil {
-		if *p.Suspended {
-			q += " AND u.suspended = 1"
-			countq += " AND u.suspended = 1"
-		} else {
-			q += " AND u.suspended = 0"
-			countq += " AND u.suspended = 0"
-		}
-	}
-	if p.Name != "" {
-		q, countq, args = addClause(q, countq, " AND (u.first_name like ?", args, "%"+p.Name+"%")
-		q, countq, args = addClause(q, countq, " OR u.last_name like ?)", args, "%"+p.Name+"%")
-	}
-	if p.Phone != "" {
-		q, countq, args = addClause(q, countq, " AND u.phone like ?", args, "%"+p.Phone+"%")
-	}
-	if p.Email != "" {
-		q, countq, args = addClause(q, countq, " AND u.email like ?", args, "%"+p.Email+"%")
+	if va.CustomValidator != nil {
+		return va.CustomValidator()
 	}
-	rows, err := GetRows(us.db, q, &p.ListArgs, args...)
+	return nil
+}
+
+func (us *Users) List(p ListUsersParams) (*UserListResponse, error) {
+	return us.ListContext(context.Background(), p)
+}
+
+func (us *Users) ListContext(ctx context.Context, p ListUsersParams) (*UserListResponse, error) {
+	q, countq, args, err := us.listQuery(&p)
 	if err != nil {
 		return nil, err
 	}
-	row := us.db.QueryRow(countq, args...)
 	var total int64
-	err = row.Scan(&total)
+	var users []*User
+	err = snapshotTx(ctx, us.db, func(tx *sql.Tx) error {
+		rows, err := queryRows(ctx, tx, q, args...)
+		if err != nil {
+			return err
+		}
+		users, err = scanListedUsers(rows)
+		if err != nil {
+			return err
+		}
+		// The count query doesn't have the LIMIT and OFFSET args. It runs in the same snapshot as the page so the
+		// total agrees with the items even while users are being added.
+		return tx.QueryRowContext(ctx, countq, args[:len(args)-2]...).Scan(&total)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return &UserListResponse{
+		Total: total,
+		Items: users,
+		ListArgs: ListArgs{
+			Size:      p.Size,
+			Page:      p.Page,
+			Direction: p.Direction,
+			OrderBy:   p.OrderBy,
+			Deleted:   p.Deleted,
+		}}, nil
+}
+
+// Count returns the number of users matching f, deleted users aren't counted.
+func (us *Users) Count(f UserFilters) (int64, error) {
+	return us.CountContext(context.Background(), f)
+}
+
+func (us *Users) CountContext(ctx context.Context, f UserFilters) (int64, error) {
+	where, args := f.where(false)
+	var total int64
+	err := us.db.QueryRowContext(ctx, us.rebind("SELECT count(u.id) FROM users u WHERE 1=1"+where), args...).Scan(&total)
+	return total, err
+}
+
+// scanListedUsers scans and closes the rows of a listSelect query.
+func scanListedUsers(rows *sql.Rows) ([]*User, error) {
+	defer rows.Close()
 	users := []*User{}
 	for rows.Next() {
 		u := &User{}
-		var orgName sql.NullString
-		var passive, activated sql.NullBool
-		err2 := rows.Scan(&u.Id, &u.Uid, &u.Username, &u.Email, &u.FirstName, &u.LastName, &u.Phone, &u.OrgId, &orgName, &u.Created, &u.Updated, &u.Role, &u.Suspended, &passive, &activated)
-		if err2 != nil {
+		var orgName, lastLoginIP, metadata sql.NullString
+		var uid, username, email, firstName, lastName, phone sql.NullString
+		var passive, activated, verified sql.NullBool
+		err := rows.Scan(&u.Id, &uid, &username, &email, &firstName, &lastName, &phone, &u.OrgId, &orgName, &u.Created, &u.Updated, &u.RoleUpdated, &u.StatusUpdated, &u.LastLogin, &lastLoginIP, &u.Role, &u.Suspended, &passive, &activated, &verified, &metadata, &u.MustChangePassword)
+		if err != nil {
+			return nil, err
+		}
+		u.Uid, u.Username, u.Email, u.FirstName, u.LastName, u.Phone = uid.String, username.String, email.String, firstName.String, lastName.String, phone.String
+		u.Metadata, err = parseMetadata(metadata)
+		if err != nil {
 			return nil, err
 		}
+		u.LastLoginIP = lastLoginIP.String
 		if passive.Valid {
 			u.Passive = passive.Bool
 		}
 		if activated.Valid {
 			u.Activated = activated.Bool
 		}
+		if verified.Valid {
+			u.Verified = verified.Bool
+		}
 		if orgName.Valid {
 			u.OrgName = orgName.String
 		}
 		users = append(users, u)
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+	return users, rows.Err()
+}
+
+// listSelect is the users query of List and Export, without the filters.
+func (us *Users) listSelect() string {
+	orgNameCol, _, orgJoin := us.orgColumns()
+	return "SELECT u.id, u.uid, u.username, u.email, u.first_name, u.last_name, u.phone," +
+		" u.org_id, " + orgNameCol + " as org_name, u.created, u.updated, u.role_updated, u.status_updated, COALESCE(u.last_login, 0), u.last_login_ip, u.role, u.suspended, u.passive, u.activated, u.verified, u.metadata, " +
+		"COALESCE(u.must_change_password, 0) From users u" + orgJoin + " WHERE 1=1"
+}
+
+// listQuery builds the paged List query, the matching count query and the args for the configured Dialect. The
+// last two args are the LIMIT and OFFSET which aren't used by the count query. p.Size is limited to MaxPageSize.
+func (us *Users) listQuery(p *ListUsersParams) (string, string, []interface{}, error) {
+	p.ApplyDefaults()
+	if p.Size > us.MaxPageSize {
+		p.Size = us.MaxPageSize
+	}
+	q := us.listSelect()
+	countq := "SELECT count(u.id) FROM users u WHERE 1=1"
+
+	where, args := p.where(p.Deleted)
+	q += where
+	countq += where
+	q, args, err := sortedPageQuery(q, &p.ListArgs, userSortColumns, args)
+	if err != nil {
+		return "", "", nil, err
 	}
-	return &UserListResponse{
-		Total: total,
-		Items: users,
-		ListArgs: ListArgs{
-			Size:      p.Size,
-			Page:      p.Page,
-			Direction: p.Direction,
-			OrderBy:   p.OrderBy,
-			Deleted:   p.Deleted,
-		}}, nil
+	return us.rebind(q), us.rebind(countq), args, nil
+}
+
+// where returns the WHERE conditions and args for the filters, deleted users are excluded unless deleted is true.
+func (f *UserFilters) where(deleted bool) (string, []interface{}) {
+	q := ""
+	args := []interface{}{}
+	if !deleted {
+		q += " AND u.deleted = 0"
+	}
+	if f.OrgId > 0 {
+		q, args = q+" AND u.org_id = ?", append(args, f.OrgId)
+	}
+	if f.Role > 0 {
+		q, args = q+" AND u.role = ?", append(args, f.Role)
+	}
+	if f.Suspended != nil {
+		if *f.Suspended {
+			q += " AND u.suspended = 1"
+		} else {
+			q += " AND u.suspended = 0"
+		}
+	}
+	if f.Name != "" {
+		q, args = q+" AND (u.first_name like ? OR u.last_name like ?)", append(args, "%"+f.Name+"%", "%"+f.Name+"%")
+	}
+	if f.Phone != "" {
+		q, args = q+" AND u.phone like ?", append(args, "%"+f.Phone+"%")
+	}
+	if f.Email != "" {
+		q, args = q+" AND u.email like ?", append(args, "%"+f.Email+"%")
+	}
+	if f.InactiveSince > 0 {
+		q, args = q+" AND (u.last_login < ? OR u.last_login IS NULL)", append(args, f.InactiveSince)
+	}
+	if f.Query != "" {
+		like := "%" + likeEscape(f.Query) + "%"
+		for i, col := range userQueryColumns {
+			clause := " OR "
+			if i == 0 {
+				clause = " AND ("
+			}
+			q, args = q+clause+col+" like ? ESCAPE '!'", append(args, like)
+		}
+		q += ")"
+	}
+	return q, args
 }
 
 func addClause(sqla string, sqlb string, clause string, params []interface{}, val interface{}) (string, string, []interface{}) {
@@ -588,27 +2213,47 @@ func (va *ResetPasswordParams) Validate() error {
 	return nil
 }
 
+// ResetPassword stores and returns a token for ChangePassword which should only be sent to the user's email. With
+// HideResetEnumeration the token is empty when there's nobody to send it to.
 func (us *Users) ResetPassword(p ResetPasswordParams) (string, error) {
-	u, _, err := us.GetByUsername(p.Email)
+	return us.ResetPasswordContext(context.Background(), p)
+}
+
+func (us *Users) ResetPasswordContext(ctx context.Context, p ResetPasswordParams) (string, error) {
+	token, err := us.resetPassword(ctx, p)
+	if us.HideResetEnumeration && (err == ErrNotFound || err == ErrNotAuth) {
+		return "", nil
+	}
 	if err != nil {
 		return "", err
 	}
-	if u.Passive {
+	us.metrics().IncPasswordReset()
+	return token, nil
+}
+
+// resetPassword is ResetPassword without the metrics, for activation tokens.
+func (us *Users) resetPassword(ctx context.Context, p ResetPasswordParams) (string, error) {
+	p.Email = NormalizeEmail(p.Email)
+	u, _, err := us.GetByUsernameContext(ctx, p.Email)
+	if err != nil {
+		return "", err
+	}
+	if u.Passive && !us.PasswordChangeActivatesPassive {
 		return "", ErrNotAuth
 	}
-	token := us.PassGen(128)
-	err = Tx(us.db, func(tx *sql.Tx) error {
-		_, err = tx.Exec("UPDATE password_resets set deleted = 1 where email = ?", p.Email)
+	token := us.PassGen(us.ResetTokenLength)
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE password_resets set deleted = 1 where email = ?"), p.Email)
 		if err != nil {
 			return err
 		}
-		stmt, err := tx.Prepare("INSERT into password_resets (user_id, email, reset_token, created, deleted) values (?, ?, ?, ?, ?)")
+		stmt, err := tx.PrepareContext(ctx, us.rebind("INSERT into password_resets (user_id, email, reset_token, created, deleted) values (?, ?, ?, ?, ?)"))
 		if err != nil {
 			return err
 		}
-		_, err = stmt.Exec(u.Id, u.Email, token, Milliseconds(time.Now()), 0)
+		_, err = stmt.ExecContext(ctx, u.Id, u.Email, hashToken(token), Milliseconds(us.Clock.Now()), 0)
 		if err != nil {
-			LogErr(err)
+			us.log().Error("storing reset token", "error", err, "user_id", u.Id)
 			return err
 		}
 		return nil
@@ -643,37 +2288,49 @@ func (va *ChangePasswordParams) Validate() error {
 	if govalidator.IsNull(va.NewPassword) {
 		return ErrInvalid("'new_password' is required.")
 	}
-	if !ValidatePassword(va.NewPassword) {
-		return ErrPasswordInvalid
-	}
 	return nil
 }
 
 func (us *Users) ChangePassword(p ChangePasswordParams) error {
+	return us.ChangePasswordContext(context.Background(), p)
+}
+
+func (us *Users) ChangePasswordContext(ctx context.Context, p ChangePasswordParams) error {
+	p.Email = NormalizeEmail(p.Email)
+	u, _, err := us.GetByUsernameContext(ctx, p.Email)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	err = us.checkPassword(p.NewPassword)
+	if err != nil {
+		return err
+	}
+	// Whether the user is passive is only revealed once they have proven who they are.
 	if p.ExistingPassword != "" {
-		_, err := us.SignIn(SignInParams{Username: p.Email, Password: p.ExistingPassword})
+		// signIn returns ErrPassiveUser after checking the password
+		_, err := us.signIn(ctx, SignInParams{Username: p.Email, Password: p.ExistingPassword})
+		if err != nil {
+			return err
+		}
+		err = us.checkPasswordChanged(ctx, p.Email, p.NewPassword)
 		if err != nil {
 			return err
 		}
 	} else if p.ResetToken != "" {
-		err := Tx(us.db, func(tx *sql.Tx) error {
-			stmt, err := tx.Prepare(
-				"SELECT reset_token, created FROM password_resets where email = ? and  deleted = 0 " +
-					"ORDER BY created DESC LIMIT 1")
-			row := stmt.QueryRow(p.Email)
-			var resetToken string
-			var created int64
-			err = CheckNotFound(row.Scan(&resetToken, &created))
+		err := TxContext(ctx, us.db, func(tx *sql.Tx) error {
+			err := us.checkResetToken(ctx, tx, p.Email, p.ResetToken)
 			if err != nil {
 				return err
 			}
-			if resetToken != p.ResetToken {
-				return ErrInvalidResetToken
+			if u != nil && u.Passive && !us.PasswordChangeActivatesPassive {
+				return ErrPassiveUser
 			}
-			if Milliseconds(time.Now()) > (created + us.ResetTokenExpiry*1000) {
-				return ErrTokenExpired
+			// Checked before the token is consumed so the user can try again with a different password.
+			err = us.checkPasswordChanged(ctx, p.Email, p.NewPassword)
+			if err != nil {
+				return err
 			}
-			_, err = tx.Exec("UPDATE password_resets set deleted = 1 WHERE email = ?", p.Email)
+			_, err = tx.ExecContext(ctx, us.rebind("UPDATE password_resets set deleted = 1 WHERE email = ?"), p.Email)
 			return err
 		})
 		if err != nil {
@@ -682,32 +2339,371 @@ func (us *Users) ChangePassword(p ChangePasswordParams) error {
 	} else {
 		return ErrNotAuth
 	}
-	hash, err := hashPassword(p.NewPassword)
+	hash, err := us.Hasher.Hash(p.NewPassword)
+	if err != nil {
+		return err
+	}
+	// Passive users can only get this far when PasswordChangeActivatesPassive is set.
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		now := Milliseconds(us.Clock.Now())
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET activated = 1, passive = 0, must_change_password = 0, "+
+			"password_hash = ?, updated = ?, password_changed = ?, token_version = COALESCE(token_version, 0) + 1 "+
+			"WHERE email = ? AND deleted = 0"), hash, now, now, p.Email))
+		if err != nil {
+			return err
+		}
+		return us.revokeCredentials(ctx, tx, u.Id)
+	})
+	if err != nil {
+		return err
+	}
+	us.events().OnPasswordChanged(u.Id)
+	return nil
+}
+
+// AdminSetPassword sets the user's password without a reset token, e.g. a temporary password for a kiosk account.
+// The password is checked like ChangePassword's and the user's sessions and trusted devices are revoked. With
+// forceChange SignIn returns ErrPasswordChangeRequired until the user calls ChangePassword.
+func (us *Users) AdminSetPassword(userId int64, newPassword string, forceChange bool) error {
+	return us.AdminSetPasswordContext(context.Background(), userId, newPassword, forceChange)
+}
+
+func (us *Users) AdminSetPasswordContext(ctx context.Context, userId int64, newPassword string, forceChange bool) error {
+	if newPassword == "" {
+		return ErrPasswordRequired
+	}
+	u, err := us.GetContext(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if u.Passive && !us.PasswordChangeActivatesPassive {
+		return ErrPassiveUser
+	}
+	err = us.checkPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	hash, err := us.Hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		now := Milliseconds(us.Clock.Now())
+		err := CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET activated = 1, passive = 0, must_change_password = ?, "+
+			"password_hash = ?, updated = ?, password_changed = ?, token_version = COALESCE(token_version, 0) + 1 "+
+			"WHERE id = ? AND deleted = 0"), forceChange, hash, now, now, u.Id))
+		if err != nil {
+			return err
+		}
+		return us.revokeCredentials(ctx, tx, u.Id)
+	})
+	if err != nil {
+		return err
+	}
+	us.events().OnPasswordChanged(u.Id)
+	return nil
+}
+
+// revokeCredentials revokes the sessions and trusted devices of a user whose password changed in tx, so none
+// outlive the old password if the change commits.
+func (us *Users) revokeCredentials(ctx context.Context, tx *sql.Tx, userId int64) error {
+	err := us.revokeSessions(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+	return us.revokeTrustedDevices(ctx, tx, userId)
+}
+
+// ExpirePasswords sets MustChangePassword for the active users whose password was last set before changedBefore,
+// in milliseconds, e.g. from a scheduled job enforcing a maximum password age. It returns the number of users
+// flagged. Users whose password hasn't changed since SignUp are aged from when they signed up.
+func (us *Users) ExpirePasswords(changedBefore int64) (int64, error) {
+	return us.ExpirePasswordsContext(context.Background(), changedBefore)
+}
+
+func (us *Users) ExpirePasswordsContext(ctx context.Context, changedBefore int64) (int64, error) {
+	stmt, err := us.prepare(ctx, "UPDATE users SET must_change_password = 1 WHERE deleted = 0 AND COALESCE(passive, 0) = 0 "+
+		"AND COALESCE(must_change_password, 0) = 0 AND COALESCE(password_changed, created) < ?")
+	if err != nil {
+		return 0, err
+	}
+	res, err := stmt.ExecContext(ctx, changedBefore)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// VerifyEmail marks the user's email as verified using the activation token returned by SignUp (or any token from
+// ResetPassword). The token is validated the same way as in ChangePassword and is consumed on success.
+func (us *Users) VerifyEmail(email string, token string) error {
+	return us.VerifyEmailContext(context.Background(), email, token)
+}
+
+func (us *Users) VerifyEmailContext(ctx context.Context, email string, token string) error {
+	email = NormalizeEmail(email)
+	u, _, err := us.GetByUsernameContext(ctx, email)
+	if err != nil {
+		return err
+	}
+	if u.Verified {
+		return ErrAlreadyVerified
+	}
+	return TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		err := us.checkResetToken(ctx, tx, email, token)
+		if err != nil {
+			return err
+		}
+		err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET verified = 1, updated = ? WHERE id = ? AND deleted = 0"),
+			Milliseconds(us.Clock.Now()), u.Id))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE password_resets set deleted = 1 WHERE email = ?"), email)
+		return err
+	})
+}
+
+const activationPurpose = "activate"
+
+// IssueStatelessActivationToken returns a signed token for ConfirmEmailStateless. Unlike the SignUp activation token
+// nothing is stored, so it can't be revoked before it expires.
+func (us *Users) IssueStatelessActivationToken(userId int64) (string, error) {
+	if len(us.StatelessTokenKey) == 0 {
+		return "", ErrNoStatelessTokenKey
+	}
+	expires := us.Clock.Now().Unix() + us.ResetTokenExpiry
+	return statelessToken(us.StatelessTokenKey, activationPurpose, userId, expires), nil
+}
+
+// ConfirmEmailStateless marks the email of the token's user as verified, see IssueStatelessActivationToken.
+func (us *Users) ConfirmEmailStateless(token string) error {
+	return us.ConfirmEmailStatelessContext(context.Background(), token)
+}
+
+func (us *Users) ConfirmEmailStatelessContext(ctx context.Context, token string) error {
+	if len(us.StatelessTokenKey) == 0 {
+		return ErrNoStatelessTokenKey
+	}
+	id, err := parseStatelessToken(us.StatelessTokenKey, activationPurpose, token, us.Clock.Now())
+	if err != nil {
+		return err
+	}
+	u, err := us.GetContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	if u.Verified {
+		return ErrAlreadyVerified
+	}
+	return CheckUpdated(us.db.ExecContext(ctx, us.rebind("UPDATE users SET verified = 1, updated = ? WHERE id = ? AND deleted = 0"),
+		Milliseconds(us.Clock.Now()), id))
+}
+
+// RequestEmailChange stores newEmail as the user's pending email and returns a token, to be sent to newEmail, for
+// ConfirmEmailChange. The email in use doesn't change until then.
+func (us *Users) RequestEmailChange(id int64, newEmail string) (string, error) {
+	return us.RequestEmailChangeContext(context.Background(), id, newEmail)
+}
+
+func (us *Users) RequestEmailChangeContext(ctx context.Context, id int64, newEmail string) (string, error) {
+	newEmail = NormalizeEmail(newEmail)
+	if !govalidator.IsEmail(newEmail) {
+		return "", ErrEmailInvalid
+	}
+	err := us.checkDisposable(newEmail)
+	if err != nil {
+		return "", err
+	}
+	u, err := us.GetContext(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	token := us.PassGen(us.ResetTokenLength)
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		username := u.Username
+		if *us.UsernameIsEmail {
+			username = newEmail
+		}
+		err := us.available(ctx, tx, u.Id, newEmail, username)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE email_changes SET deleted = 1 WHERE user_id = ?"), u.Id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("INSERT INTO email_changes (user_id, email, token, created, deleted) values (?, ?, ?, ?, ?)"),
+			u.Id, newEmail, hashToken(token), Milliseconds(us.Clock.Now()), 0)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConfirmEmailChange moves the user to the email pending from RequestEmailChange, the username follows when
+// UsernameIsEmail. The token expires after ResetTokenExpiry.
+func (us *Users) ConfirmEmailChange(id int64, token string) error {
+	return us.ConfirmEmailChangeContext(context.Background(), id, token)
+}
+
+func (us *Users) ConfirmEmailChangeContext(ctx context.Context, id int64, token string) error {
+	u, err := us.GetContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	var newEmail, username string
+	err = TxContext(ctx, us.db, func(tx *sql.Tx) error {
+		var changeToken string
+		var created int64
+		err := CheckNotFound(tx.QueryRowContext(ctx, us.rebind("SELECT email, token, created FROM email_changes "+
+			"WHERE user_id = ? AND deleted = 0 ORDER BY created DESC LIMIT 1"), u.Id).Scan(&newEmail, &changeToken, &created))
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(changeToken), []byte(hashToken(token))) != 1 {
+			return ErrInvalidResetToken
+		}
+		if Milliseconds(us.Clock.Now()) > (created + us.ResetTokenExpiry*1000) {
+			return ErrTokenExpired
+		}
+		username = u.Username
+		if *us.UsernameIsEmail {
+			username = newEmail
+		}
+		// The email may have been taken since the change was requested.
+		err = us.available(ctx, tx, u.Id, newEmail, username)
+		if err != nil {
+			return err
+		}
+		// Confirming proves the user owns the new email.
+		err = CheckUpdated(tx.ExecContext(ctx, us.rebind("UPDATE users SET email = ?, username = ?, verified = 1, updated = ? "+
+			"WHERE id = ? AND deleted = 0"), newEmail, username, Milliseconds(us.Clock.Now()), u.Id))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, us.rebind("UPDATE email_changes SET deleted = 1 WHERE user_id = ?"), u.Id)
+		return err
+	})
+	if us.Dialect.IsDuplicate(err) {
+		return us.taken(ctx, u.Id, newEmail, username)
+	}
+	return err
+}
+
+// available returns ErrEmailTaken or ErrUsernameTaken if another live user has the email or username. Soft deleted
+// users don't block them.
+func (us *Users) available(ctx context.Context, q rowQueryer, id int64, email string, username string) error {
+	var takenEmail, takenUsername string
+	err := q.QueryRowContext(ctx, us.rebind("SELECT email, username FROM users WHERE deleted = 0 AND id <> ? AND (email = ? OR username = ?) LIMIT 1"),
+		id, email, username).Scan(&takenEmail, &takenUsername)
+	if err == nil {
+		if strings.ToLower(takenEmail) == strings.ToLower(email) {
+			return ErrEmailTaken
+		}
+		return ErrUsernameTaken
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if us.ForbidEmailUsernameCollision {
+		return us.collides(ctx, q, email, username, id)
+	}
+	return nil
+}
+
+// taken returns ErrUsernameTaken or ErrEmailTaken after a write of user id failed with a duplicate key, e.g. when a
+// concurrent sign up committed the same email or username after exists() checked them. id is zero for a new user.
+func (us *Users) taken(ctx context.Context, id int64, email string, username string) error {
+	if us.available(ctx, us.db, id, email, username) == ErrUsernameTaken {
+		return ErrUsernameTaken
+	}
+	return ErrEmailTaken
+}
+
+// CheckResetToken returns nil if token is the email's latest unused and unexpired reset token, otherwise
+// ErrInvalidResetToken or ErrTokenExpired, e.g. to show the reset form on page load. Unlike ChangePassword it
+// doesn't consume the token.
+func (us *Users) CheckResetToken(email string, token string) error {
+	return us.CheckResetTokenContext(context.Background(), email, token)
+}
+
+func (us *Users) CheckResetTokenContext(ctx context.Context, email string, token string) error {
+	err := us.checkResetToken(ctx, us.db, NormalizeEmail(email), token)
+	if err == ErrNotFound {
+		return ErrInvalidResetToken
+	}
+	return err
+}
+
+// checkResetToken returns an error unless token is the latest unused and unexpired reset token for the email.
+func (us *Users) checkResetToken(ctx context.Context, db preparer, email string, token string) error {
+	stmt, err := db.PrepareContext(ctx, us.rebind(
+		"SELECT reset_token, created FROM password_resets where email = ? and  deleted = 0 "+
+			"ORDER BY created DESC LIMIT 1"))
 	if err != nil {
 		return err
 	}
-	stmt, err := us.db.Prepare("UPDATE users SET activated = 1, password_hash = ?, updated = ? WHERE email = ? AND deleted = 0")
-	err = CheckNotFound(err)
+	defer stmt.Close()
+	row := stmt.QueryRowContext(ctx, email)
+	var resetToken string
+	var created int64
+	err = CheckNotFound(row.Scan(&resetToken, &created))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(resetToken), []byte(hashToken(token))) != 1 {
+		return ErrInvalidResetToken
+	}
+	if Milliseconds(us.Clock.Now()) > (created + us.ResetTokenExpiry*1000) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+// checkPasswordChanged returns ErrPasswordUnchanged if password is the user's current password.
+func (us *Users) checkPasswordChanged(ctx context.Context, email string, password string) error {
+	_, hash, err := us.GetByUsernameContext(ctx, email)
 	if err != nil {
 		return err
 	}
-	_, err = stmt.Exec(hash, Milliseconds(time.Now()), p.Email)
+	if us.Hasher.Compare(hash, password) == nil {
+		return ErrPasswordUnchanged
+	}
 	return nil
 }
 
-func scanUser(row *sql.Row) (*User, error) {
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row scanner) (*User, error) {
 	var u User
 	var suspended int
-	var passive, activated sql.NullBool
-	err := row.Scan(&u.Id, &u.Uid, &u.Username, &u.Email, &u.FirstName, &u.LastName, &u.Phone, &u.OrgId,
-		&u.Created, &u.Updated, &u.Role, &suspended, &passive, &activated)
+	var passive, activated, verified sql.NullBool
+	var orgName, lastLoginIP, metadata sql.NullString
+	var uid, username, email, firstName, lastName, phone sql.NullString
+	err := row.Scan(&u.Id, &uid, &username, &email, &firstName, &lastName, &phone, &u.OrgId, &orgName,
+		&u.Created, &u.Updated, &u.RoleUpdated, &u.StatusUpdated, &u.LastLogin, &lastLoginIP, &u.Role, &suspended, &passive, &activated, &verified, &metadata, &u.MustChangePassword)
+	if err == nil {
+		u.Metadata, err = parseMetadata(metadata)
+	}
+	u.Uid, u.Username, u.Email, u.FirstName, u.LastName, u.Phone = uid.String, username.String, email.String, firstName.String, lastName.String, phone.String
+	u.OrgName = orgName.String
 	u.Suspended = suspended > 0
+	u.LastLoginIP = lastLoginIP.String
 	if passive.Valid {
 		u.Passive = passive.Bool
 	}
 	if activated.Valid {
 		u.Activated = activated.Bool
 	}
+	if verified.Valid {
+		u.Verified = verified.Bool
+	}
 	return CheckRows(&u, err)
 }
 
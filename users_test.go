@@ -1,8 +1,19 @@
 package gus
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -68,6 +79,69 @@ func TestUsers_SignUp(t *testing.T) {
 	assert.Equal(t, int64(1), users.Items[0].Id)
 }
 
+func TestUsers_ListOrderBy(t *testing.T) {
+	for _, col := range []string{"id", "created", "updated", "email", "first_name", "org_name", "created,id"} {
+		_, err := us.List(ListUsersParams{ListArgs: ListArgs{OrderBy: col, Direction: DirectionAsc}})
+		assert.Nil(t, err, col)
+	}
+	users, err := us.List(ListUsersParams{ListArgs: ListArgs{OrderBy: "email", Direction: "asc"}})
+	assert.Nil(t, err)
+	for i := 1; i < len(users.Items); i++ {
+		assert.True(t, users.Items[i-1].Email <= users.Items[i].Email)
+	}
+
+	injections := []ListArgs{
+		{OrderBy: "id; DROP TABLE users"},
+		{OrderBy: "(SELECT password FROM users LIMIT 1)"},
+		{OrderBy: "id,password"},
+		{OrderBy: "u.id"},
+		{OrderBy: "password"},
+		{OrderBy: "id", Direction: "ASC; DELETE FROM users"},
+		{OrderBy: "id", Direction: "ASC, password"},
+		{OrderBy: "id", Direction: "sideways"},
+	}
+	for _, args := range injections {
+		_, err := us.List(ListUsersParams{ListArgs: args})
+		assert.Equal(t, sqlErr, err, args)
+	}
+	after, err := us.List(ListUsersParams{})
+	assert.Nil(t, err)
+	assert.Equal(t, users.Total, after.Total)
+}
+
+func TestUsers_Count(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "counted@mail.com", FirstName: "Counted"})
+	assert.Nil(t, err)
+	suspended := true
+	assert.Nil(t, us.Suspend(u.Id))
+
+	for _, f := range []UserFilters{
+		{},
+		{Email: "mail.com"},
+		{Name: "Counted"},
+		{Suspended: &suspended},
+		{Query: "nobody-matches-this"},
+	} {
+		n, err := us.Count(f)
+		assert.Nil(t, err)
+		users, err := us.List(ListUsersParams{ListArgs: ListArgs{Size: 1000}, UserFilters: f})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(users.Items)), n, f)
+		assert.Equal(t, users.Total, n, f)
+	}
+
+	// Deleted users aren't counted, as in List
+	before, err := us.Count(UserFilters{})
+	assert.Nil(t, err)
+	assert.Nil(t, us.Delete(u.Id))
+	after, err := us.Count(UserFilters{})
+	assert.Nil(t, err)
+	assert.Equal(t, before-1, after)
+	n, err := us.Count(UserFilters{Name: "Counted"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+}
+
 func TestUsers_Passive(t *testing.T){
 	t.Log("with email")
 	cp.Email = "passive@mail.com"
@@ -106,6 +180,32 @@ func TestUsers_Passive(t *testing.T){
 
 
 
+func TestUsers_ChangePasswordPassive(t *testing.T) {
+	newP := "newPassword1!"
+	_, _, err := us.SignUp(SignUpParams{Email: "passive-change@mail.com", Passive: true})
+	assert.Nil(t, err)
+	// Without a valid credential they can't learn the user is passive
+	err = us.ChangePassword(ChangePasswordParams{Email: "passive-change@mail.com", ResetToken: "any", NewPassword: newP})
+	assert.Equal(t, ErrNotFound, err)
+	err = us.ChangePassword(ChangePasswordParams{Email: "passive-change@mail.com", ExistingPassword: "wrong", NewPassword: newP})
+	assert.Equal(t, ErrNotAuth, err)
+
+	// Activates the passive user
+	aus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PasswordChangeActivatesPassive: true})
+	u, _, err := aus.SignUp(SignUpParams{Email: "passive-activate@mail.com", Passive: true})
+	assert.Nil(t, err)
+	token, err := aus.ResetPassword(ResetPasswordParams{Email: u.Email})
+	assert.Nil(t, err)
+	err = aus.ChangePassword(ChangePasswordParams{Email: u.Email, ResetToken: token, NewPassword: newP})
+	assert.Nil(t, err)
+	u, err = aus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.False(t, u.Passive)
+	assert.True(t, u.Activated)
+	_, err = aus.SignIn(SignInParams{Email: u.Email, Password: newP})
+	assert.Nil(t, err)
+}
+
 func TestUsers_Update(t *testing.T) {
 	cp.Email = "update@mail.com"
 	u, _, err := us.SignUp(cp)
@@ -140,6 +240,55 @@ func TestUsers_Update(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestUsers_UpdateUsername(t *testing.T) {
+	username := "renamed"
+	u, _, err := us.SignUp(SignUpParams{Email: "rename-email@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrUsernameIsEmail, us.Update(UpdateUserParams{Id: &u.Id, Username: &username}))
+
+	f := false
+	ius := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	u, _, err = ius.SignUp(SignUpParams{Email: "rename@mail.com", Username: "rename"})
+	assert.Nil(t, err)
+	other, _, err := ius.SignUp(SignUpParams{Email: "rename-other@mail.com", Username: "rename-other"})
+	assert.Nil(t, err)
+
+	assert.Nil(t, ius.Update(UpdateUserParams{Id: &u.Id, Username: &username}))
+	u, err = ius.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, username, u.Username)
+	assert.Equal(t, "rename@mail.com", u.Email)
+
+	assert.Equal(t, ErrUsernameTaken, ius.Update(UpdateUserParams{Id: &u.Id, Username: &other.Username}))
+	empty := ""
+	assert.Equal(t, ErrUsernameRequired, ius.Update(UpdateUserParams{Id: &u.Id, Username: &empty}))
+	u, err = ius.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, username, u.Username)
+}
+
+func TestUsers_Message(t *testing.T) {
+	french := map[string]string{"email_taken": "Cette adresse e-mail est déjà utilisée."}
+	fus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1,
+		Translator: func(code string) string { return french[code] }})
+	_, _, err := fus.SignUp(SignUpParams{Email: "message@mail.com"})
+	assert.Nil(t, err)
+	_, _, err = fus.SignUp(SignUpParams{Email: "message@mail.com"})
+	assert.Equal(t, ErrEmailTaken, err)
+	assert.Equal(t, "email_taken", err.(*ValidationError).Code)
+	assert.Equal(t, "Cette adresse e-mail est déjà utilisée.", fus.Message(err))
+	assert.Equal(t, "That email is taken.", us.Message(err))
+
+	// Untranslated and uncoded errors keep their message
+	assert.Equal(t, ErrUsernameTaken.Error(), fus.Message(ErrUsernameTaken))
+	assert.Equal(t, "'name' required.", fus.Message(ErrInvalid("'name' required.")))
+	assert.Equal(t, ErrNotFound.Error(), fus.Message(ErrNotFound))
+
+	b, err := json.Marshal(ErrEmailTaken)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"code":"email_taken","messages":["That email is taken."]}`, string(b))
+}
+
 func TestUsers_Delete(t *testing.T) {
 	cp.Email = "delete@mail.com"
 	u, _, err := us.SignUp(cp)
@@ -158,6 +307,225 @@ func TestUsers_Delete(t *testing.T) {
 	assert.Equal(t, u.Email, cp.Email)
 }
 
+func TestUsers_UnDelete(t *testing.T) {
+	f := false
+	ius := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	u, _, err := ius.SignUp(SignUpParams{Email: "undelete@mail.com", Username: "undelete"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrNotFound, ius.UnDelete(u.Id))
+	assert.Nil(t, ius.Delete(u.Id))
+	_, err = ius.Get(u.Id)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Email taken while deleted
+	taken, _, err := ius.SignUp(SignUpParams{Email: "undelete@mail.com", Username: "undelete-other"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrEmailTaken, ius.UnDelete(u.Id))
+	assert.Nil(t, ius.Delete(taken.Id))
+
+	// Username taken while deleted
+	taken, _, err = ius.SignUp(SignUpParams{Email: "undelete-other@mail.com", Username: "undelete"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrUsernameTaken, ius.UnDelete(u.Id))
+	assert.Nil(t, ius.Delete(taken.Id))
+
+	// Happy path
+	assert.Nil(t, ius.UnDelete(u.Id))
+	restored, err := ius.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Email, restored.Email)
+	assert.True(t, restored.Updated >= u.Updated)
+}
+
+func TestUsers_Purge(t *testing.T) {
+	count := func(q string, args ...interface{}) int {
+		var n int
+		assert.Nil(t, testDb.QueryRow(q, args...).Scan(&n))
+		return n
+	}
+	password := "M0nk3yNutz5!"
+	for _, mode := range []PurgeMode{PurgeDelete, PurgeAnonymize} {
+		email := fmt.Sprintf("purge%d@mail.com", mode)
+		u, _, err := us.SignUp(SignUpParams{Email: email, Password: password, FirstName: "Purge", Phone: "0400000000"})
+		assert.Nil(t, err)
+		_, err = us.ResetPassword(ResetPasswordParams{Email: email})
+		assert.Nil(t, err)
+		_, err = us.SignIn(SignInParams{Email: email, Password: "wrong"})
+		assert.Equal(t, ErrNotAuth, err)
+		assert.Equal(t, 1, count("SELECT count(*) FROM password_resets WHERE email = ?", email))
+		assert.Equal(t, 1, count("SELECT count(*) FROM password_attempts WHERE username = ?", email))
+
+		assert.Nil(t, us.Purge(u.Id, mode))
+		_, err = us.Get(u.Id)
+		assert.Equal(t, ErrNotFound, err)
+		assert.Equal(t, 0, count("SELECT count(*) FROM users WHERE email = ? OR first_name = ? OR phone = ?",
+			email, "Purge", "0400000000"))
+		assert.Equal(t, 0, count("SELECT count(*) FROM password_resets WHERE user_id = ? OR email = ?", u.Id, email))
+		assert.Equal(t, 0, count("SELECT count(*) FROM password_attempts WHERE username = ?", email))
+		if mode == PurgeAnonymize {
+			assert.Equal(t, 1, count("SELECT count(*) FROM users WHERE id = ? AND deleted = ? AND password_hash = ''", u.Id, purged))
+		} else {
+			assert.Equal(t, 0, count("SELECT count(*) FROM users WHERE id = ?", u.Id))
+		}
+		assert.Equal(t, ErrNotFound, us.UnDelete(u.Id))
+	}
+	assert.Equal(t, ErrNotFound, us.Purge(33453453, PurgeDelete))
+}
+
+func TestUsers_SignUpAfterDelete(t *testing.T) {
+	p := SignUpParams{Email: "resignup@mail.com"}
+	u, _, err := us.SignUp(p)
+	assert.Nil(t, err)
+	assert.Nil(t, us.Delete(u.Id))
+
+	// A deleted user's email must not block a new sign up
+	u2, _, err := us.SignUp(p)
+	assert.Nil(t, err)
+	assert.NotEqual(t, u.Id, u2.Id)
+}
+
+func TestUsers_ByUid(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "uid@mail.com"})
+	assert.Nil(t, err)
+
+	// Get
+	byUid, err := us.GetByUid(u.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, byUid.Id)
+	_, err = us.GetByUid("no-such-uid")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Update
+	fname := "Uid"
+	err = us.UpdateByUid(u.Uid, UpdateUserParams{FirstName: &fname})
+	assert.Nil(t, err)
+	byUid, err = us.GetByUid(u.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, fname, byUid.FirstName)
+
+	// Assign role
+	role := Role(3)
+	err = us.AssignRoleByUid(u.Uid, AssignRoleParams{Role: &role})
+	assert.Nil(t, err)
+	byUid, err = us.GetByUid(u.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, role, byUid.Role)
+
+	// Delete
+	err = us.DeleteByUid(u.Uid)
+	assert.Nil(t, err)
+	_, err = us.GetByUid(u.Uid)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, us.DeleteByUid(u.Uid))
+}
+
+func TestUsers_GetByUid(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "getbyuid@mail.com", FirstName: "Get", LastName: "Uid", Phone: "0400000000"})
+	assert.Nil(t, err)
+	byId, err := us.Get(u.Id)
+	assert.Nil(t, err)
+	byUid, err := us.GetByUid(u.Uid)
+	assert.Nil(t, err)
+	assert.Equal(t, byId, byUid)
+
+	_, err = us.GetByUid("")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, us.Delete(u.Id))
+	_, err = us.GetByUid(u.Uid)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUsers_GetMany(t *testing.T) {
+	var ids []int64
+	for i := 0; i < 3; i++ {
+		u, _, err := us.SignUp(SignUpParams{Email: fmt.Sprintf("many%d@mail.com", i)})
+		assert.Nil(t, err)
+		ids = append(ids, u.Id)
+	}
+	assert.Nil(t, us.Delete(ids[1]))
+
+	users, err := us.GetMany([]int64{ids[2], 33453453, ids[0], ids[1], ids[2]})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(users))
+	assert.Equal(t, ids[2], users[0].Id)
+	assert.Equal(t, "many2@mail.com", users[0].Email)
+	assert.Equal(t, ids[0], users[1].Id)
+
+	users, err = us.GetMany(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []*User{}, users)
+	users, err = us.GetMany([]int64{33453453})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(users))
+}
+
+func TestUsers_GetByUsernameDeleted(t *testing.T) {
+	f := false
+	ius := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	u, _, err := ius.SignUp(SignUpParams{Email: "deleted-get@mail.com", Username: "deletedget"})
+	assert.Nil(t, err)
+	_, _, err = ius.GetByUsername(u.Email)
+	assert.Nil(t, err)
+	_, _, err = ius.GetByUsername(u.Username)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ius.Delete(u.Id))
+	_, _, err = ius.GetByUsername(u.Email)
+	assert.Equal(t, ErrNotFound, err)
+	_, _, err = ius.GetByUsername(u.Username)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUsers_ForbidEmailUsernameCollision(t *testing.T) {
+	f := false
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f, ForbidEmailUsernameCollision: true})
+	_, _, err := cus.SignUp(SignUpParams{Email: "collide-real@mail.com", Username: "collide-alias@mail.com"})
+	assert.Nil(t, err)
+
+	// Username equal to an existing email
+	_, _, err = cus.SignUp(SignUpParams{Email: "collide-other@mail.com", Username: "collide-real@mail.com"})
+	assert.Equal(t, ErrUsernameTaken, err)
+
+	// Email equal to an existing username
+	_, _, err = cus.SignUp(SignUpParams{Email: "collide-alias@mail.com", Username: "collide-other"})
+	assert.Equal(t, ErrEmailTaken, err)
+
+	// Email updated to an existing username
+	u, _, err := cus.SignUp(SignUpParams{Email: "collide-update@mail.com", Username: "collide-update"})
+	assert.Nil(t, err)
+	email := "collide-alias@mail.com"
+	err = cus.Update(UpdateUserParams{Id: &u.Id, Email: &email})
+	assert.Error(t, err)
+
+	// Promoted to a username equal to an existing email
+	guest, _, err := cus.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	_, _, err = cus.PromoteUser(guest.Id, SignUpParams{Email: "collide-promoted@mail.com", Username: "collide-real@mail.com"})
+	assert.Equal(t, ErrUsernameTaken, err)
+	_, _, err = cus.PromoteUser(guest.Id, SignUpParams{Email: "collide-alias@mail.com", Username: "collide-promoted"})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, _, err = cus.PromoteUser(guest.Id, SignUpParams{Email: "collide-promoted@mail.com", Username: "collide-promoted"})
+	assert.Nil(t, err)
+}
+
+func TestUsers_RotateUid(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "rotate-uid@mail.com"})
+	assert.Nil(t, err)
+	uid, err := us.RotateUid(u.Id)
+	assert.Nil(t, err)
+	assert.NotEqual(t, u.Uid, uid)
+
+	byUid, err := us.GetByUid(uid)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, byUid.Id)
+	_, err = us.GetByUid(u.Uid)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = us.RotateUid(33453453)
+	assert.Equal(t, ErrNotFound, err)
+}
+
 func TestUsers_AssignRole(t *testing.T) {
 	cp.Email = "assign@mail.com"
 	u, _, err := us.SignUp(cp)
@@ -175,10 +543,123 @@ func TestUsers_AssignRole(t *testing.T) {
 	assert.Equal(t, u.Role, Role(0))
 }
 
+func TestUsers_AdministrativeTimestamps(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "timestamps@mail.com"})
+	assert.Nil(t, err)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	updated := u.Updated
+	time.Sleep(time.Millisecond * 5)
+
+	role := Role(7)
+	assert.Nil(t, us.AssignRole(AssignRoleParams{Id: &u.Id, Role: &role}))
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, updated, u.Updated)
+	assert.True(t, u.RoleUpdated > updated)
+	assert.Equal(t, int64(0), u.StatusUpdated)
+
+	assert.Nil(t, us.Suspend(u.Id))
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, updated, u.Updated)
+	assert.True(t, u.StatusUpdated >= u.RoleUpdated)
+	assert.Nil(t, us.Restore(u.Id))
+
+	fname := "Profile"
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, FirstName: &fname}))
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.True(t, u.Updated > updated)
+}
+
+func TestUsers_DefaultRole(t *testing.T) {
+	dus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, DefaultRole: 1})
+	staff, err := orgsv.Create(CreateOrgParams{Name: "Staff", DefaultRole: 10})
+	assert.Nil(t, err)
+	guests, err := orgsv.Create(CreateOrgParams{Name: "Guests", DefaultRole: 2})
+	assert.Nil(t, err)
+	none, err := orgsv.Create(CreateOrgParams{Name: "No default"})
+	assert.Nil(t, err)
+
+	u, _, err := dus.SignUp(SignUpParams{Email: "default-staff@mail.com", OrgId: staff.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, Role(10), u.Role)
+	u, _, err = dus.SignUp(SignUpParams{Email: "default-guest@mail.com", OrgId: guests.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, Role(2), u.Role)
+	u, err = dus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, Role(2), u.Role)
+
+	// Explicit role and fallbacks
+	u, _, err = dus.SignUp(SignUpParams{Email: "default-explicit@mail.com", OrgId: staff.Id, Role: 5})
+	assert.Nil(t, err)
+	assert.Equal(t, Role(5), u.Role)
+	u, _, err = dus.SignUp(SignUpParams{Email: "default-none@mail.com", OrgId: none.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, Role(1), u.Role)
+
+	// SetOrg
+	err = dus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &staff.Id})
+	assert.Nil(t, err)
+	u, err = dus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, staff.Id, u.OrgId)
+	assert.Equal(t, Role(10), u.Role)
+	role := Role(3)
+	err = dus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &guests.Id, Role: &role})
+	assert.Nil(t, err)
+	u, err = dus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, guests.Id, u.OrgId)
+	assert.Equal(t, role, u.Role)
+}
+
+func TestUsers_NoOrgs(t *testing.T) {
+	_, err := testDb.Exec("CREATE DATABASE IF NOT EXISTS gus_test_noorgs")
+	assert.Nil(t, err)
+	db, err := GetDb(DbOpts{Seed: true, DriverName: "mysql", DataSourceName: testDsn("gus_test_noorgs"),
+		SeedSql: []string{"DROP TABLE orgs;"}})
+	assert.Nil(t, err)
+	defer db.Close()
+	f := false
+	nus := NewUsers(db, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UseOrgs: &f, DefaultRole: 2})
+
+	password := "M0nk3yNutz5!"
+	u, _, err := nus.SignUp(SignUpParams{Email: "noorgs@mail.com", Password: password, OrgId: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, Role(2), u.Role)
+	u, err = nus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), u.OrgId)
+
+	uc, err := nus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), uc.Claims.OrgId)
+	assert.False(t, uc.Claims.OrgSuspended)
+
+	users, err := nus.List(ListUsersParams{UserFilters: UserFilters{OrgId: 3, Query: "noorgs"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), users.Total)
+	assert.Equal(t, "", users.Items[0].OrgName)
+
+	org := int64(4)
+	assert.Nil(t, nus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &org}))
+	u, err = nus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, org, u.OrgId)
+	assert.Equal(t, Role(2), u.Role)
+
+	// The orgs table really is absent
+	_, err = NewUsers(db, UserOpts{AuthAttempts: 5, AuthLockDuration: 1}).List(ListUsersParams{})
+	assert.Error(t, err)
+}
+
 func TestUsers_SignIn(t *testing.T) {
 	// With a given password
 	cp.Email = "given-pword@mail.com"
-	cp.Password = "M0nk3yNutz5"
+	cp.Password = "M0nk3yNutz5!"
 	u, givenPassword, err := us.SignUp(cp)
 	assert.Nil(t, err)
 	assert.Equal(t, "", givenPassword)
@@ -232,22 +713,79 @@ func TestUsers_SignIn(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// failedSignIn is a failed sign in's attempt, it returns whether the sign in was locked.
+func failedSignIn(us *Users, ctx context.Context, username string, clientId string) bool {
+	_, locked := us.recordAttempt(ctx, username, clientId, "")
+	return locked
+}
+
 func TestUsers_Lock(t *testing.T) {
 	username := "lock@mail.com"
-	assert.False(t, us.isLocked(username))
-	assert.False(t, us.isLocked(username))
-	assert.False(t, us.isLocked(username))
-	assert.False(t, us.isLocked(username))
-	assert.False(t, us.isLocked(username))
-	assert.True(t, us.isLocked(username))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+	assert.True(t, failedSignIn(us, context.Background(), username, ""))
 	// TODO: check the logic as lock time varies slightly and makes test indeterminate
 	time.Sleep(time.Millisecond * time.Duration(2500))
-	assert.False(t, us.isLocked(username))
+	assert.False(t, failedSignIn(us, context.Background(), username, ""))
+}
+
+func TestUsers_ClientLock(t *testing.T) {
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 2, ClientAuthAttempts: 4, AuthLockDuration: 1})
+	ctx := context.Background()
+	attacker, other := "203.0.113.1", "203.0.113.2"
+
+	// Spraying usernames from one client locks the client, not the usernames
+	for i := 0; i < 4; i++ {
+		assert.False(t, failedSignIn(cus, ctx, fmt.Sprintf("spray%d@mail.com", i), attacker))
+	}
+	assert.True(t, failedSignIn(cus, ctx, "spray-new@mail.com", attacker))
+	assert.False(t, failedSignIn(cus, ctx, "spray0@mail.com", other))
+
+	// The username limit still applies whatever the client
+	assert.False(t, failedSignIn(cus, ctx, "client-lock@mail.com", other))
+	assert.False(t, failedSignIn(cus, ctx, "client-lock@mail.com", "203.0.113.3"))
+	assert.True(t, failedSignIn(cus, ctx, "client-lock@mail.com", "203.0.113.4"))
+
+	// Without ClientAuthAttempts clients aren't limited
+	for i := 0; i < 6; i++ {
+		assert.False(t, failedSignIn(us, ctx, fmt.Sprintf("unlimited%d@mail.com", i), attacker))
+	}
+
+	// Sign in is refused even with the right password
+	password := "M0nk3yNutz5!"
+	_, _, err := cus.SignUp(SignUpParams{Email: "client-victim@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = cus.SignIn(SignInParams{Email: "client-victim@mail.com", Password: password, ClientId: attacker})
+	assert.IsType(t, &RateLimitExceededError{}, err)
+	_, err = cus.SignIn(SignInParams{Email: "client-victim@mail.com", Password: password, ClientId: other})
+	assert.Nil(t, err)
+
+	time.Sleep(time.Millisecond * time.Duration(2500))
+	assert.False(t, failedSignIn(cus, ctx, "spray-new@mail.com", attacker))
+}
+
+func TestUsers_MaxStoredAttempts(t *testing.T) {
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 1, MaxStoredAttempts: 3})
+	username := "max-attempts@mail.com"
+	for i := 0; i < 10; i++ {
+		failedSignIn(cus, context.Background(), username, "")
+	}
+	var count int64
+	err := testDb.QueryRow("SELECT COUNT(username) FROM password_attempts WHERE username = ?", username).Scan(&count)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.True(t, failedSignIn(cus, context.Background(), username, ""))
+
+	// Cap is raised so the lock can still be reached
+	assert.Equal(t, int64(6), NewUsers(testDb, UserOpts{AuthAttempts: 5, MaxStoredAttempts: 2}).MaxStoredAttempts)
 }
 
 func TestUsers_PasswordReset(t *testing.T) {
 	email := "reset@mail.com"
-	password := "M0nk3yNutz5"
+	password := "M0nk3yNutz5!"
 	u, _, err := us.SignUp(SignUpParams{Email: email, Password: password})
 	assert.Nil(t, err)
 	newP := "newPassword1!"
@@ -263,10 +801,20 @@ func TestUsers_PasswordReset(t *testing.T) {
 	assert.Equal(t, email, uc.Email)
 
 
+	// SAME PASSWORD
+	err = us.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: newP, NewPassword: newP})
+	assert.Equal(t, ErrPasswordUnchanged, err)
+
 	// RESET TOKEN
 	token, err := us.ResetPassword(ResetPasswordParams{Email: email})
 	assert.Nil(t, err)
 	assert.NotEmpty(t, token)
+	var stored int64
+	err = testDb.QueryRow("SELECT COUNT(id) FROM password_resets WHERE reset_token = ?", token).Scan(&stored)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stored)
+	err = us.ChangePassword(ChangePasswordParams{Email: email, ResetToken: token, NewPassword: newP})
+	assert.Equal(t, ErrPasswordUnchanged, err)
 	newP2 := "sdf@348DFsdf"
 	err = us.ChangePassword(ChangePasswordParams{Email: email, ResetToken: token, NewPassword: newP2})
 	assert.Nil(t, err)
@@ -296,3 +844,3004 @@ func TestUsers_PasswordReset(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, email, uc.Email)
 }
+
+func TestUsers_BcryptCost(t *testing.T) {
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, BcryptCost: 5})
+	email := "cost@mail.com"
+	password := "M0nk3yNutz5!"
+	_, _, err := cus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	_, err = cus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	_, hash, err := cus.GetByUsername(email)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$2a$05$"))
+
+	// Out of range falls back to the default
+	assert.Equal(t, defaultBcryptCost, NewUsers(testDb, UserOpts{BcryptCost: bcrypt.MaxCost + 1}).BcryptCost)
+}
+
+func TestUserWithClaims_JSON(t *testing.T) {
+	full := UserWithClaims{
+		User:   &User{Id: 3, Email: "claims@mail.com", Role: 2, OrgId: 7},
+		Claims: &Claims{Role: 2, Roles: []Role{3, 4}, OrgId: 7, OrgSuspended: true, TokenVersion: 5},
+	}
+	b, err := json.Marshal(full)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"token_version":5`)
+	assert.Equal(t, 1, strings.Count(string(b), `"role"`))
+	assert.Equal(t, 1, strings.Count(string(b), `"org_id"`))
+	var uc UserWithClaims
+	assert.Nil(t, json.Unmarshal(b, &uc))
+	assert.Equal(t, *full.User, *uc.User)
+	assert.Equal(t, *full.Claims, *uc.Claims)
+
+	// Claims only
+	claimsOnly := UserWithClaims{Claims: &Claims{Role: 4, OrgId: 9}}
+	b, err = json.Marshal(claimsOnly)
+	assert.Nil(t, err)
+	uc = UserWithClaims{}
+	assert.Nil(t, json.Unmarshal(b, &uc))
+	assert.Nil(t, uc.User)
+	assert.Equal(t, *claimsOnly.Claims, *uc.Claims)
+}
+
+func TestAuthorize(t *testing.T) {
+	c := &Claims{OrgId: 1, Role: 5}
+	assert.Nil(t, Authorize(c, 1, 5))
+	assert.Nil(t, Authorize(c, 1, 3))
+
+	// Wrong org
+	assert.Equal(t, ErrNotAuth, Authorize(c, 2, 5))
+	// Insufficient role
+	assert.Equal(t, ErrNotAuth, Authorize(c, 1, 6))
+	// Org suspended
+	c.OrgSuspended = true
+	assert.Equal(t, ErrNotAuth, Authorize(c, 1, 5))
+	// No claims
+	assert.Equal(t, ErrNotAuth, Authorize(nil, 1, 0))
+}
+
+// plainHasher is a test only PasswordHasher which stores passwords with a '$plain$' prefix.
+type plainHasher struct{}
+
+func (plainHasher) Hash(password string) (string, error) {
+	return "$plain$" + password, nil
+}
+
+func (plainHasher) Compare(hash, password string) error {
+	if subtle.ConstantTimeCompare([]byte(hash), []byte("$plain$"+password)) != 1 {
+		return errors.New("mismatched hash and password")
+	}
+	return nil
+}
+
+func TestUsers_PasswordHasher(t *testing.T) {
+	password := "M0nk3yNutz5!"
+	legacy := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, BcryptCost: bcrypt.MinCost})
+	migrating := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1,
+		Hasher: MigrationHasher{Prefix: "$plain$", Hasher: plainHasher{}, Legacy: legacy.Hasher}})
+
+	// Legacy bcrypt user can still sign in after migrating
+	_, _, err := legacy.SignUp(SignUpParams{Email: "legacy-hash@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = migrating.SignIn(SignInParams{Email: "legacy-hash@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	// New users are hashed with the new hasher
+	_, _, err = migrating.SignUp(SignUpParams{Email: "new-hash@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, hash, err := migrating.GetByUsername("new-hash@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "$plain$"+password, hash)
+	_, err = migrating.SignIn(SignInParams{Email: "new-hash@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = migrating.SignIn(SignInParams{Email: "new-hash@mail.com", Password: "wrong"})
+	assert.Equal(t, ErrNotAuth, err)
+
+	// Changing the password of a legacy user re-hashes with the new hasher
+	newP := "newPassword1!"
+	err = migrating.ChangePassword(ChangePasswordParams{Email: "legacy-hash@mail.com", ExistingPassword: password, NewPassword: newP})
+	assert.Nil(t, err)
+	_, hash, err = migrating.GetByUsername("legacy-hash@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "$plain$"+newP, hash)
+}
+
+func TestUsers_Context(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "context@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = us.GetContext(ctx, u.Id)
+	assert.Equal(t, context.Canceled, err)
+	_, err = us.SignInContext(ctx, SignInParams{Email: u.Email, Password: "M0nk3yNutz5!"})
+	assert.Equal(t, context.Canceled, err)
+	_, err = us.ListContext(ctx, ListUsersParams{})
+	assert.Equal(t, context.Canceled, err)
+	_, _, err = us.SignUpContext(ctx, SignUpParams{Email: "context2@mail.com"})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, us.SuspendContext(ctx, u.Id))
+}
+
+func TestUsers_SignInWithToken(t *testing.T) {
+	issuer := HMACIssuer{Key: []byte("01234567890123456789012345678901"), Expiry: time.Minute}
+	tus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, TokenIssuer: issuer})
+	password := "M0nk3yNutz5!"
+	org, err := orgsv.Create(CreateOrgParams{Name: "Token claims org"})
+	assert.Nil(t, err)
+	_, _, err = tus.SignUp(SignUpParams{Email: "token@mail.com", Password: password, OrgId: org.Id, Role: 7})
+	assert.Nil(t, err)
+
+	ut, err := tus.SignInWithToken(SignInParams{Email: "token@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, ut.Token)
+	tc, err := issuer.Parse(ut.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, ut.Uid, tc.Subject)
+	assert.Equal(t, Claims{Role: 7, OrgId: org.Id, OrgSuspended: false}, tc.Claims)
+
+	// Tampered or wrongly signed tokens are rejected
+	_, err = HMACIssuer{Key: []byte("another key")}.Parse(ut.Token)
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = issuer.Parse(ut.Token + "x")
+	assert.Equal(t, ErrNotAuth, err)
+
+	// Expired
+	expired, err := HMACIssuer{Key: issuer.Key, Expiry: -time.Minute}.Issue(&UserWithClaims{User: &ut.User, Claims: &tc.Claims})
+	assert.Nil(t, err)
+	_, err = issuer.Parse(expired)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	// Issued and expired by the issuer's clock
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	clocked := HMACIssuer{Key: issuer.Key, Expiry: time.Minute, Clock: clock}
+	token, err := clocked.Issue(&UserWithClaims{User: &ut.User, Claims: &tc.Claims})
+	assert.Nil(t, err)
+	ctc, err := clocked.Parse(token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500000000), ctc.IssuedAt)
+	assert.Equal(t, int64(1500000060), ctc.Expires)
+	clock.advance(time.Minute)
+	_, err = clocked.Parse(token)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	// No issuer configured
+	_, err = us.SignInWithToken(SignInParams{Email: "token@mail.com", Password: password})
+	assert.Equal(t, ErrNoTokenIssuer, err)
+}
+
+func TestUsers_VerifyEmail(t *testing.T) {
+	vus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 1, RequireVerifiedEmail: true})
+	email := "verify@mail.com"
+	password := "M0nk3yNutz5!"
+	u, token, err := vus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+
+	// Unverified can't sign in
+	_, err = vus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Equal(t, ErrEmailNotVerified, err)
+
+	// Wrong token
+	err = vus.VerifyEmail(email, token+"ADSF")
+	assert.Equal(t, ErrInvalidResetToken, err)
+
+	// Expired token
+	time.Sleep(time.Millisecond * time.Duration(2000))
+	err = vus.VerifyEmail(email, token)
+	assert.Equal(t, ErrTokenExpired, err)
+
+	token, err = vus.ResetPassword(ResetPasswordParams{Email: email})
+	assert.Nil(t, err)
+	err = vus.VerifyEmail(email, token)
+	assert.Nil(t, err)
+	u, err = vus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.True(t, u.Verified)
+	_, err = vus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+
+	// Already verified
+	token, err = vus.ResetPassword(ResetPasswordParams{Email: email})
+	assert.Nil(t, err)
+	err = vus.VerifyEmail(email, token)
+	assert.Equal(t, ErrAlreadyVerified, err)
+}
+
+func TestUsers_EmailChange(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "change-from@mail.com"})
+	assert.Nil(t, err)
+	other, _, err := us.SignUp(SignUpParams{Email: "change-taken@mail.com"})
+	assert.Nil(t, err)
+
+	_, err = us.RequestEmailChange(u.Id, "not-an-email")
+	assert.Equal(t, ErrEmailInvalid, err)
+	_, err = us.RequestEmailChange(u.Id, other.Email)
+	assert.Equal(t, ErrEmailTaken, err)
+
+	token, err := us.RequestEmailChange(u.Id, "change-to@mail.com")
+	assert.Nil(t, err)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "change-from@mail.com", u.Email)
+
+	// Wrong token
+	assert.Equal(t, ErrInvalidResetToken, us.ConfirmEmailChange(u.Id, token+"ADSF"))
+	assert.Equal(t, ErrNotFound, us.ConfirmEmailChange(other.Id, token))
+
+	// Expired token
+	time.Sleep(time.Millisecond * time.Duration(2000))
+	assert.Equal(t, ErrTokenExpired, us.ConfirmEmailChange(u.Id, token))
+
+	// Taken between request and confirm
+	token, err = us.RequestEmailChange(u.Id, "change-to@mail.com")
+	assert.Nil(t, err)
+	_, _, err = us.SignUp(SignUpParams{Email: "change-to@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrEmailTaken, us.ConfirmEmailChange(u.Id, token))
+
+	token, err = us.RequestEmailChange(u.Id, "change-final@mail.com")
+	assert.Nil(t, err)
+	assert.Nil(t, us.ConfirmEmailChange(u.Id, token))
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "change-final@mail.com", u.Email)
+	assert.Equal(t, "change-final@mail.com", u.Username)
+	assert.True(t, u.Verified)
+
+	// Consumed
+	assert.Equal(t, ErrNotFound, us.ConfirmEmailChange(u.Id, token))
+}
+
+func TestUsers_ConfirmEmailStateless(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 60, StatelessTokenKey: key})
+	u, _, err := sus.SignUp(SignUpParams{Email: "stateless@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+
+	_, err = us.IssueStatelessActivationToken(u.Id)
+	assert.Equal(t, ErrNoStatelessTokenKey, err)
+
+	token, err := sus.IssueStatelessActivationToken(u.Id)
+	assert.Nil(t, err)
+
+	// Tampered
+	other, _, err := sus.SignUp(SignUpParams{Email: "stateless-other@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+	parts := strings.SplitN(token, ".", 2)
+	assert.Equal(t, ErrInvalidResetToken, sus.ConfirmEmailStateless(fmt.Sprint(other.Id)+"."+parts[1]))
+	assert.Equal(t, ErrInvalidResetToken, sus.ConfirmEmailStateless(token+"A"))
+	assert.Equal(t, ErrInvalidResetToken, sus.ConfirmEmailStateless("garbage"))
+	wrongKey := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 60, StatelessTokenKey: []byte("wrong")})
+	assert.Equal(t, ErrInvalidResetToken, wrongKey.ConfirmEmailStateless(token))
+
+	// Expired
+	eus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 1, StatelessTokenKey: key})
+	expired, err := eus.IssueStatelessActivationToken(u.Id)
+	assert.Nil(t, err)
+	time.Sleep(time.Millisecond * time.Duration(1100))
+	assert.Equal(t, ErrTokenExpired, eus.ConfirmEmailStateless(expired))
+
+	// Valid
+	assert.Nil(t, sus.ConfirmEmailStateless(token))
+	u, err = sus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.True(t, u.Verified)
+	assert.Equal(t, ErrAlreadyVerified, sus.ConfirmEmailStateless(token))
+	other, err = sus.Get(other.Id)
+	assert.Nil(t, err)
+	assert.False(t, other.Verified)
+}
+
+// stubBreachChecker reports the passwords in breached, or err if set.
+type stubBreachChecker struct {
+	breached map[string]bool
+	err      error
+}
+
+func (s stubBreachChecker) IsBreached(password string) (bool, error) {
+	return s.breached[password], s.err
+}
+
+func TestUsers_BreachChecker(t *testing.T) {
+	checker := stubBreachChecker{breached: map[string]bool{"Password1!": true}}
+	bus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, BreachChecker: checker})
+	_, _, err := bus.SignUp(SignUpParams{Email: "breached@mail.com", Password: "Password1!"})
+	assert.Equal(t, ErrPasswordBreached, err)
+
+	// Generated passwords aren't checked
+	_, _, err = bus.SignUp(SignUpParams{Email: "breached@mail.com"})
+	assert.Nil(t, err)
+	token, err := bus.ResetPassword(ResetPasswordParams{Email: "breached@mail.com"})
+	assert.Nil(t, err)
+	err = bus.ChangePassword(ChangePasswordParams{Email: "breached@mail.com", ResetToken: token, NewPassword: "Password1!"})
+	assert.Equal(t, ErrPasswordBreached, err)
+	err = bus.ChangePassword(ChangePasswordParams{Email: "breached@mail.com", ResetToken: token, NewPassword: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+
+	// Checker failures
+	down := stubBreachChecker{err: errors.New("network down")}
+	open := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, BreachChecker: down})
+	_, _, err = open.SignUp(SignUpParams{Email: "breach-open@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+	closed := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, BreachChecker: down, BreachCheckFailClosed: true})
+	_, _, err = closed.SignUp(SignUpParams{Email: "breach-closed@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Equal(t, down.err, err)
+}
+
+// recordingSink records the events it receives as strings.
+type recordingSink struct {
+	NopEventSink
+	events []string
+}
+
+func (r *recordingSink) OnSignUp(u *User) {
+	r.events = append(r.events, "signup:"+u.Email)
+}
+
+func (r *recordingSink) OnSignIn(u *UserWithClaims) {
+	r.events = append(r.events, "signin:"+u.Email)
+}
+
+func (r *recordingSink) OnPasswordChanged(userId int64) {
+	r.events = append(r.events, fmt.Sprint("password:", userId))
+}
+
+func (r *recordingSink) OnSuspended(userId int64) {
+	r.events = append(r.events, fmt.Sprint("suspended:", userId))
+}
+
+func (r *recordingSink) OnDeleted(userId int64) {
+	r.events = append(r.events, fmt.Sprint("deleted:", userId))
+}
+
+func (r *recordingSink) OnLockout(username string, attempts int64) {
+	r.events = append(r.events, fmt.Sprint("lockout:", username, ":", attempts))
+}
+
+func TestUsers_EventSink(t *testing.T) {
+	sink := &recordingSink{}
+	eus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, EventSink: sink})
+	email := "events@mail.com"
+	password := "M0nk3yNutz5!"
+	newPassword := "M0nk3yNutz6!"
+
+	u, _, err := eus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"signup:" + email}, sink.events)
+
+	// Failures don't fire
+	_, _, err = eus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, err = eus.SignIn(SignInParams{Email: email, Password: "wrong"})
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Equal(t, 1, len(sink.events))
+
+	_, err = eus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	// Checking the existing password isn't a sign in
+	err = eus.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: password, NewPassword: newPassword})
+	assert.Nil(t, err)
+	assert.Nil(t, eus.Suspend(u.Id))
+	assert.Nil(t, eus.Restore(u.Id))
+	assert.Nil(t, eus.Delete(u.Id))
+	assert.Equal(t, ErrNotFound, eus.Delete(u.Id))
+	assert.Equal(t, []string{"signup:" + email, "signin:" + email, fmt.Sprint("password:", u.Id),
+		fmt.Sprint("suspended:", u.Id), fmt.Sprint("deleted:", u.Id)}, sink.events)
+
+	// No sink
+	_, _, err = us.SignUp(SignUpParams{Email: "no-events@mail.com"})
+	assert.Nil(t, err)
+}
+
+func TestUsers_OnLockout(t *testing.T) {
+	sink := &recordingSink{}
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 1, EventSink: sink})
+	ctx := context.Background()
+	username := "lockout@mail.com"
+	for i := 0; i < 10; i++ {
+		failedSignIn(lus, ctx, username, "")
+	}
+	failedSignIn(lus, ctx, "lockout-other@mail.com", "")
+	assert.Equal(t, []string{"lockout:lockout@mail.com:3"}, sink.events)
+
+	// A new lockout window
+	time.Sleep(time.Millisecond * time.Duration(2500))
+	for i := 0; i < 10; i++ {
+		failedSignIn(lus, ctx, username, "")
+	}
+	assert.Equal(t, []string{"lockout:lockout@mail.com:3", "lockout:lockout@mail.com:3"}, sink.events)
+}
+
+// longHasher produces hashes too long for the password_hash column so storing them fails.
+type longHasher struct {
+	BcryptHasher
+}
+
+func (longHasher) Hash(password string) (string, error) {
+	return strings.Repeat("x", 300), nil
+}
+
+func TestUsers_ChangePasswordUpdateFails(t *testing.T) {
+	email := "update-fails@mail.com"
+	password := "M0nk3yNutz5!"
+	_, _, err := us.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Hasher: longHasher{BcryptHasher{Cost: defaultBcryptCost}}})
+	err = lus.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: password, NewPassword: "newPassword1!"})
+	assert.Error(t, err)
+
+	// Password is unchanged
+	_, err = us.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+}
+
+func TestUsers_ListQuery(t *testing.T) {
+	f := false
+	qus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	_, _, err := qus.SignUp(SignUpParams{Email: "zebra-email@mail.com", Username: "q1"})
+	assert.Nil(t, err)
+	_, _, err = qus.SignUp(SignUpParams{Email: "q2@mail.com", Username: "zebra-username"})
+	assert.Nil(t, err)
+	_, _, err = qus.SignUp(SignUpParams{Email: "q3@mail.com", Username: "q3", FirstName: "zebra-first"})
+	assert.Nil(t, err)
+	_, _, err = qus.SignUp(SignUpParams{Email: "q4@mail.com", Username: "q4", LastName: "zebra-last"})
+	assert.Nil(t, err)
+	_, _, err = qus.SignUp(SignUpParams{Email: "q5@mail.com", Username: "q5", Phone: "0zebra"})
+	assert.Nil(t, err)
+
+	users, err := qus.List(ListUsersParams{UserFilters: UserFilters{Query: "zebra"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(users.Items))
+	assert.Equal(t, int64(5), users.Total)
+
+	// Combined with other filters
+	users, err = qus.List(ListUsersParams{UserFilters: UserFilters{Query: "zebra", Email: "q2@"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(users.Items))
+	assert.Equal(t, int64(1), users.Total)
+
+	// Wildcards are matched literally
+	users, err = qus.List(ListUsersParams{UserFilters: UserFilters{Query: "%"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(users.Items))
+	assert.Equal(t, int64(0), users.Total)
+	for _, q := range []string{"zebr_", "!", "!%"} {
+		n, err := qus.Count(UserFilters{Query: q})
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), n, q)
+	}
+	_, _, err = qus.SignUp(SignUpParams{Email: "q6@mail.com", Username: "q6", FirstName: "zebr_100%!"})
+	assert.Nil(t, err)
+	for _, q := range []string{"zebr_", "_100%", "%!"} {
+		users, err = qus.List(ListUsersParams{UserFilters: UserFilters{Query: q}})
+		assert.Nil(t, err)
+		if assert.Equal(t, 1, len(users.Items), q) {
+			assert.Equal(t, "q6@mail.com", users.Items[0].Email)
+		}
+	}
+}
+
+func TestUsers_StatementCache(t *testing.T) {
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1})
+	u, _, err := cus.SignUp(SignUpParams{Email: "stmt-cache@mail.com"})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := cus.Get(u.Id)
+			if err == nil && got.Email != u.Email {
+				err = fmt.Errorf("got %s", got.Email)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, cus.Close())
+	assert.Equal(t, 0, len(cus.stmts))
+	// Statements are prepared again after Close
+	_, err = cus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, cus.Close())
+}
+
+func BenchmarkUsers_SignIn(b *testing.B) {
+	bus := NewUsers(testDb, UserOpts{AuthAttempts: 1 << 30, BcryptCost: bcrypt.MinCost})
+	defer bus.Close()
+	password := "M0nk3yNutz5!"
+	_, _, err := bus.SignUp(SignUpParams{Email: "bench@mail.com", Password: password})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := bus.SignIn(SignInParams{Email: "bench@mail.com", Password: password}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// recordingLogger records the lines it receives as "level msg key=value ...".
+type recordingLogger struct {
+	lines []string
+}
+
+func (r *recordingLogger) record(level string, msg string, keyvals []interface{}) {
+	line := level + " " + msg
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+	}
+	r.lines = append(r.lines, line)
+}
+
+func (r *recordingLogger) Debug(msg string, keyvals ...interface{}) {
+	r.record("debug", msg, keyvals)
+}
+
+func (r *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	r.record("info", msg, keyvals)
+}
+
+func (r *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	r.record("error", msg, keyvals)
+}
+
+func TestUsers_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Logger: logger})
+	email := "logged@mail.com"
+	password := "M0nk3yNutz5!"
+	u, _, err := lus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	assert.Nil(t, lus.Suspend(u.Id))
+
+	_, err = lus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Equal(t, []string{"debug sign in failed username=" + email}, logger.lines)
+
+	// recordAttempt fails closed and logs the username
+	closed, err := sql.Open("mysql", testDsn("gus_test"))
+	assert.Nil(t, err)
+	closed.Close()
+	logger.lines = nil
+	cus := NewUsers(closed, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Logger: logger})
+	_, err = cus.SignIn(SignInParams{Email: email, Password: password})
+	assert.IsType(t, &RateLimitExceededError{}, err)
+	if assert.Equal(t, 2, len(logger.lines)) {
+		assert.Contains(t, logger.lines[0], "error recording sign in attempt error=")
+		assert.Contains(t, logger.lines[1], "error finding sign in retry time error=")
+		for _, line := range logger.lines {
+			assert.Contains(t, line, "username="+email)
+		}
+	}
+
+	// No logger
+	nus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1})
+	assert.NotPanics(t, func() { nus.SignIn(SignInParams{Email: email, Password: password}) })
+}
+
+// countingMetrics counts the calls it receives.
+type countingMetrics struct {
+	signUps, signIns, failedSignIns, lockouts, resets int
+}
+
+func (c *countingMetrics) IncSignUp() {
+	c.signUps++
+}
+
+func (c *countingMetrics) IncSignIn(success bool) {
+	if success {
+		c.signIns++
+	} else {
+		c.failedSignIns++
+	}
+}
+
+func (c *countingMetrics) IncLockout() {
+	c.lockouts++
+}
+
+func (c *countingMetrics) IncPasswordReset() {
+	c.resets++
+}
+
+func TestUsers_Metrics(t *testing.T) {
+	m := &countingMetrics{}
+	mus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 60, Metrics: m})
+	email := "metrics@mail.com"
+	password := "M0nk3yNutz5!"
+
+	_, _, err := mus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	_, _, err = mus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Equal(t, ErrEmailTaken, err)
+	// The activation token of a sign up without a password isn't a reset
+	_, _, err = mus.SignUp(SignUpParams{Email: "metrics2@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, countingMetrics{signUps: 2}, *m)
+
+	_, err = mus.ResetPassword(ResetPasswordParams{Email: email})
+	assert.Nil(t, err)
+	_, err = mus.ResetPassword(ResetPasswordParams{Email: "nobody@mail.com"})
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 1, m.resets)
+
+	_, err = mus.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = mus.SignIn(SignInParams{Email: email, Password: "wrong"})
+		assert.Equal(t, ErrNotAuth, err)
+	}
+	// The third attempt locks, later ones are still failures but not new lockouts
+	for i := 0; i < 2; i++ {
+		_, err = mus.SignIn(SignInParams{Email: email, Password: password})
+		assert.IsType(t, &RateLimitExceededError{}, err)
+	}
+	assert.Equal(t, countingMetrics{signUps: 2, signIns: 1, failedSignIns: 4, lockouts: 1, resets: 1}, *m)
+
+	// No metrics
+	nus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1})
+	assert.NotPanics(t, func() { nus.ResetPassword(ResetPasswordParams{Email: email}) })
+}
+
+func TestUsers_Roles(t *testing.T) {
+	email := "roles@mail.com"
+	password := "M0nk3yNutz5!"
+	u, _, err := us.SignUp(SignUpParams{Email: email, Password: password, Role: 1})
+	assert.Nil(t, err)
+
+	roles, err := us.GetRoles(u.Id)
+	assert.Nil(t, err)
+	assert.Empty(t, roles)
+
+	assert.Nil(t, us.AddRole(u.Id, 5))
+	assert.Nil(t, us.AddRole(u.Id, 3))
+	// Adding a role twice does nothing
+	assert.Nil(t, us.AddRole(u.Id, 5))
+	roles, err = us.GetRoles(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, []Role{3, 5}, roles)
+	assert.Equal(t, ErrNotFound, us.AddRole(999999, 5))
+
+	uc, _, err := us.GetByUsername(email)
+	assert.Nil(t, err)
+	assert.Equal(t, Role(1), uc.Claims.Role)
+	assert.Equal(t, []Role{3, 5}, uc.Claims.Roles)
+
+	// The primary role is independent of the additional roles
+	role := Role(2)
+	assert.Nil(t, us.AssignRole(AssignRoleParams{Id: &u.Id, Role: &role}))
+	uc, _, err = us.GetByUsername(email)
+	assert.Nil(t, err)
+	assert.Equal(t, Role(2), uc.Claims.Role)
+	assert.Equal(t, []Role{3, 5}, uc.Claims.Roles)
+
+	assert.Nil(t, us.RemoveRole(u.Id, 5))
+	assert.Equal(t, ErrNotFound, us.RemoveRole(u.Id, 5))
+	roles, err = us.GetRoles(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, []Role{3}, roles)
+
+	// Passive users can't be given roles
+	p, _, err := us.SignUp(SignUpParams{Email: "passive-roles@mail.com", Passive: true})
+	assert.Nil(t, err)
+	assert.Error(t, us.AddRole(p.Id, 5))
+
+	// Signed in claims carry the roles
+	uc, err = us.SignIn(SignInParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, []Role{3}, uc.Claims.Roles)
+	b, err := json.Marshal(uc)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"roles":[3]`)
+
+	assert.Nil(t, us.Purge(u.Id, PurgeDelete))
+	roles, err = us.GetRoles(u.Id)
+	assert.Nil(t, err)
+	assert.Empty(t, roles)
+}
+
+func TestUsers_LastLogin(t *testing.T) {
+	email := "lastlogin@mail.com"
+	password := "M0nk3yNutz5!"
+	u, _, err := us.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), u.LastLogin)
+
+	_, err = us.SignIn(SignInParams{Email: email, Password: password, IP: "203.0.113.7"})
+	assert.Nil(t, err)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	first := u.LastLogin
+	assert.True(t, first > 0)
+	assert.Equal(t, "203.0.113.7", u.LastLoginIP)
+
+	// Failed sign ins aren't recorded
+	time.Sleep(5 * time.Millisecond)
+	_, err = us.SignIn(SignInParams{Email: email, Password: "wrong", IP: "198.51.100.1"})
+	assert.Equal(t, ErrNotAuth, err)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, first, u.LastLogin)
+	assert.Equal(t, "203.0.113.7", u.LastLoginIP)
+
+	_, err = us.SignIn(SignInParams{Email: email, Password: password, IP: "2001:db8::1"})
+	assert.Nil(t, err)
+	users, err := us.List(ListUsersParams{UserFilters: UserFilters{Email: email}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(users.Items))
+	assert.True(t, users.Items[0].LastLogin > first)
+	assert.Equal(t, "2001:db8::1", users.Items[0].LastLoginIP)
+}
+
+func TestUsers_InactiveSince(t *testing.T) {
+	ids := map[string]int64{}
+	for _, name := range []string{"never", "nulled", "old", "boundary", "recent"} {
+		u, _, err := us.SignUp(SignUpParams{Email: name + "@inactive.com"})
+		assert.Nil(t, err)
+		ids[name] = u.Id
+	}
+	threshold := int64(1000000)
+	for name, lastLogin := range map[string]interface{}{"nulled": nil, "old": threshold - 1, "boundary": threshold,
+		"recent": threshold + 1} {
+		_, err := testDb.Exec("UPDATE users SET last_login = ? WHERE id = ?", lastLogin, ids[name])
+		assert.Nil(t, err)
+	}
+
+	f := UserFilters{Email: "@inactive.com", InactiveSince: threshold}
+	users, err := us.List(ListUsersParams{ListArgs: ListArgs{OrderBy: "id", Direction: DirectionAsc}, UserFilters: f})
+	assert.Nil(t, err)
+	got := []int64{}
+	for _, u := range users.Items {
+		got = append(got, u.Id)
+	}
+	assert.Equal(t, []int64{ids["never"], ids["nulled"], ids["old"]}, got)
+	n, err := us.Count(f)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// Zero doesn't filter
+	n, err = us.Count(UserFilters{Email: "@inactive.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), n)
+}
+
+func TestUsers_NormalizeEmail(t *testing.T) {
+	assert.Equal(t, "a@b.com", NormalizeEmail("  A@B.com\n"))
+	// Provider aliases are distinct addresses
+	assert.Equal(t, "first.last+tag@gmail.com", NormalizeEmail("First.Last+tag@gmail.com"))
+
+	password := "M0nk3yNutz5!"
+	u, _, err := us.SignUp(SignUpParams{Email: " A@B.com ", Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, "a@b.com", u.Email)
+	assert.Equal(t, "a@b.com", u.Username)
+
+	_, _, err = us.SignUp(SignUpParams{Email: "a@b.com", Password: password})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, _, err = us.SignUp(SignUpParams{Email: "A@B.COM", Password: password})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, err = us.Exists(ExistsParams{Email: "A@b.Com"})
+	assert.Equal(t, ErrEmailTaken, err)
+
+	_, err = us.SignIn(SignInParams{Email: "A@B.com", Password: password})
+	assert.Nil(t, err)
+	token, err := us.ResetPassword(ResetPasswordParams{Email: "A@B.com"})
+	assert.Nil(t, err)
+	assert.Nil(t, us.ChangePassword(ChangePasswordParams{Email: "A@b.com", ResetToken: token, NewPassword: "M0nk3yNutz6!"}))
+
+	email := "C@D.com"
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, Email: &email}))
+	assert.Equal(t, "C@D.com", email)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "c@d.com", u.Email)
+	o, _, err := us.SignUp(SignUpParams{Email: "other@d.com", Password: password})
+	assert.Nil(t, err)
+	email = "c@D.COM"
+	assert.Equal(t, ErrEmailTaken, us.Update(UpdateUserParams{Id: &o.Id, Email: &email}))
+}
+
+// fakeClock is a Clock which only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestUsers_LockWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 60, Clock: clock})
+	ctx := context.Background()
+	username := "lockwindow@mail.com"
+
+	assert.False(t, failedSignIn(cus, ctx, username, ""))
+	clock.advance(10 * time.Second)
+	assert.False(t, failedSignIn(cus, ctx, username, ""))
+	clock.advance(10 * time.Second)
+	assert.True(t, failedSignIn(cus, ctx, username, ""))
+
+	// Only the first attempt has aged out, the locked attempt at 20s and this one are still within the window
+	clock.advance(45 * time.Second)
+	assert.True(t, failedSignIn(cus, ctx, username, ""))
+
+	// The attempts at 0s, 10s and 20s have aged out leaving the ones at 65s and now
+	clock.advance(20 * time.Second)
+	assert.False(t, failedSignIn(cus, ctx, username, ""))
+}
+
+func TestUsers_SuccessfulSignInsNotLocked(t *testing.T) {
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 3, AuthLockDuration: 60})
+	email := "successlock@mail.com"
+	password := "M0nk3yNutz5!"
+	_, _, err := lus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = lus.SignIn(SignInParams{Email: email, Password: password})
+		assert.Nil(t, err)
+	}
+	var n int
+	assert.Nil(t, testDb.QueryRow("SELECT count(*) FROM password_attempts WHERE username = ?", email).Scan(&n))
+	assert.Equal(t, 0, n)
+
+	for i := 0; i < 3; i++ {
+		_, err = lus.SignIn(SignInParams{Email: email, Password: "wrong"})
+		assert.Equal(t, ErrNotAuth, err)
+	}
+	_, err = lus.SignIn(SignInParams{Email: email, Password: password})
+	assert.IsType(t, &RateLimitExceededError{}, err)
+}
+
+func TestUsers_ClockTokenExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 60, Clock: clock,
+		StatelessTokenKey: []byte("01234567890123456789012345678901")})
+	u, _, err := cus.SignUp(SignUpParams{Email: "clock@mail.com"})
+	assert.Nil(t, err)
+	created := clock.now
+
+	token, err := cus.IssueStatelessActivationToken(u.Id)
+	assert.Nil(t, err)
+	clock.advance(61 * time.Second)
+	assert.Equal(t, ErrTokenExpired, cus.ConfirmEmailStateless(token))
+	clock.advance(-2 * time.Second)
+	assert.Nil(t, cus.ConfirmEmailStateless(token))
+
+	reset, err := cus.ResetPassword(ResetPasswordParams{Email: "clock@mail.com"})
+	assert.Nil(t, err)
+	clock.advance(61 * time.Second)
+	err = cus.ChangePassword(ChangePasswordParams{Email: "clock@mail.com", ResetToken: reset, NewPassword: "M0nk3yNutz5!"})
+	assert.Equal(t, ErrTokenExpired, err)
+
+	u, err = cus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, Milliseconds(created), u.Created)
+}
+
+func TestUsers_Invites(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	ius := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, RequireInvite: true, Clock: clock})
+
+	_, _, err := ius.SignUp(SignUpParams{Email: "noinvite@mail.com"})
+	assert.Equal(t, ErrInviteRequired, err)
+	_, _, err = ius.SignUp(SignUpParams{Email: "badinvite@mail.com", InviteCode: "nope"})
+	assert.Equal(t, ErrInviteInvalid, err)
+
+	// Bound to an org and role, which must exist
+	_, err = ius.CreateInvite(CreateInviteParams{OrgId: 999999, Role: 6})
+	assert.Equal(t, ErrUnknownOrg, err)
+	org, err := orgsv.Create(CreateOrgParams{Name: "Invites"})
+	assert.Nil(t, err)
+	invite, err := ius.CreateInvite(CreateInviteParams{OrgId: org.Id, Role: 6, MaxUses: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, inviteCodeLength, len(invite.Code))
+	u, _, err := ius.SignUp(SignUpParams{Email: "invited1@mail.com", InviteCode: invite.Code, Role: 9})
+	assert.Nil(t, err)
+	assert.Equal(t, org.Id, u.OrgId)
+	assert.Equal(t, Role(6), u.Role)
+
+	// A failed sign up doesn't use the invite
+	_, _, err = ius.SignUp(SignUpParams{Email: "invited1@mail.com", InviteCode: invite.Code})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, _, err = ius.SignUp(SignUpParams{Email: "invited2@mail.com", InviteCode: invite.Code})
+	assert.Nil(t, err)
+
+	// Exhausted
+	_, _, err = ius.SignUp(SignUpParams{Email: "invited3@mail.com", InviteCode: invite.Code})
+	assert.Equal(t, ErrInviteExhausted, err)
+
+	// Expired
+	expiring, err := ius.CreateInvite(CreateInviteParams{Code: "expiring", Expires: Milliseconds(clock.Now().Add(time.Hour))})
+	assert.Nil(t, err)
+	_, err = ius.CreateInvite(CreateInviteParams{Code: "expiring"})
+	assert.Equal(t, ErrInviteCodeTaken, err)
+	_, _, err = ius.SignUp(SignUpParams{Email: "expiring1@mail.com", InviteCode: expiring.Code})
+	assert.Nil(t, err)
+	clock.advance(time.Hour)
+	_, _, err = ius.SignUp(SignUpParams{Email: "expiring2@mail.com", InviteCode: expiring.Code})
+	assert.Equal(t, ErrInviteExpired, err)
+
+	// Unlimited until revoked
+	open, err := ius.CreateInvite(CreateInviteParams{})
+	assert.Nil(t, err)
+	for _, email := range []string{"open1@mail.com", "open2@mail.com", "open3@mail.com"} {
+		_, _, err = ius.SignUp(SignUpParams{Email: email, InviteCode: open.Code})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, ius.RevokeInvite(open.Code))
+	assert.Equal(t, ErrNotFound, ius.RevokeInvite(open.Code))
+	_, _, err = ius.SignUp(SignUpParams{Email: "open4@mail.com", InviteCode: open.Code})
+	assert.Equal(t, ErrInviteInvalid, err)
+
+	// Passive users and sign ups without RequireInvite don't need one
+	_, _, err = ius.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	_, _, err = us.SignUp(SignUpParams{Email: "uninvited@mail.com"})
+	assert.Nil(t, err)
+}
+
+func TestCreateInviteParams_Validate(t *testing.T) {
+	assert.Nil(t, (&CreateInviteParams{Code: "abc", MaxUses: 1}).Validate())
+	assert.Error(t, (&CreateInviteParams{Code: "0123456789012345678901234567890"}).Validate())
+	assert.Error(t, (&CreateInviteParams{MaxUses: -1}).Validate())
+	assert.Error(t, (&CreateInviteParams{Expires: -1}).Validate())
+}
+
+// racingDialect simulates a concurrent sign up committing between SignUp's exists check and its INSERT.
+type racingDialect struct {
+	Dialect
+	race func()
+	err  error
+}
+
+func (d racingDialect) InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	d.race()
+	return 0, d.err
+}
+
+func TestUsers_SignUpRace(t *testing.T) {
+	f := false
+	other := NewUsers(testDb, UserOpts{UsernameIsEmail: &f})
+	race := func() {}
+	duplicate := errors.New("Error 1062: Duplicate entry 'x' for key 'email'")
+	rus := NewUsers(testDb, UserOpts{UsernameIsEmail: &f,
+		Dialect: racingDialect{Dialect: MySqlDialect, race: func() { race() }, err: duplicate}})
+
+	race = func() {
+		_, _, err := other.SignUp(SignUpParams{Email: "racer@mail.com"})
+		assert.Nil(t, err)
+	}
+	_, _, err := rus.SignUp(SignUpParams{Email: "racer@mail.com"})
+	assert.Equal(t, ErrEmailTaken, err)
+
+	race = func() {
+		_, _, err := other.SignUp(SignUpParams{Email: "racer1@mail.com", Username: "racer"})
+		assert.Nil(t, err)
+	}
+	_, _, err = rus.SignUp(SignUpParams{Email: "racer2@mail.com", Username: "racer"})
+	assert.Equal(t, ErrUsernameTaken, err)
+
+	// The winner can't always be found, e.g. it was deleted since
+	race = func() {}
+	_, _, err = rus.SignUp(SignUpParams{Email: "racer3@mail.com"})
+	assert.Equal(t, ErrEmailTaken, err)
+
+	// Other driver errors aren't translated
+	rus.Dialect = racingDialect{Dialect: MySqlDialect, race: func() {}, err: errors.New("Error 1146: Table 'users' doesn't exist")}
+	_, _, err = rus.SignUp(SignUpParams{Email: "racer4@mail.com"})
+	assert.EqualError(t, err, "Error 1146: Table 'users' doesn't exist")
+}
+
+func TestUsers_RecoveryCodes(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "recovery@mail.com"})
+	assert.Nil(t, err)
+	_, err = us.GenerateRecoveryCodes(999999)
+	assert.Equal(t, ErrNotFound, err)
+
+	codes, err := us.GenerateRecoveryCodes(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, recoveryCodeCount, len(codes))
+	var stored int
+	assert.Nil(t, testDb.QueryRow("SELECT count(id) FROM recovery_codes WHERE user_id = ? AND code_hash = ?",
+		u.Id, codes[0]).Scan(&stored))
+	assert.Equal(t, 0, stored)
+
+	// Each code works exactly once and only for its user
+	other, _, err := us.SignUp(SignUpParams{Email: "recovery2@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrNoRecoveryCodes, us.UseRecoveryCode(other.Id, codes[0]))
+	assert.Nil(t, us.UseRecoveryCode(u.Id, codes[0]))
+	assert.Equal(t, ErrInvalidRecoveryCode, us.UseRecoveryCode(u.Id, codes[0]))
+	assert.Equal(t, ErrInvalidRecoveryCode, us.UseRecoveryCode(u.Id, "wrong"))
+
+	// Regenerating replaces the old codes
+	old := codes
+	codes, err = us.GenerateRecoveryCodes(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidRecoveryCode, us.UseRecoveryCode(u.Id, old[1]))
+
+	for _, code := range codes {
+		assert.Nil(t, us.UseRecoveryCode(u.Id, code))
+	}
+	assert.Equal(t, ErrNoRecoveryCodes, us.UseRecoveryCode(u.Id, codes[0]))
+	assert.Equal(t, ErrNotFound, us.UseRecoveryCode(999999, codes[0]))
+}
+
+func TestUsers_RecoveryCodeLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)}
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 60, Clock: clock})
+	password := "M0nk3yNutz5!"
+	u, _, err := lus.SignUp(SignUpParams{Email: "recovery-lockout@mail.com", Password: password})
+	assert.Nil(t, err)
+	codes, err := lus.GenerateRecoveryCodes(u.Id)
+	assert.Nil(t, err)
+
+	// Successes aren't counted
+	for _, code := range codes[:3] {
+		assert.Nil(t, lus.UseRecoveryCode(u.Id, code))
+	}
+	assert.Equal(t, ErrInvalidRecoveryCode, lus.UseRecoveryCode(u.Id, "guess1"))
+	assert.Equal(t, ErrInvalidRecoveryCode, lus.UseRecoveryCode(u.Id, "guess2"))
+
+	// Locked, even for a valid code and for signing in, until the failures leave the window
+	err = lus.UseRecoveryCode(u.Id, codes[3])
+	assert.IsType(t, &RateLimitExceededError{}, err)
+	_, err = lus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.IsType(t, &RateLimitExceededError{}, err)
+	clock.advance(61 * time.Second)
+	assert.Nil(t, lus.UseRecoveryCode(u.Id, codes[3]))
+}
+
+func TestUsers_PromoteUser(t *testing.T) {
+	guest, _, err := us.SignUp(SignUpParams{Passive: true, FirstName: "Guest", Phone: "555"})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(guest.Email, "@passive-user.gus"))
+	_, err = us.SignIn(SignInParams{Email: guest.Email, Password: "anything"})
+	assert.Equal(t, ErrNotAuth, err)
+
+	taken, _, err := us.SignUp(SignUpParams{Email: "promotedtaken@mail.com"})
+	assert.Nil(t, err)
+	_, _, err = us.PromoteUser(guest.Id, SignUpParams{Email: "PromotedTaken@mail.com"})
+	assert.Equal(t, ErrEmailTaken, err)
+	_, _, err = us.PromoteUser(guest.Id, SignUpParams{Email: "not an email"})
+	assert.Equal(t, ErrEmailInvalid, err)
+
+	password := "M0nk3yNutz5!"
+	u, token, err := us.PromoteUser(guest.Id, SignUpParams{Email: "Promoted@mail.com", Password: password, LastName: "Buyer"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", token)
+	assert.Equal(t, guest.Id, u.Id)
+	assert.Equal(t, guest.Uid, u.Uid)
+	assert.Equal(t, "promoted@mail.com", u.Email)
+	assert.Equal(t, "promoted@mail.com", u.Username)
+	assert.Equal(t, "Guest", u.FirstName)
+	assert.Equal(t, "Buyer", u.LastName)
+	assert.Equal(t, "555", u.Phone)
+	assert.False(t, u.Passive)
+	_, err = us.SignIn(SignInParams{Email: "promoted@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	// Already active users are rejected
+	_, _, err = us.PromoteUser(u.Id, SignUpParams{Email: "again@mail.com", Password: password})
+	assert.Equal(t, ErrNotPassive, err)
+	_, _, err = us.PromoteUser(taken.Id, SignUpParams{Email: "again@mail.com"})
+	assert.Equal(t, ErrNotPassive, err)
+	_, _, err = us.PromoteUser(999999, SignUpParams{Email: "again@mail.com"})
+	assert.Equal(t, ErrNotFound, err)
+
+	// Without a password an activation token is returned to set one
+	guest, _, err = us.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	u, token, err = us.PromoteUser(guest.Id, SignUpParams{Email: "promoted2@mail.com"})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, token)
+	assert.Nil(t, us.ChangePassword(ChangePasswordParams{Email: u.Email, ResetToken: token, NewPassword: password}))
+	_, err = us.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+
+	// Promoting into an org makes them a member, as SignUp does, so they can switch back to it
+	org, err := orgsv.Create(CreateOrgParams{Name: "Promoted into"})
+	assert.Nil(t, err)
+	other, err := orgsv.Create(CreateOrgParams{Name: "Promoted other"})
+	assert.Nil(t, err)
+	guest, _, err = us.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	u, _, err = us.PromoteUser(guest.Id, SignUpParams{Email: "promoted-org@mail.com", OrgId: org.Id})
+	assert.Nil(t, err)
+	orgs, err := us.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(orgs)) {
+		assert.Equal(t, org.Id, orgs[0].Id)
+	}
+	assert.Nil(t, us.AddToOrg(u.Id, other.Id))
+	assert.Nil(t, us.SetActiveOrg(u.Id, other.Id))
+	assert.Nil(t, us.SetActiveOrg(u.Id, org.Id))
+}
+
+func TestUsers_LockRetryAfter(t *testing.T) {
+	start := time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 60, ClientAuthAttempts: 3, Clock: clock})
+	p := SignInParams{Username: "retryafter@mail.com", Password: "wrong", ClientId: "retry-client"}
+
+	// Attempts at 0s, 10.5s and 20s
+	_, err := cus.SignIn(p)
+	assert.Equal(t, ErrNotAuth, err)
+	clock.advance(10500 * time.Millisecond)
+	_, err = cus.SignIn(p)
+	assert.Equal(t, ErrNotAuth, err)
+	clock.now = start.Add(20 * time.Second)
+	_, err = cus.SignIn(p)
+	rl, ok := err.(*RateLimitExceededError)
+	if assert.True(t, ok) {
+		// The attempt at 10.5s leaves the window at 70.5s
+		assert.Equal(t, int64(51), rl.RetryAfter)
+	}
+
+	// Retrying early is another attempt, at 70s, so the wait is until the one at 20s leaves
+	clock.now = start.Add(70 * time.Second)
+	_, err = cus.SignIn(p)
+	rl, ok = err.(*RateLimitExceededError)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(10), rl.RetryAfter)
+	}
+	clock.advance(time.Duration(rl.RetryAfter) * time.Second)
+	_, err = cus.SignIn(p)
+	assert.Equal(t, ErrNotAuth, err)
+
+	// Locked by the client, the username's own attempts would be allowed
+	clock.advance(time.Hour)
+	for _, username := range []string{"retry1@mail.com", "retry2@mail.com", "retry3@mail.com"} {
+		_, err = cus.SignIn(SignInParams{Username: username, Password: "wrong", ClientId: "retry-client"})
+		assert.Equal(t, ErrNotAuth, err)
+		clock.advance(time.Second)
+	}
+	_, err = cus.SignIn(SignInParams{Username: "retry4@mail.com", Password: "wrong", ClientId: "retry-client"})
+	rl, ok = err.(*RateLimitExceededError)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(58), rl.RetryAfter)
+	}
+}
+
+func TestUsers_Sessions(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	sus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, SessionExpiry: 60, Clock: clock})
+	email := "sessions@mail.com"
+	password := "M0nk3yNutz5!"
+	u, _, err := sus.SignUp(SignUpParams{Email: email, Password: password})
+	assert.Nil(t, err)
+	_, err = sus.CreateSession(999999)
+	assert.Equal(t, ErrNotFound, err)
+
+	id, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	created := Milliseconds(clock.now)
+	clock.advance(10 * time.Second)
+	s, err := sus.ValidateSession(id)
+	assert.Nil(t, err)
+	assert.Equal(t, Session{UserId: u.Id, Created: created, LastSeen: Milliseconds(clock.now),
+		Expires: created + 60*1000}, *s)
+	_, err = sus.ValidateSession("wrong")
+	assert.Equal(t, ErrSessionInvalid, err)
+	clock.advance(50 * time.Second)
+	_, err = sus.ValidateSession(id)
+	assert.Equal(t, ErrSessionExpired, err)
+
+	// Single revoke leaves the user's other sessions
+	first, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	second, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, sus.RevokeSession(first))
+	assert.Equal(t, ErrNotFound, sus.RevokeSession(first))
+	_, err = sus.ValidateSession(first)
+	assert.Equal(t, ErrSessionInvalid, err)
+	_, err = sus.ValidateSession(second)
+	assert.Nil(t, err)
+
+	// Changing the password revokes them all
+	third, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	err = sus.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: password, NewPassword: "N3wM0nk3yNutz5!"})
+	assert.Nil(t, err)
+	for _, id := range []string{second, third} {
+		_, err = sus.ValidateSession(id)
+		assert.Equal(t, ErrSessionInvalid, err)
+	}
+
+	// As does suspending, after which no new sessions can be created
+	fourth, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, sus.Suspend(u.Id))
+	_, err = sus.ValidateSession(fourth)
+	assert.Equal(t, ErrSessionInvalid, err)
+	_, err = sus.CreateSession(u.Id)
+	assert.Equal(t, ErrNotAuth, err)
+}
+
+func TestUsers_APIKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	kus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, APIKeyExpiry: 60, Clock: clock})
+	org, err := orgsv.Create(CreateOrgParams{Name: "API keys"})
+	assert.Nil(t, err)
+	u, _, err := kus.SignUp(SignUpParams{Email: "apikeys@mail.com", Password: "M0nk3yNutz5!", OrgId: org.Id})
+	assert.Nil(t, err)
+	_, err = kus.CreateAPIKey(999999, "ci")
+	assert.Equal(t, ErrNotFound, err)
+
+	key, err := kus.CreateAPIKey(u.Id, "ci")
+	assert.Nil(t, err)
+	created := Milliseconds(clock.now)
+	var stored int
+	assert.Nil(t, testDb.QueryRow("SELECT count(id) FROM api_keys WHERE key_hash = ?", key).Scan(&stored))
+	assert.Equal(t, 0, stored)
+
+	clock.advance(10 * time.Second)
+	uc, err := kus.AuthenticateAPIKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, uc.Id)
+	assert.Equal(t, org.Id, uc.Claims.OrgId)
+	_, err = kus.AuthenticateAPIKey("wrong")
+	assert.Equal(t, ErrNotAuth, err)
+
+	other, err := kus.CreateAPIKey(u.Id, "deploy")
+	assert.Nil(t, err)
+	keys, err := kus.ListAPIKeys(u.Id)
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(keys)) {
+		assert.Equal(t, APIKey{Id: keys[0].Id, UserId: u.Id, Name: "ci", Created: created,
+			LastUsed: created + 10*1000, Expires: created + 60*1000}, *keys[0])
+		assert.Equal(t, "deploy", keys[1].Name)
+		assert.Equal(t, int64(0), keys[1].LastUsed)
+	}
+
+	// Revoking only stops that key and only its owner can revoke it
+	assert.Equal(t, ErrNotFound, kus.RevokeAPIKey(u.Id+1, keys[1].Id))
+	assert.Nil(t, kus.RevokeAPIKey(u.Id, keys[1].Id))
+	assert.Equal(t, ErrNotFound, kus.RevokeAPIKey(u.Id, keys[1].Id))
+	_, err = kus.AuthenticateAPIKey(other)
+	assert.Equal(t, ErrNotAuth, err)
+	keys, err = kus.ListAPIKeys(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+
+	// Suspended users and orgs are rejected
+	assert.Nil(t, kus.Suspend(u.Id))
+	_, err = kus.AuthenticateAPIKey(key)
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Nil(t, kus.Restore(u.Id))
+	_, err = kus.AuthenticateAPIKey(key)
+	assert.Nil(t, err)
+	assert.Nil(t, orgsv.Suspend(org.Id))
+	_, err = kus.AuthenticateAPIKey(key)
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Nil(t, orgsv.Restore(org.Id))
+
+	clock.advance(50 * time.Second)
+	_, err = kus.AuthenticateAPIKey(key)
+	assert.Equal(t, ErrAPIKeyExpired, err)
+}
+
+func TestUsers_PasswordPolicy(t *testing.T) {
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PasswordPolicy: PasswordRules{MinLength: 15}.Check})
+	email := "policy@mail.com"
+	_, _, err := pus.SignUp(SignUpParams{Email: email, Password: "M0nk3yNutz5!"})
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, "password_too_short", err.(*ValidationError).Code)
+	}
+	// Generated passwords aren't checked
+	_, _, err = pus.SignUp(SignUpParams{Email: "policy2@mail.com"})
+	assert.Nil(t, err)
+	_, _, err = pus.SignUp(SignUpParams{Email: email, Password: "correct horse battery"})
+	assert.Nil(t, err)
+
+	err = pus.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: "correct horse battery", NewPassword: "Sh0rt!"})
+	assert.IsType(t, &ValidationError{}, err)
+	err = pus.ChangePassword(ChangePasswordParams{Email: email, ExistingPassword: "correct horse battery", NewPassword: "staple battery horse"})
+	assert.Nil(t, err)
+
+	// Without a policy the ValidatePassword rules apply
+	dus := NewUsers(testDb, UserOpts{})
+	for _, weak := range []string{"a", "short", "alllowercase1!", "NoNumbers!!", "N0Special5"} {
+		_, _, err = dus.SignUp(SignUpParams{Email: "nopolicy@mail.com", Password: weak})
+		assert.Equal(t, ErrPasswordInvalid, err, weak)
+	}
+	u, _, err := dus.SignUp(SignUpParams{Email: "nopolicy@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+	err = dus.ChangePassword(ChangePasswordParams{Email: u.Email, ExistingPassword: "M0nk3yNutz5!", NewPassword: "a"})
+	assert.Equal(t, ErrPasswordInvalid, err)
+	assert.Equal(t, ErrPasswordInvalid, dus.AdminSetPassword(u.Id, "a", false))
+}
+
+func TestUsers_SuspendByOrg(t *testing.T) {
+	password := "M0nk3yNutz5!"
+	delinquent, err := orgsv.Create(CreateOrgParams{Name: "Delinquent"})
+	assert.Nil(t, err)
+	other, err := orgsv.Create(CreateOrgParams{Name: "Paying"})
+	assert.Nil(t, err)
+	var members []*User
+	for i := 0; i < 3; i++ {
+		u, _, err := us.SignUp(SignUpParams{Email: fmt.Sprintf("delinquent%d@mail.com", i), Password: password, OrgId: delinquent.Id})
+		assert.Nil(t, err)
+		members = append(members, u)
+	}
+	assert.Nil(t, us.Suspend(members[2].Id))
+	bystander, _, err := us.SignUp(SignUpParams{Email: "paying@mail.com", Password: password, OrgId: other.Id})
+	assert.Nil(t, err)
+	session, err := us.CreateSession(members[0].Id)
+	assert.Nil(t, err)
+	bystanderSession, err := us.CreateSession(bystander.Id)
+	assert.Nil(t, err)
+
+	// Already suspended users aren't counted
+	n, err := us.SuspendByOrg(delinquent.Id, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	for _, m := range members {
+		u, err := us.Get(m.Id)
+		assert.Nil(t, err)
+		assert.True(t, u.Suspended)
+	}
+	_, err = us.ValidateSession(session)
+	assert.Equal(t, ErrSessionInvalid, err)
+
+	u, err := us.Get(bystander.Id)
+	assert.Nil(t, err)
+	assert.False(t, u.Suspended)
+	_, err = us.ValidateSession(bystanderSession)
+	assert.Nil(t, err)
+
+	n, err = us.SuspendByOrg(delinquent.Id, false)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), n)
+	_, err = us.SignIn(SignInParams{Email: members[0].Email, Password: password})
+	assert.Nil(t, err)
+}
+
+func TestUsers_SignUpIdempotencyKey(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	ius := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, IdempotencyKeyExpiry: 60, Clock: clock})
+	p := SignUpParams{Email: "idempotent@mail.com", Password: "M0nk3yNutz5!", IdempotencyKey: "signup-1"}
+	u, _, err := ius.SignUp(p)
+	assert.Nil(t, err)
+	replayed, token, err := ius.SignUp(p)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, replayed.Id)
+	assert.Equal(t, "", token)
+
+	// The key is bound to the params so it can't return another caller's user
+	_, _, err = ius.SignUp(SignUpParams{Email: "idempotent-other@mail.com", Password: "M0nk3yNutz5!", IdempotencyKey: "signup-1"})
+	assert.Equal(t, ErrIdempotencyKeyReused, err)
+	_, _, err = ius.SignUp(SignUpParams{Email: p.Email, FirstName: "Changed", Password: "M0nk3yNutz5!", IdempotencyKey: "signup-1"})
+	assert.Equal(t, ErrIdempotencyKeyReused, err)
+	replayed, _, err = ius.SignUp(SignUpParams{Email: " IDEMPOTENT@mail.com", Password: "M0nk3yNutz5!", IdempotencyKey: "signup-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, replayed.Id)
+
+	// Passive users get a new email each time so would otherwise be created twice
+	passive := SignUpParams{Passive: true, IdempotencyKey: "guest-1"}
+	guest, _, err := ius.SignUp(passive)
+	assert.Nil(t, err)
+	replayed, _, err = ius.SignUp(passive)
+	assert.Nil(t, err)
+	assert.Equal(t, guest.Id, replayed.Id)
+	passive.IdempotencyKey = "guest-2"
+	other, _, err := ius.SignUp(passive)
+	assert.Nil(t, err)
+	assert.NotEqual(t, guest.Id, other.Id)
+
+	// Without a key, or once it has expired, the email is taken
+	p.IdempotencyKey = ""
+	_, _, err = ius.SignUp(p)
+	assert.Equal(t, ErrEmailTaken, err)
+	clock.advance(61 * time.Second)
+	p.IdempotencyKey = "signup-1"
+	_, _, err = ius.SignUp(p)
+	assert.Equal(t, ErrEmailTaken, err)
+	guest2, _, err := ius.SignUp(SignUpParams{Passive: true, IdempotencyKey: "guest-1"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, guest.Id, guest2.Id)
+}
+
+func TestUsers_UpdatePartial(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "partial@mail.com", FirstName: "Before", LastName: "Last", Phone: "+61400000000"})
+	assert.Nil(t, err)
+	fname := "After"
+	p := UpdateUserParams{Id: &u.Id, FirstName: &fname}
+	assert.Nil(t, p.Validate())
+	assert.Nil(t, us.Update(p))
+	updated, err := us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "After", updated.FirstName)
+	assert.Equal(t, "Last", updated.LastName)
+	assert.Equal(t, "partial@mail.com", updated.Email)
+	assert.Equal(t, "+61400000000", updated.Phone)
+
+	assert.Equal(t, ErrIdRequired, us.Update(UpdateUserParams{FirstName: &fname}))
+}
+
+func TestUpdateUserParams_Validate(t *testing.T) {
+	for _, phone := range []string{"0400000000", "+0400000000", "+61 400 000 000", "+1234567890123456", "+6140000000a"} {
+		p := UpdateUserParams{Phone: &phone}
+		assert.Equal(t, ErrPhoneInvalid, p.Validate(), phone)
+	}
+	for _, phone := range []string{"", "+61400000000", "+12"} {
+		p := UpdateUserParams{Phone: &phone}
+		assert.Nil(t, p.Validate(), phone)
+	}
+}
+
+func TestUsers_UpdateClears(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "clears@mail.com", FirstName: "First", LastName: "Last", Phone: "+61400000000"})
+	assert.Nil(t, err)
+	get := func() *User {
+		u, err := us.Get(u.Id)
+		assert.Nil(t, err)
+		return u
+	}
+	set, empty := "Set", ""
+
+	// nil leaves each field unchanged
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id}))
+	got := get()
+	assert.Equal(t, []string{"First", "Last", "+61400000000", "clears@mail.com"},
+		[]string{got.FirstName, got.LastName, got.Phone, got.Email})
+
+	// A value sets it
+	email := "cleared@mail.com"
+	phone := "+61400000001"
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, FirstName: &set, LastName: &set, Phone: &phone, Email: &email}))
+	got = get()
+	assert.Equal(t, []string{"Set", "Set", "+61400000001", "cleared@mail.com"},
+		[]string{got.FirstName, got.LastName, got.Phone, got.Email})
+
+	// "" clears it, one field at a time, except the email which is required
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, Phone: &empty}))
+	got = get()
+	assert.Equal(t, []string{"Set", "Set", "", "cleared@mail.com"}, []string{got.FirstName, got.LastName, got.Phone, got.Email})
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, FirstName: &empty}))
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, LastName: &empty}))
+	got = get()
+	assert.Equal(t, []string{"", "", "", "cleared@mail.com"}, []string{got.FirstName, got.LastName, got.Phone, got.Email})
+	assert.Equal(t, ErrEmailRequired, us.Update(UpdateUserParams{Id: &u.Id, Email: &empty}))
+	p := UpdateUserParams{Id: &u.Id, Email: &empty}
+	assert.Equal(t, ErrEmailRequired, p.Validate())
+	assert.Equal(t, "cleared@mail.com", get().Email)
+}
+
+func TestUsers_GetByEmail(t *testing.T) {
+	f := false
+	eus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	u, _, err := eus.SignUp(SignUpParams{Email: "byemail@mail.com", Username: "byemail-username"})
+	assert.Nil(t, err)
+	// A username that looks like another user's email
+	other, _, err := eus.SignUp(SignUpParams{Email: "byemail2@mail.com", Username: "byemail-other@mail.com"})
+	assert.Nil(t, err)
+
+	got, err := eus.GetByEmail(" ByEmail@Mail.com ")
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, got.Id)
+	got, err = eus.GetByEmail("byemail2@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, other.Id, got.Id)
+
+	_, err = eus.GetByEmail("byemail-username")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = eus.GetByEmail("byemail-other@mail.com")
+	assert.Equal(t, ErrNotFound, err)
+	uc, _, err := eus.GetByUsername("byemail-other@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, other.Id, uc.Id)
+
+	assert.Nil(t, eus.Delete(u.Id))
+	_, err = eus.GetByEmail("byemail@mail.com")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUsers_PassiveEmailDomain(t *testing.T) {
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PassiveEmailDomain: "guests.invalid"})
+	u, _, err := pus.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(u.Email, "@guests.invalid"), u.Email)
+	got, err := pus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Email, got.Email)
+
+	// A given email is kept
+	u, _, err = pus.SignUp(SignUpParams{Passive: true, Email: "passive-domain@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "passive-domain@mail.com", u.Email)
+}
+
+func TestUsers_MaxPageSize(t *testing.T) {
+	mus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, MaxPageSize: 2})
+	for i := 0; i < 3; i++ {
+		_, _, err := mus.SignUp(SignUpParams{Email: fmt.Sprintf("pagesize%d@mail.com", i)})
+		assert.Nil(t, err)
+	}
+	f := UserFilters{Email: "pagesize"}
+	for _, size := range []int{1000000, 0} {
+		users, err := mus.List(ListUsersParams{ListArgs: ListArgs{Size: size}, UserFilters: f})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(users.Items))
+		assert.Equal(t, 2, users.Size)
+		assert.Equal(t, int64(3), users.Total)
+	}
+	users, err := mus.List(ListUsersParams{ListArgs: ListArgs{Size: 1}, UserFilters: f})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, users.Size)
+
+	users, err = us.List(ListUsersParams{ListArgs: ListArgs{Size: 1000000}, UserFilters: f})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, users.Size)
+	assert.Equal(t, 3, len(users.Items))
+}
+
+// insertRaceDialect runs race just before each INSERT, e.g. to commit a conflicting user after exists() has passed.
+type insertRaceDialect struct {
+	Dialect
+	race func()
+}
+
+func (d insertRaceDialect) InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	d.race()
+	return d.Dialect.InsertId(ctx, tx, query, args...)
+}
+
+func TestUsers_UniqueLiveUsers(t *testing.T) {
+	f := false
+	other := NewUsers(testDb, UserOpts{UsernameIsEmail: &f})
+	race := func() {}
+	rus := NewUsers(testDb, UserOpts{UsernameIsEmail: &f, Dialect: insertRaceDialect{Dialect: MySqlDialect, race: func() { race() }}})
+
+	// The unique indexes reject what exists() missed and the violation is reported as taken
+	race = func() {
+		_, _, err := other.SignUp(SignUpParams{Email: "live@mail.com", Username: "live-first"})
+		assert.Nil(t, err)
+	}
+	_, _, err := rus.SignUp(SignUpParams{Email: "live@mail.com", Username: "live-second"})
+	assert.Equal(t, ErrEmailTaken, err)
+	race = func() {
+		_, _, err := other.SignUp(SignUpParams{Email: "live1@mail.com", Username: "live"})
+		assert.Nil(t, err)
+	}
+	_, _, err = rus.SignUp(SignUpParams{Email: "live2@mail.com", Username: "live"})
+	assert.Equal(t, ErrUsernameTaken, err)
+	race = func() {}
+
+	u, err := other.GetByEmail("live@mail.com")
+	assert.Nil(t, err)
+	_, err = testDb.Exec("UPDATE users SET email = ? WHERE id = ?", "live1@mail.com", u.Id)
+	assert.True(t, MySqlDialect.IsDuplicate(err), err)
+
+	// Deleted users don't block the email or username
+	assert.Nil(t, other.Delete(u.Id))
+	again, _, err := rus.SignUp(SignUpParams{Email: "live@mail.com", Username: "live-first"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, u.Id, again.Id)
+	assert.Equal(t, ErrEmailTaken, other.UnDelete(u.Id))
+}
+
+func TestUsers_Metadata(t *testing.T) {
+	meta := map[string]interface{}{"plan": "pro", "seats": 3, "beta": true}
+	u, _, err := us.SignUp(SignUpParams{Email: "metadata@mail.com", Metadata: meta})
+	assert.Nil(t, err)
+	assert.Equal(t, meta, u.Metadata)
+
+	// JSON numbers come back as float64
+	want := map[string]interface{}{"plan": "pro", "seats": float64(3), "beta": true}
+	got, err := us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, want, got.Metadata)
+	uc, _, err := us.GetByUsername("metadata@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, want, uc.Metadata)
+	users, err := us.List(ListUsersParams{UserFilters: UserFilters{Email: "metadata@mail.com"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(users.Items))
+	assert.Equal(t, want, users.Items[0].Metadata)
+
+	assert.Nil(t, us.SetMetadata(u.Id, "seats", 5))
+	assert.Nil(t, us.SetMetadata(u.Id, "tags", []string{"a", "b"}))
+	assert.Nil(t, us.SetMetadata(u.Id, "beta", nil))
+	v, err := us.GetMetadata(u.Id, "seats")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), v)
+	v, err = us.GetMetadata(u.Id, "tags")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"a", "b"}, v)
+	v, err = us.GetMetadata(u.Id, "beta")
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+	v, err = us.GetMetadata(u.Id, "plan")
+	assert.Nil(t, err)
+	assert.Equal(t, "pro", v)
+
+	// Update merges keys and leaves the rest
+	assert.Nil(t, us.Update(UpdateUserParams{Id: &u.Id, Metadata: map[string]interface{}{"plan": "team", "tags": nil}}))
+	got, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"plan": "team", "seats": float64(5)}, got.Metadata)
+
+	other, _, err := us.SignUp(SignUpParams{Email: "metadata2@mail.com"})
+	assert.Nil(t, err)
+	assert.Nil(t, other.Metadata)
+	v, err = us.GetMetadata(other.Id, "plan")
+	assert.Nil(t, err)
+	assert.Nil(t, v)
+	assert.Equal(t, ErrNotFound, us.SetMetadata(-1, "plan", "pro"))
+	_, err = us.GetMetadata(-1, "plan")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUsers_MetadataConcurrent(t *testing.T) {
+	u, _, err := us.SignUp(SignUpParams{Email: "metadata-concurrent@mail.com"})
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, us.SetMetadata(u.Id, fmt.Sprintf("key%d", i), i))
+		}(i)
+	}
+	wg.Wait()
+	got, err := us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(got.Metadata))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, float64(i), got.Metadata[fmt.Sprintf("key%d", i)])
+	}
+}
+
+func TestUsers_DetailedSignInErrors(t *testing.T) {
+	password := "M0nk3yNutz5!"
+	dus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, DetailedSignInErrors: true})
+	org, err := orgsv.Create(CreateOrgParams{Name: "Detailed"})
+	assert.Nil(t, err)
+	suspended, _, err := dus.SignUp(SignUpParams{Email: "detailed-suspended@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.Nil(t, dus.Suspend(suspended.Id))
+	orgSuspended, _, err := dus.SignUp(SignUpParams{Email: "detailed-org@mail.com", Password: password, OrgId: org.Id})
+	assert.Nil(t, err)
+	_, err = testDb.Exec("UPDATE orgs SET suspended = 1 WHERE id = ?", org.Id)
+	assert.Nil(t, err)
+	_, _, err = dus.SignUp(SignUpParams{Email: "detailed-passive@mail.com", Password: password, Passive: true})
+	assert.Nil(t, err)
+
+	for email, want := range map[string]error{
+		suspended.Email:             ErrUserSuspended,
+		orgSuspended.Email:          ErrOrgSuspended,
+		"detailed-passive@mail.com": ErrPassiveUser,
+	} {
+		_, err = dus.SignIn(SignInParams{Email: email, Password: password})
+		assert.Equal(t, want, err, email)
+		// Bad credentials and the default don't reveal the status
+		_, err = dus.SignIn(SignInParams{Email: email, Password: "wrong" + password})
+		assert.Equal(t, ErrNotAuth, err, email)
+		_, err = us.SignIn(SignInParams{Email: email, Password: password})
+		assert.Equal(t, ErrNotAuth, err, email)
+	}
+	_, err = dus.SignIn(SignInParams{Email: "detailed-unknown@mail.com", Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+}
+
+func TestUsers_HideResetEnumeration(t *testing.T) {
+	hus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, HideResetEnumeration: true})
+	resets := func(email string) int {
+		var n int
+		assert.Nil(t, testDb.QueryRow("SELECT count(*) FROM password_resets WHERE email = ?", email).Scan(&n))
+		return n
+	}
+	token, err := hus.ResetPassword(ResetPasswordParams{Email: "hidden-unknown@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", token)
+	assert.Equal(t, 0, resets("hidden-unknown@mail.com"))
+	_, err = us.ResetPassword(ResetPasswordParams{Email: "hidden-unknown@mail.com"})
+	assert.Equal(t, ErrNotFound, err)
+
+	_, _, err = hus.SignUp(SignUpParams{Email: "hidden-passive@mail.com", Passive: true})
+	assert.Nil(t, err)
+	token, err = hus.ResetPassword(ResetPasswordParams{Email: "hidden-passive@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "", token)
+	assert.Equal(t, 0, resets("hidden-passive@mail.com"))
+
+	_, _, err = hus.SignUp(SignUpParams{Email: "hidden-known@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+	token, err = hus.ResetPassword(ResetPasswordParams{Email: "hidden-known@mail.com"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", token)
+	assert.Equal(t, 1, resets("hidden-known@mail.com"))
+	assert.Nil(t, hus.ChangePassword(ChangePasswordParams{Email: "hidden-known@mail.com", ResetToken: token, NewPassword: "N3wM0nk3yNutz5!"}))
+}
+
+func TestOrgs_Lifecycle(t *testing.T) {
+	o, err := orgsv.Create(CreateOrgParams{Name: "Lifecycle"})
+	assert.Nil(t, err)
+	password := "M0nk3yNutz5!"
+	u, _, err := us.SignUp(SignUpParams{Email: "lifecycle@mail.com", Password: password, OrgId: o.Id})
+	assert.Nil(t, err)
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Lifecycle", u.OrgName)
+
+	assert.Equal(t, ErrNameRequired, orgsv.Rename(o.Id, ""))
+	assert.Nil(t, orgsv.Rename(o.Id, "Renamed"))
+	o, err = orgsv.Get(o.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Renamed", o.Name)
+	orgs, err := orgsv.List(ListOrgsParams{OrgFilters: OrgFilters{Name: "Renamed"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orgs.Items))
+	u, err = us.GetByEmail("lifecycle@mail.com")
+	assert.Nil(t, err)
+	assert.Equal(t, "Renamed", u.OrgName)
+	uc, err := us.SignIn(SignInParams{Email: "lifecycle@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, "Renamed", uc.OrgName)
+	assert.False(t, uc.Claims.OrgSuspended)
+
+	// Suspending the org keeps its users from signing in and shows in their claims
+	assert.Nil(t, orgsv.Suspend(o.Id))
+	o, err = orgsv.Get(o.Id)
+	assert.Nil(t, err)
+	assert.True(t, o.Suspended)
+	uc, _, err = us.GetByUsername("lifecycle@mail.com")
+	assert.Nil(t, err)
+	assert.True(t, uc.Claims.OrgSuspended)
+	_, err = us.SignIn(SignInParams{Email: "lifecycle@mail.com", Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Nil(t, orgsv.Restore(o.Id))
+	uc, err = us.SignIn(SignInParams{Email: "lifecycle@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.False(t, uc.Claims.OrgSuspended)
+
+	assert.Nil(t, orgsv.Delete(o.Id))
+	_, err = orgsv.Get(o.Id)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, orgsv.Rename(o.Id, "Deleted"))
+}
+
+func TestUsers_OrgMemberships(t *testing.T) {
+	mus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, DefaultRole: 1})
+	first, err := orgsv.Create(CreateOrgParams{Name: "Member First", DefaultRole: 3})
+	assert.Nil(t, err)
+	second, err := orgsv.Create(CreateOrgParams{Name: "Member Second", DefaultRole: 4})
+	assert.Nil(t, err)
+	password := "M0nk3yNutz5!"
+	u, _, err := mus.SignUp(SignUpParams{Email: "member@mail.com", Password: password, OrgId: first.Id})
+	assert.Nil(t, err)
+
+	orgs, err := mus.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orgs))
+	assert.Equal(t, first.Id, orgs[0].Id)
+	assert.Equal(t, ErrNotOrgMember, mus.SetActiveOrg(u.Id, second.Id))
+
+	assert.Nil(t, mus.AddToOrg(u.Id, second.Id))
+	assert.Nil(t, mus.AddToOrg(u.Id, second.Id))
+	assert.Equal(t, ErrUnknownOrg, mus.AddToOrg(u.Id, -1))
+	assert.Equal(t, ErrNotFound, mus.AddToOrg(-1, second.Id))
+	orgs, err = mus.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(orgs))
+	assert.Equal(t, "Member Second", orgs[1].Name)
+
+	// Adding doesn't switch, SetActiveOrg does
+	uc, err := mus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, first.Id, uc.Claims.OrgId)
+	assert.Equal(t, Role(3), uc.Claims.Role)
+	assert.Nil(t, mus.SetActiveOrg(u.Id, second.Id))
+	uc, err = mus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, second.Id, uc.Claims.OrgId)
+	assert.Equal(t, Role(3), uc.Claims.Role)
+	assert.Equal(t, "Member Second", uc.OrgName)
+
+	// Removing another org keeps the active one, removing the active one leaves none
+	assert.Nil(t, mus.RemoveFromOrg(u.Id, first.Id))
+	assert.Equal(t, ErrNotFound, mus.RemoveFromOrg(u.Id, first.Id))
+	got, err := mus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, second.Id, got.OrgId)
+	assert.Nil(t, mus.RemoveFromOrg(u.Id, second.Id))
+	uc, err = mus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), uc.Claims.OrgId)
+	assert.Equal(t, Role(1), uc.Claims.Role)
+	orgs, err = mus.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(orgs))
+
+	// SetOrg joins the org too
+	assert.Nil(t, mus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &first.Id}))
+	orgs, err = mus.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orgs))
+	assert.Equal(t, first.Id, orgs[0].Id)
+}
+
+func TestUsers_AddExistingMember(t *testing.T) {
+	org, err := orgsv.Create(CreateOrgParams{Name: "Existing member"})
+	assert.Nil(t, err)
+	var inserts int
+	db := sql.OpenDB(prepareHookConnector{dsn: testDsn("gus_test"), before: func(query string) {
+		if strings.HasPrefix(query, "INSERT INTO user_orgs") {
+			inserts++
+		}
+	}})
+	defer db.Close()
+	hus := NewUsers(db, UserOpts{AuthAttempts: 5, AuthLockDuration: 1})
+	u, _, err := hus.SignUp(SignUpParams{Email: "existing-member@mail.com", OrgId: org.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, inserts)
+
+	// Re-adding a member doesn't attempt the insert, whose duplicate key error would abort a Postgres tx
+	assert.Nil(t, hus.AddToOrg(u.Id, org.Id))
+	assert.Nil(t, hus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &org.Id}))
+	assert.Equal(t, 1, inserts)
+	orgs, err := hus.ListOrgs(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(orgs))
+}
+
+func TestUsers_SwitchOrg(t *testing.T) {
+	home, err := orgsv.Create(CreateOrgParams{Name: "Switch Home", DefaultRole: 3})
+	assert.Nil(t, err)
+	away, err := orgsv.Create(CreateOrgParams{Name: "Switch Away", DefaultRole: 4})
+	assert.Nil(t, err)
+	other, err := orgsv.Create(CreateOrgParams{Name: "Switch Other"})
+	assert.Nil(t, err)
+	u, _, err := us.SignUp(SignUpParams{Email: "switch@mail.com", OrgId: home.Id})
+	assert.Nil(t, err)
+	assert.Nil(t, us.AddToOrg(u.Id, away.Id))
+
+	// The user keeps their role rather than getting the org's default
+	uc, err := us.SwitchOrg(u.Id, away.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, away.Id, uc.Claims.OrgId)
+	assert.Equal(t, Role(3), uc.Claims.Role)
+	assert.Equal(t, "Switch Away", uc.OrgName)
+	assert.False(t, uc.Claims.OrgSuspended)
+
+	_, err = us.SwitchOrg(u.Id, other.Id)
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = us.SwitchOrg(-1, home.Id)
+	assert.Equal(t, ErrNotAuth, err)
+	got, err := us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, away.Id, got.OrgId)
+
+	// Switching into a suspended org works but the claims say it's suspended
+	assert.Nil(t, orgsv.Suspend(home.Id))
+	uc, err = us.SwitchOrg(u.Id, home.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, home.Id, uc.Claims.OrgId)
+	assert.True(t, uc.Claims.OrgSuspended)
+	assert.Nil(t, orgsv.Restore(home.Id))
+
+	// Deleted orgs can't be switched to, though the membership remains
+	gone, err := orgsv.Create(CreateOrgParams{Name: "Switch Gone"})
+	assert.Nil(t, err)
+	assert.Nil(t, us.AddToOrg(u.Id, gone.Id))
+	assert.Nil(t, orgsv.Delete(gone.Id))
+	assert.Equal(t, ErrUnknownOrg, us.SetActiveOrg(u.Id, gone.Id))
+	_, err = us.SwitchOrg(u.Id, gone.Id)
+	assert.Equal(t, ErrNotAuth, err)
+
+	assert.Nil(t, us.Suspend(u.Id))
+	_, err = us.SwitchOrg(u.Id, away.Id)
+	assert.Equal(t, ErrNotAuth, err)
+}
+
+// prepareHookConnector opens connections with the driver of testDb which call before with each query they prepare,
+// e.g. to change the db between two queries of a method.
+type prepareHookConnector struct {
+	dsn    string
+	before func(query string)
+}
+
+func (c prepareHookConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return prepareHookConn{Conn: conn, before: c.before}, nil
+}
+
+func (c prepareHookConnector) Driver() driver.Driver {
+	return testDb.Driver()
+}
+
+type prepareHookConn struct {
+	driver.Conn
+	before func(query string)
+}
+
+func (c prepareHookConn) Prepare(query string) (driver.Stmt, error) {
+	c.before(query)
+	return c.Conn.Prepare(query)
+}
+
+func (c prepareHookConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func TestUsers_ListSnapshot(t *testing.T) {
+	for i := 0; i < 3; i++ {
+		_, _, err := us.SignUp(SignUpParams{Email: fmt.Sprintf("snapshot%d@mail.com", i)})
+		assert.Nil(t, err)
+	}
+	// A user is added between the page and count queries
+	added := false
+	db := sql.OpenDB(prepareHookConnector{dsn: testDsn("gus_test"), before: func(query string) {
+		if strings.HasPrefix(query, "SELECT count(") && !added {
+			added = true
+			_, _, err := us.SignUp(SignUpParams{Email: "snapshot3@mail.com"})
+			assert.Nil(t, err)
+		}
+	}})
+	defer db.Close()
+	hus := NewUsers(db, UserOpts{AuthAttempts: 5, AuthLockDuration: 1})
+
+	f := UserFilters{Email: "snapshot"}
+	users, err := hus.List(ListUsersParams{UserFilters: f})
+	assert.Nil(t, err)
+	assert.True(t, added)
+	assert.Equal(t, 3, len(users.Items))
+	assert.Equal(t, int64(3), users.Total)
+
+	users, err = hus.List(ListUsersParams{UserFilters: f})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(users.Items))
+	assert.Equal(t, int64(4), users.Total)
+}
+
+func TestUsers_RecentAttempts(t *testing.T) {
+	start := time.Date(2031, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &fakeClock{now: start}
+	aus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Clock: clock})
+	password := "M0nk3yNutz5!"
+	_, _, err := aus.SignUp(SignUpParams{Email: "attempts@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		clock.advance(time.Minute)
+		_, err = aus.SignIn(SignInParams{Email: "Attempts@mail.com", Password: "wrong", ClientId: fmt.Sprintf("client%d", i), IP: ip})
+		assert.Equal(t, ErrNotAuth, err)
+	}
+	// Successful sign ins and other usernames aren't included
+	_, err = aus.SignIn(SignInParams{Email: "attempts@mail.com", Password: password, IP: "10.0.0.4"})
+	assert.Nil(t, err)
+	_, err = aus.SignIn(SignInParams{Email: "attempts-other@mail.com", Password: "wrong", IP: "10.0.0.5"})
+	assert.Equal(t, ErrNotAuth, err)
+
+	attempts, err := aus.RecentAttempts(" ATTEMPTS@mail.com", Milliseconds(start))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(attempts))
+	assert.Equal(t, Attempt{Username: "attempts@mail.com", ClientId: "client2", IP: "10.0.0.3",
+		Created: Milliseconds(start.Add(3 * time.Minute))}, attempts[0])
+	assert.Equal(t, "10.0.0.2", attempts[1].IP)
+	assert.Equal(t, "10.0.0.1", attempts[2].IP)
+
+	attempts, err = aus.RecentAttempts("attempts@mail.com", Milliseconds(start.Add(90*time.Second)))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(attempts))
+	assert.Equal(t, "10.0.0.3", attempts[0].IP)
+	assert.Equal(t, "10.0.0.2", attempts[1].IP)
+
+	attempts, err = aus.RecentAttempts("nobody@mail.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(attempts))
+}
+
+func TestUsers_Prune(t *testing.T) {
+	now := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 600, ResetTokenExpiry: 3600, Clock: &fakeClock{now: now}})
+	ago := func(d time.Duration) int64 {
+		return Milliseconds(now.Add(-d))
+	}
+	count := func(q string, args ...interface{}) int {
+		var n int
+		assert.Nil(t, testDb.QueryRow(q, args...).Scan(&n))
+		return n
+	}
+	for _, d := range []time.Duration{2 * time.Hour, time.Hour, 5 * time.Minute} {
+		_, err := testDb.Exec("INSERT INTO password_attempts (username, client_id, created) VALUES (?, ?, ?)", "prune@mail.com", "", ago(d))
+		assert.Nil(t, err)
+	}
+	// The attempt within the lock window is kept
+	n, err := pus.PruneAttempts(ago(90 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = pus.PruneAttempts(Milliseconds(now))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	attempts, err := pus.RecentAttempts("prune@mail.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(attempts))
+	assert.Equal(t, ago(5*time.Minute), attempts[0].Created)
+
+	for _, r := range []struct {
+		created time.Duration
+		deleted int
+	}{{30 * time.Minute, 1}, {30 * time.Minute, 0}, {2 * time.Hour, 0}, {3 * time.Hour, 1}} {
+		_, err := testDb.Exec("INSERT INTO password_resets (user_id, email, reset_token, created, deleted) VALUES (?, ?, ?, ?, ?)",
+			0, "prune@mail.com", "token", ago(r.created), r.deleted)
+		assert.Nil(t, err)
+	}
+	n, err = pus.PruneResets(ago(150 * time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	// The unexpired token is kept
+	n, err = pus.PruneResets(Milliseconds(now))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, 1, count("SELECT count(*) FROM password_resets WHERE email = ? AND deleted = 0 AND created = ?",
+		"prune@mail.com", ago(30*time.Minute)))
+	assert.Equal(t, 1, count("SELECT count(*) FROM password_resets WHERE email = ?", "prune@mail.com"))
+}
+
+// recordingHasher records the hashes it's asked to compare.
+type recordingHasher struct {
+	plainHasher
+	mu     sync.Mutex
+	hashes []string
+}
+
+func (h *recordingHasher) Compare(hash, password string) error {
+	h.mu.Lock()
+	h.hashes = append(h.hashes, hash)
+	h.mu.Unlock()
+	return h.plainHasher.Compare(hash, password)
+}
+
+func TestUsers_SignInUnknownComparesHash(t *testing.T) {
+	h := &recordingHasher{}
+	hus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Hasher: h})
+	password := "M0nk3yNutz5!"
+	_, _, err := hus.SignUp(SignUpParams{Email: "dummy-hash@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	_, err = hus.SignIn(SignInParams{Email: "dummy-hash-unknown@mail.com", Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = hus.SignIn(SignInParams{Email: "dummy-hash-unknown2@mail.com", Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = hus.SignIn(SignInParams{Email: "dummy-hash@mail.com", Password: "wrong"})
+	assert.Equal(t, ErrNotAuth, err)
+
+	// Unknown users are compared against the same hash of a random password, made with the Hasher
+	assert.Equal(t, 3, len(h.hashes))
+	assert.True(t, strings.HasPrefix(h.hashes[0], "$plain$"))
+	assert.NotEqual(t, "$plain$"+password, h.hashes[0])
+	assert.Equal(t, h.hashes[0], h.hashes[1])
+	assert.Equal(t, "$plain$"+password, h.hashes[2])
+}
+
+func TestUsers_Webhooks(t *testing.T) {
+	server, requests := webhookServer(0)
+	defer server.Close()
+	secret := []byte("webhook-secret")
+	sink := &recordingSink{}
+	wus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, EventSink: sink, WebhookURL: server.URL, WebhookSecret: secret})
+	password := "M0nk3yNutz5!"
+	u, _, err := wus.SignUp(SignUpParams{Email: "webhooks@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = wus.SignIn(SignInParams{Email: "webhooks@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.Nil(t, wus.Suspend(u.Id))
+
+	received := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		r := receiveWebhook(t, requests)
+		assert.True(t, VerifyWebhook(secret, r.body, r.signature))
+		var e WebhookEvent
+		assert.Nil(t, json.Unmarshal(r.body, &e))
+		assert.Equal(t, u.Id, e.UserId)
+		received[e.Event] = true
+	}
+	assert.Equal(t, map[string]bool{"sign_up": true, "sign_in": true, "suspended": true}, received)
+	assert.Nil(t, wus.Close())
+	// The EventSink still gets the events
+	assert.Equal(t, []string{"signup:webhooks@mail.com", "signin:webhooks@mail.com", fmt.Sprint("suspended:", u.Id)}, sink.events)
+}
+
+func TestUsers_DisableLockout(t *testing.T) {
+	password := "M0nk3yNutz5!"
+	signIn := func(us *Users, email string, password string) error {
+		_, err := us.SignIn(SignInParams{Email: email, Password: password, ClientId: "lockout-client"})
+		return err
+	}
+
+	dus := NewUsers(testDb, UserOpts{DisableLockout: true, AuthAttempts: 2, ClientAuthAttempts: 2, AuthLockDuration: 60})
+	_, _, err := dus.SignUp(SignUpParams{Email: "no-lockout@mail.com", Password: password})
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, ErrNotAuth, signIn(dus, "no-lockout@mail.com", "wrong"))
+	}
+	assert.Nil(t, signIn(dus, "no-lockout@mail.com", password))
+	attempts, err := dus.RecentAttempts("no-lockout@mail.com", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(attempts))
+
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 2, AuthLockDuration: 60})
+	_, _, err = pus.SignUp(SignUpParams{Email: "two-lockout@mail.com", Password: password})
+	assert.Nil(t, err)
+	assert.Nil(t, signIn(pus, "two-lockout@mail.com", password))
+	assert.Equal(t, ErrNotAuth, signIn(pus, "two-lockout@mail.com", "wrong"))
+	assert.Equal(t, ErrNotAuth, signIn(pus, "two-lockout@mail.com", "wrong"))
+	_, ok := signIn(pus, "two-lockout@mail.com", password).(*RateLimitExceededError)
+	assert.True(t, ok)
+}
+
+func TestUsers_AuthAttemptsLimit(t *testing.T) {
+	password := "M0nk3yNutz5!"
+	for _, c := range []struct {
+		attempts int64
+		allowed  int
+	}{{0, 5}, {-1, 5}, {1, 1}, {5, 5}} {
+		email := fmt.Sprintf("limit%d@mail.com", c.attempts)
+		lus := NewUsers(testDb, UserOpts{AuthAttempts: c.attempts, AuthLockDuration: 60})
+		_, _, err := lus.SignUp(SignUpParams{Email: email, Password: password})
+		assert.Nil(t, err)
+		// The first sign in is never locked
+		_, err = lus.SignIn(SignInParams{Email: email, Password: password})
+		assert.Nil(t, err)
+		for i := 0; i < c.allowed; i++ {
+			_, err = lus.SignIn(SignInParams{Email: email, Password: "wrong"})
+			assert.Equal(t, ErrNotAuth, err, email)
+		}
+		_, err = lus.SignIn(SignInParams{Email: email, Password: password})
+		_, ok := err.(*RateLimitExceededError)
+		assert.True(t, ok, email)
+	}
+}
+
+func TestUsers_TrustedDevices(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	dus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, TrustedDeviceExpiry: 60, Clock: clock})
+	password := "M0nk3yNutz5!"
+	u, _, err := dus.SignUp(SignUpParams{Email: "devices@mail.com", Password: password})
+	assert.Nil(t, err)
+	other, _, err := dus.SignUp(SignUpParams{Email: "devices-other@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = dus.TrustDevice(999999, "laptop")
+	assert.Equal(t, ErrNotFound, err)
+
+	token, err := dus.TrustDevice(u.Id, "laptop")
+	assert.Nil(t, err)
+	created := Milliseconds(clock.now)
+	otherToken, err := dus.TrustDevice(other.Id, "phone")
+	assert.Nil(t, err)
+	signIn := func(email, token string) bool {
+		uc, err := dus.SignIn(SignInParams{Email: email, Password: password, DeviceToken: token})
+		assert.Nil(t, err)
+		return uc != nil && uc.TrustedDevice
+	}
+	clock.advance(10 * time.Second)
+	assert.True(t, signIn(u.Email, token))
+	assert.False(t, signIn(u.Email, ""))
+	assert.False(t, signIn(u.Email, "wrong"))
+	assert.False(t, signIn(u.Email, otherToken))
+	// A device token doesn't replace the password
+	_, err = dus.SignIn(SignInParams{Email: u.Email, Password: "wrong", DeviceToken: token})
+	assert.Equal(t, ErrNotAuth, err)
+
+	devices, err := dus.ListTrustedDevices(u.Id)
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(devices)) {
+		assert.Equal(t, TrustedDevice{Id: devices[0].Id, UserId: u.Id, Name: "laptop", Created: created,
+			LastUsed: created + 10*1000, Expires: created + 60*1000}, *devices[0])
+	}
+
+	// Only the owner can revoke a device
+	assert.Equal(t, ErrNotFound, dus.RevokeTrustedDevice(other.Id, devices[0].Id))
+	assert.Nil(t, dus.RevokeTrustedDevice(u.Id, devices[0].Id))
+	assert.Equal(t, ErrNotFound, dus.RevokeTrustedDevice(u.Id, devices[0].Id))
+	assert.False(t, signIn(u.Email, token))
+
+	// Devices expire
+	token, err = dus.TrustDevice(u.Id, "desktop")
+	assert.Nil(t, err)
+	clock.advance(60 * time.Second)
+	assert.False(t, signIn(u.Email, token))
+	devices, err = dus.ListTrustedDevices(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(devices))
+
+	// Changing the password revokes all the user's devices
+	token, err = dus.TrustDevice(u.Id, "tablet")
+	assert.Nil(t, err)
+	otherToken, err = dus.TrustDevice(other.Id, "tablet")
+	assert.Nil(t, err)
+	reset, err := dus.ResetPassword(ResetPasswordParams{Email: u.Email})
+	assert.Nil(t, err)
+	assert.Nil(t, dus.ChangePassword(ChangePasswordParams{Email: u.Email, ResetToken: reset, NewPassword: password + "!"}))
+	assert.True(t, signIn(other.Email, otherToken))
+	password += "!"
+	assert.False(t, signIn(u.Email, token))
+}
+
+func TestSignUpParams_ValidatePassword(t *testing.T) {
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PasswordPolicy: DefaultPasswordRules.Check})
+	p := SignUpParams{Email: "validate-signup@mail.com"}
+	assert.Nil(t, p.Validate())
+	for _, weak := range []string{"short", "alllowercase1!", "NoNumbers!!", "N0Special5"} {
+		p.Password = weak
+		assert.Nil(t, p.Validate(), weak)
+		_, _, err := pus.SignUp(p)
+		assert.IsType(t, &ValidationError{}, err, weak)
+	}
+	p.Password = "M0nk3yNutz5!"
+	assert.Nil(t, p.Validate())
+	_, _, err := pus.SignUp(p)
+	assert.Nil(t, err)
+
+	// The params leave strength to the policy, which may allow what the default rules don't
+	c := ChangePasswordParams{Email: p.Email, ExistingPassword: p.Password, NewPassword: "correct horse battery"}
+	assert.Nil(t, c.Validate())
+	p.Password = "correct horse battery"
+	assert.Nil(t, p.Validate())
+}
+
+func TestUsers_CheckResetToken(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, ResetTokenExpiry: 60, Clock: clock})
+	email := "check-reset@mail.com"
+	_, _, err := cus.SignUp(SignUpParams{Email: email})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidResetToken, cus.CheckResetToken(email, "none-issued"))
+
+	token, err := cus.ResetPassword(ResetPasswordParams{Email: email})
+	assert.Nil(t, err)
+	assert.Nil(t, cus.CheckResetToken(email, token))
+	assert.Nil(t, cus.CheckResetToken(" CHECK-RESET@mail.com", token))
+	assert.Equal(t, ErrInvalidResetToken, cus.CheckResetToken(email, "wrong"))
+	assert.Equal(t, ErrInvalidResetToken, cus.CheckResetToken("nobody@mail.com", token))
+
+	// Checking doesn't consume the token
+	assert.Nil(t, cus.CheckResetToken(email, token))
+	assert.Nil(t, cus.ChangePassword(ChangePasswordParams{Email: email, ResetToken: token, NewPassword: "M0nk3yNutz5!"}))
+	assert.Equal(t, ErrInvalidResetToken, cus.CheckResetToken(email, token))
+
+	token, err = cus.ResetPassword(ResetPasswordParams{Email: email})
+	assert.Nil(t, err)
+	clock.advance(61 * time.Second)
+	assert.Equal(t, ErrTokenExpired, cus.CheckResetToken(email, token))
+}
+
+func TestUsers_UidGen(t *testing.T) {
+	var n int
+	uus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UidGen: func() string {
+		n++
+		return fmt.Sprintf("usr_%s_%d", strings.Repeat("0", 40), n)
+	}})
+	u, _, err := uus.SignUp(SignUpParams{Email: "uidgen@mail.com"})
+	assert.Nil(t, err)
+	uid := "usr_" + strings.Repeat("0", 40) + "_1"
+	assert.Equal(t, uid, u.Uid)
+	byUid, err := uus.GetByUid(uid)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Id, byUid.Id)
+	rotated, err := uus.RotateUid(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "usr_"+strings.Repeat("0", 40)+"_2", rotated)
+
+	// Defaults to a uuid
+	u, _, err = us.SignUp(SignUpParams{Email: "uidgen-default@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, 36, len(u.Uid))
+}
+
+func TestUsers_AdminSetPassword(t *testing.T) {
+	aus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PasswordPolicy: PasswordRules{MinLength: 10}.Check})
+	u, _, err := aus.SignUp(SignUpParams{Email: "admin-set@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, ErrNotFound, aus.AdminSetPassword(999999, "kiosk-password", false))
+	assert.Equal(t, ErrPasswordRequired, aus.AdminSetPassword(u.Id, "", false))
+	err = aus.AdminSetPassword(u.Id, "short", false)
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, "password_too_short", err.(*ValidationError).Code)
+	}
+
+	// Without forceChange the password works straight away
+	assert.Nil(t, aus.AdminSetPassword(u.Id, "kiosk-password", false))
+	_, err = aus.SignIn(SignInParams{Email: u.Email, Password: "kiosk-password"})
+	assert.Nil(t, err)
+
+	// With forceChange the user can only change the password
+	assert.Nil(t, aus.AdminSetPassword(u.Id, "temporary-password", true))
+	got, err := aus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.True(t, got.MustChangePassword)
+	_, err = aus.SignIn(SignInParams{Email: u.Email, Password: "kiosk-password"})
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = aus.SignIn(SignInParams{Email: u.Email, Password: "temporary-password"})
+	assert.Equal(t, ErrPasswordChangeRequired, err)
+	err = aus.ChangePassword(ChangePasswordParams{Email: u.Email, ExistingPassword: "temporary-password", NewPassword: "my-own-password"})
+	assert.Nil(t, err)
+	uc, err := aus.SignIn(SignInParams{Email: u.Email, Password: "my-own-password"})
+	assert.Nil(t, err)
+	assert.False(t, uc.MustChangePassword)
+}
+
+func TestUsers_ExpirePasswords(t *testing.T) {
+	// Long ago so the users of other tests are too new to expire
+	clock := &fakeClock{now: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)}
+	eus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Clock: clock})
+	password := "M0nk3yNutz5!"
+	old, _, err := eus.SignUp(SignUpParams{Email: "expire-old@mail.com", Password: password})
+	assert.Nil(t, err)
+	changed, _, err := eus.SignUp(SignUpParams{Email: "expire-changed@mail.com", Password: password})
+	assert.Nil(t, err)
+	clock.advance(48 * time.Hour)
+	assert.Nil(t, eus.ChangePassword(ChangePasswordParams{Email: changed.Email, ExistingPassword: password, NewPassword: "N3wM0nk3yNutz!"}))
+	_, _, err = eus.SignUp(SignUpParams{Email: "expire-new@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	n, err := eus.ExpirePasswords(Milliseconds(clock.now.Add(-24 * time.Hour)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	got, err := eus.Get(old.Id)
+	assert.Nil(t, err)
+	assert.True(t, got.MustChangePassword)
+	_, err = eus.SignIn(SignInParams{Email: old.Email, Password: password})
+	assert.Equal(t, ErrPasswordChangeRequired, err)
+	_, err = eus.SignIn(SignInParams{Email: "expire-new@mail.com", Password: password})
+	assert.Nil(t, err)
+	_, err = eus.SignIn(SignInParams{Email: changed.Email, Password: "N3wM0nk3yNutz!"})
+	assert.Nil(t, err)
+	// Already flagged users aren't counted again
+	n, err = eus.ExpirePasswords(Milliseconds(clock.now.Add(-24 * time.Hour)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+
+	// Changing the password lifts the gate
+	assert.Nil(t, eus.ChangePassword(ChangePasswordParams{Email: old.Email, ExistingPassword: password, NewPassword: "N3wM0nk3yNutz!"}))
+	uc, err := eus.SignIn(SignInParams{Email: old.Email, Password: "N3wM0nk3yNutz!"})
+	assert.Nil(t, err)
+	assert.False(t, uc.MustChangePassword)
+}
+
+func TestUsers_NullColumns(t *testing.T) {
+	// e.g. a legacy row which never had a uid, name or phone
+	res, err := testDb.Exec("INSERT INTO users (username, email, org_id, updated, created, deleted, role, suspended) "+
+		"VALUES (?, ?, 0, 0, 0, 0, 1, 0)", "null-columns@mail.com", "null-columns@mail.com")
+	assert.Nil(t, err)
+	id, err := res.LastInsertId()
+	assert.Nil(t, err)
+
+	u, err := us.Get(id)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []string{"", "", "", ""}, []string{u.Uid, u.FirstName, u.LastName, u.Phone})
+		assert.Equal(t, "null-columns@mail.com", u.Email)
+	}
+	uc, _, err := us.GetByUsername("null-columns@mail.com")
+	if assert.Nil(t, err) {
+		assert.Equal(t, id, uc.Id)
+		assert.Equal(t, "", uc.Phone)
+	}
+	list, err := us.List(ListUsersParams{UserFilters: UserFilters{Email: "null-columns@"}})
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(list.Items)) {
+		assert.Equal(t, "", list.Items[0].FirstName)
+	}
+}
+
+func TestUsers_AssignSameRole(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	rus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Clock: clock})
+	u, _, err := rus.SignUp(SignUpParams{Email: "same-role@mail.com"})
+	assert.Nil(t, err)
+	role := Role(7)
+	assert.Nil(t, rus.AssignRole(AssignRoleParams{Id: &u.Id, Role: &role}))
+	assigned, err := rus.Get(u.Id)
+	assert.Nil(t, err)
+
+	// Reassigning succeeds, even within the same millisecond, and isn't a change
+	assert.Nil(t, rus.AssignRole(AssignRoleParams{Id: &u.Id, Role: &role}))
+	clock.advance(time.Minute)
+	assert.Nil(t, rus.AssignRole(AssignRoleParams{Id: &u.Id, Role: &role}))
+	got, err := rus.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, role, got.Role)
+	assert.Equal(t, assigned.RoleUpdated, got.RoleUpdated)
+
+	missing := int64(999999)
+	assert.Equal(t, ErrNotFound, rus.AssignRole(AssignRoleParams{Id: &missing, Role: &role}))
+}
+
+func TestUsers_BulkImport(t *testing.T) {
+	org, err := orgsv.Create(CreateOrgParams{Name: "Imported"})
+	assert.Nil(t, err)
+	_, _, err = us.SignUp(SignUpParams{Email: "import-existing@mail.com"})
+	assert.Nil(t, err)
+	hash, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("M0nk3yNutz5!")
+	assert.Nil(t, err)
+
+	users := []ImportUser{
+		{Email: " Import-Good@mail.com", FirstName: "Good", PasswordHash: hash, OrgId: org.Id, Role: 3, Verified: true},
+		{Email: "not-an-email", PasswordHash: hash},
+		{Email: "import-nohash@mail.com"},
+		{Email: "import-existing@mail.com", PasswordHash: hash},
+		{Email: "import-good@mail.com", PasswordHash: hash},
+	}
+	// Enough to need several batches
+	for i := 0; i < 2*importBatchSize; i++ {
+		users = append(users, ImportUser{Email: fmt.Sprintf("import-%d@mail.com", i), PasswordHash: hash})
+	}
+	imported, errs := us.BulkImport(users)
+	assert.Equal(t, int64(len(users)-4), imported)
+	if assert.Equal(t, len(users), len(errs)) {
+		assert.Equal(t, []error{nil, ErrEmailInvalid, ErrPasswordRequired, ErrEmailTaken, ErrEmailTaken, nil}, errs[:6])
+		assert.Nil(t, errs[len(errs)-1])
+	}
+
+	uc, err := us.SignIn(SignInParams{Email: "import-good@mail.com", Password: "M0nk3yNutz5!"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Good", uc.FirstName)
+		assert.Equal(t, org.Id, uc.User.OrgId)
+		assert.Equal(t, Role(3), uc.User.Role)
+		assert.True(t, uc.Verified)
+		assert.NotEmpty(t, uc.Uid)
+		orgs, err := us.ListOrgs(uc.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(orgs))
+	}
+	_, err = us.SignIn(SignInParams{Email: fmt.Sprintf("import-%d@mail.com", 2*importBatchSize-1), Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+
+	// Importing again only reports the duplicates
+	imported, errs = us.BulkImport(users[:1])
+	assert.Equal(t, int64(0), imported)
+	assert.Equal(t, []error{ErrEmailTaken}, errs)
+	imported, errs = us.BulkImport(nil)
+	assert.Equal(t, int64(0), imported)
+	assert.Nil(t, errs)
+
+	// A sign up racing the batch insert fails only its row
+	var uids int
+	rus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UidGen: func() string {
+		uids++
+		if uids == 1 {
+			_, _, err := us.SignUp(SignUpParams{Email: "import-race@mail.com"})
+			assert.Nil(t, err)
+		}
+		return fmt.Sprintf("import-race-uid-%d", uids)
+	}})
+	imported, errs = rus.BulkImport([]ImportUser{
+		{Email: "import-race@mail.com", PasswordHash: hash},
+		{Email: "import-race-other@mail.com", PasswordHash: hash},
+	})
+	assert.Equal(t, int64(1), imported)
+	assert.Equal(t, []error{ErrEmailTaken, nil}, errs)
+	_, err = us.SignIn(SignInParams{Email: "import-race-other@mail.com", Password: "M0nk3yNutz5!"})
+	assert.Nil(t, err)
+}
+
+func TestUsers_Export(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	var n int
+	// A small page size so the export takes several pages
+	eus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, Clock: clock, MaxPageSize: 2,
+		UidGen: func() string {
+			n++
+			return fmt.Sprintf("export-uid-%d", n)
+		}})
+	org, err := orgsv.Create(CreateOrgParams{Name: "Export"})
+	assert.Nil(t, err)
+	var ids []int64
+	for i, name := range []string{"Ann", "Bob, Jr.", "Cy \"C\""} {
+		u, _, err := eus.SignUp(SignUpParams{Email: fmt.Sprintf("export%d@mail.com", i), FirstName: name, OrgId: org.Id, Role: 2,
+			Metadata: map[string]interface{}{"n": i}})
+		assert.Nil(t, err)
+		ids = append(ids, u.Id)
+	}
+	// Other orgs aren't exported
+	_, _, err = eus.SignUp(SignUpParams{Email: "export-other@mail.com"})
+	assert.Nil(t, err)
+
+	var b bytes.Buffer
+	assert.Nil(t, eus.Export(&b, UserFilters{OrgId: org.Id}, ExportCSV))
+	row := func(i int, name string) string {
+		return fmt.Sprintf("%d,export-uid-%d,export%d@mail.com,export%d@mail.com,%s,,,%d,Export,2,1500000000000,1500000000000,0,false,false,false,false,\"{\"\"n\"\":%d}\"\n",
+			ids[i], i+1, i, i, name, org.Id, i)
+	}
+	assert.Equal(t, "id,uid,username,email,first_name,last_name,phone,org_id,org_name,role,created,updated,last_login,suspended,passive,activated,verified,metadata\n"+
+		row(0, "Ann")+row(1, "\"Bob, Jr.\"")+row(2, "\"Cy \"\"C\"\"\""), b.String())
+
+	b.Reset()
+	assert.Nil(t, eus.Export(&b, UserFilters{OrgId: org.Id}, ExportJSON))
+	assert.NotContains(t, b.String(), "password_hash")
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if assert.Equal(t, 3, len(lines)) {
+		for i, line := range lines {
+			var got User
+			assert.Nil(t, json.Unmarshal([]byte(line), &got))
+			want, err := eus.Get(ids[i])
+			assert.Nil(t, err)
+			assert.Equal(t, *want, got)
+		}
+	}
+
+	// Nothing matching is just the header
+	b.Reset()
+	assert.Nil(t, eus.Export(&b, UserFilters{OrgId: 999999}, ExportCSV))
+	assert.Equal(t, 1, strings.Count(b.String(), "\n"))
+	assert.Error(t, eus.Export(&b, UserFilters{}, "xml"))
+
+	// Deleting an exported user part way doesn't shift the next page past the third user
+	b.Reset()
+	w := &hookWriter{w: &b, hook: func() { assert.Nil(t, eus.Delete(ids[0])) }}
+	assert.Nil(t, eus.Export(w, UserFilters{OrgId: org.Id}, ExportJSON))
+	assert.Equal(t, 3, strings.Count(b.String(), "\n"))
+	assert.Contains(t, b.String(), "export2@mail.com")
+}
+
+// hookWriter calls hook once, after the first write.
+type hookWriter struct {
+	w    io.Writer
+	hook func()
+}
+
+func (hw *hookWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	if hw.hook != nil {
+		hw.hook()
+		hw.hook = nil
+	}
+	return n, err
+}
+
+func TestUsers_GeneratedLengths(t *testing.T) {
+	var lengths []int64
+	gen := func(n int64) string {
+		lengths = append(lengths, n)
+		return RandStringBytesMaskImprSrc(n)
+	}
+	lus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PassGen: gen, GeneratedPasswordLength: 40, ResetTokenLength: 48})
+	// The generated password and then the activation token
+	_, token, err := lus.SignUp(SignUpParams{Email: "lengths@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{40, 48}, lengths)
+	assert.Equal(t, 48, len(token))
+	token, err = lus.ResetPassword(ResetPasswordParams{Email: "lengths@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, 48, len(token))
+
+	// Defaults, and short lengths are raised
+	assert.Equal(t, int64(128), NewUsers(testDb, UserOpts{}).GeneratedPasswordLength)
+	assert.Equal(t, int64(128), NewUsers(testDb, UserOpts{}).ResetTokenLength)
+	short := NewUsers(testDb, UserOpts{GeneratedPasswordLength: 8, ResetTokenLength: -1})
+	assert.Equal(t, int64(minGeneratedLength), short.GeneratedPasswordLength)
+	assert.Equal(t, int64(minGeneratedLength), short.ResetTokenLength)
+}
+
+func TestUsers_DisposableEmails(t *testing.T) {
+	dus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, PassiveEmailDomain: "burner.example",
+		DisposableDomainChecker: DefaultDisposableDomains.With("burner.example")})
+	_, _, err := dus.SignUp(SignUpParams{Email: "throwaway@Mailinator.com"})
+	assert.Equal(t, ErrDisposableEmail, err)
+	_, _, err = dus.SignUp(SignUpParams{Email: "throwaway@burner.example"})
+	assert.Equal(t, ErrDisposableEmail, err)
+	_, _, err = dus.SignUp(SignUpParams{Email: "not-disposable@mail.com"})
+	assert.Nil(t, err)
+
+	// Generated passive emails are exempt, but not the email the user is promoted with
+	p, _, err := dus.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(p.Email, "@burner.example"))
+	_, _, err = dus.PromoteUser(p.Id, SignUpParams{Email: "promoted@yopmail.com"})
+	assert.Equal(t, ErrDisposableEmail, err)
+	_, _, err = dus.PromoteUser(p.Id, SignUpParams{Email: "promoted-disposable@mail.com"})
+	assert.Nil(t, err)
+
+	// Nor can an email be changed to a disposable one
+	_, err = dus.RequestEmailChange(p.Id, "changed@Mailinator.com")
+	assert.Equal(t, ErrDisposableEmail, err)
+	_, err = dus.RequestEmailChange(p.Id, "changed-disposable@mail.com")
+	assert.Nil(t, err)
+}
+
+func TestUsers_SuspendRevokesTokens(t *testing.T) {
+	issuer := HMACIssuer{Key: []byte("01234567890123456789012345678901"), Expiry: time.Minute}
+	tus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, TokenIssuer: issuer})
+	password := "M0nk3yNutz5!"
+	u, _, err := tus.SignUp(SignUpParams{Email: "suspend-token@mail.com", Password: password})
+	assert.Nil(t, err)
+	ut, err := tus.SignInWithToken(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	session, err := tus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	tc, err := tus.ValidateToken(ut.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Uid, tc.Subject)
+	_, err = tus.ValidateToken("not.a.token")
+	assert.Equal(t, ErrNotAuth, err)
+
+	// The signature still verifies but the token is rejected, even after the user is restored
+	assert.Nil(t, tus.Suspend(u.Id))
+	_, err = issuer.Parse(ut.Token)
+	assert.Nil(t, err)
+	_, err = tus.ValidateToken(ut.Token)
+	assert.Equal(t, ErrNotAuth, err)
+	_, err = tus.ValidateSession(session)
+	assert.Equal(t, ErrSessionInvalid, err)
+	assert.Nil(t, tus.Restore(u.Id))
+	_, err = tus.ValidateToken(ut.Token)
+	assert.Equal(t, ErrNotAuth, err)
+
+	// A token issued after the suspension is accepted
+	fresh, err := tus.SignInWithToken(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	tc, err = tus.ValidateToken(fresh.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), tc.TokenVersion)
+
+	// Suspending the org revokes its users' tokens too
+	org, err := orgsv.Create(CreateOrgParams{Name: "Token org"})
+	assert.Nil(t, err)
+	assert.Nil(t, tus.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &org.Id}))
+	fresh, err = tus.SignInWithToken(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	_, err = tus.SuspendByOrg(org.Id, true)
+	assert.Nil(t, err)
+	_, err = tus.SuspendByOrg(org.Id, false)
+	assert.Nil(t, err)
+	_, err = tus.ValidateToken(fresh.Token)
+	assert.Equal(t, ErrNotAuth, err)
+
+	_, err = us.ValidateToken(fresh.Token)
+	assert.Equal(t, ErrNoTokenIssuer, err)
+}
+
+func TestUsers_BumpTokenVersion(t *testing.T) {
+	issuer := HMACIssuer{Key: []byte("01234567890123456789012345678901"), Expiry: time.Minute}
+	tus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, TokenIssuer: issuer})
+	password := "M0nk3yNutz5!"
+	u, _, err := tus.SignUp(SignUpParams{Email: "bump-token@mail.com", Password: password})
+	assert.Nil(t, err)
+	old, err := tus.SignInWithToken(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+
+	// Signs out everywhere
+	assert.Nil(t, tus.BumpTokenVersion(u.Id))
+	_, err = tus.ValidateToken(old.Token)
+	assert.Equal(t, ErrNotAuth, err)
+	fresh, err := tus.SignInWithToken(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	tc, err := tus.ValidateToken(fresh.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), tc.TokenVersion)
+
+	// Changing the password bumps it
+	newPassword := "N3wM0nk3yNutz!"
+	assert.Nil(t, tus.ChangePassword(ChangePasswordParams{Email: u.Email, ExistingPassword: password, NewPassword: newPassword}))
+	_, err = tus.ValidateToken(fresh.Token)
+	assert.Equal(t, ErrNotAuth, err)
+	fresh, err = tus.SignInWithToken(SignInParams{Email: u.Email, Password: newPassword})
+	assert.Nil(t, err)
+	tc, err = tus.ValidateToken(fresh.Token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), tc.TokenVersion)
+
+	assert.Equal(t, ErrNotFound, tus.BumpTokenVersion(-1))
+}
+
+func TestUsers_UnknownOrg(t *testing.T) {
+	org, err := orgsv.Create(CreateOrgParams{Name: "Known org"})
+	assert.Nil(t, err)
+	gone, err := orgsv.Create(CreateOrgParams{Name: "Deleted org"})
+	assert.Nil(t, err)
+	_, err = testDb.Exec("UPDATE orgs SET deleted = 1 WHERE id = ?", gone.Id)
+	assert.Nil(t, err)
+
+	u, _, err := us.SignUp(SignUpParams{Email: "known-org@mail.com", OrgId: org.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, org.Id, u.OrgId)
+	_, _, err = us.SignUp(SignUpParams{Email: "unknown-org@mail.com", OrgId: -1})
+	assert.Equal(t, ErrUnknownOrg, err)
+	_, _, err = us.SignUp(SignUpParams{Email: "deleted-org@mail.com", OrgId: gone.Id})
+	assert.Equal(t, ErrUnknownOrg, err)
+	_, err = us.GetByEmail("unknown-org@mail.com")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Zero is no org
+	none, _, err := us.SignUp(SignUpParams{Email: "no-org@mail.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), none.OrgId)
+
+	zero, missing := int64(0), int64(-1)
+	assert.Equal(t, ErrUnknownOrg, us.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &missing}))
+	assert.Equal(t, ErrUnknownOrg, us.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &gone.Id}))
+	u, err = us.Get(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, org.Id, u.OrgId)
+	assert.Nil(t, us.SetOrg(SetOrgParams{Id: &u.Id, OrgId: &zero}))
+
+	passive, _, err := us.SignUp(SignUpParams{Passive: true})
+	assert.Nil(t, err)
+	_, _, err = us.PromoteUser(passive.Id, SignUpParams{Email: "promote-unknown-org@mail.com", OrgId: -1})
+	assert.Equal(t, ErrUnknownOrg, err)
+	promoted, _, err := us.PromoteUser(passive.Id, SignUpParams{Email: "promote-known-org@mail.com", OrgId: org.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, org.Id, promoted.OrgId)
+
+	hash, err := us.Hasher.Hash("M0nk3yNutz5!")
+	assert.Nil(t, err)
+	n, errs := us.BulkImport([]ImportUser{
+		{Email: "import-known-org@mail.com", PasswordHash: hash, OrgId: org.Id},
+		{Email: "import-unknown-org@mail.com", PasswordHash: hash, OrgId: -1},
+	})
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, []error{nil, ErrUnknownOrg}, errs)
+}
+
+func TestUsers_GetWithClaims(t *testing.T) {
+	org, err := orgsv.Create(CreateOrgParams{Name: "Claims by id org"})
+	assert.Nil(t, err)
+	u, _, err := us.SignUp(SignUpParams{Email: "claims-by-id@mail.com", OrgId: org.Id, Role: 4})
+	assert.Nil(t, err)
+
+	uc, err := us.GetWithClaims(u.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, u.Email, uc.Email)
+	assert.Equal(t, "Claims by id org", uc.OrgName)
+	assert.Equal(t, Claims{Role: 4, OrgId: org.Id, OrgSuspended: false}, *uc.Claims)
+
+	assert.Nil(t, orgsv.Suspend(org.Id))
+	uc, err = us.GetWithClaims(u.Id)
+	assert.Nil(t, err)
+	assert.True(t, uc.Claims.OrgSuspended)
+	assert.Nil(t, orgsv.Restore(org.Id))
+	uc, err = us.GetWithClaims(u.Id)
+	assert.Nil(t, err)
+	assert.False(t, uc.Claims.OrgSuspended)
+
+	_, err = us.GetWithClaims(-1)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, us.Delete(u.Id))
+	_, err = us.GetWithClaims(u.Id)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUsers_CaseInsensitiveUsernames(t *testing.T) {
+	f := false
+	password := "M0nk3yNutz5!"
+	cus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f, CaseInsensitiveUsernames: true})
+	u, _, err := cus.SignUp(SignUpParams{Email: "Case-Alice@mail.com", Username: "Case-Alice", Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, "case-alice", u.Username)
+	assert.Equal(t, "case-alice@mail.com", u.Email)
+
+	// Mixed case signs in by username or email
+	for _, username := range []string{"case-alice", "CASE-ALICE", "Case-Alice", "Case-Alice@Mail.com"} {
+		uc, err := cus.SignIn(SignInParams{Username: username, Password: password})
+		assert.Nil(t, err, username)
+		if uc != nil {
+			assert.Equal(t, u.Id, uc.Id)
+		}
+	}
+
+	// Duplicates differing only by case are taken
+	_, _, err = cus.SignUp(SignUpParams{Email: "case-alice2@mail.com", Username: "CASE-alice", Password: password})
+	assert.Equal(t, ErrUsernameTaken, err)
+	_, err = cus.Exists(ExistsParams{Username: "Case-ALICE"})
+	assert.Equal(t, ErrUsernameTaken, err)
+	other, _, err := cus.SignUp(SignUpParams{Email: "case-bob@mail.com", Username: "Case-Bob", Password: password})
+	assert.Nil(t, err)
+	taken := "CASE-ALICE"
+	assert.Equal(t, ErrUsernameTaken, cus.Update(UpdateUserParams{Id: &other.Id, Username: &taken}))
+	renamed := "Case-Robert"
+	assert.Nil(t, cus.Update(UpdateUserParams{Id: &other.Id, Username: &renamed}))
+	other, err = cus.Get(other.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "case-robert", other.Username)
+
+	// Without the flag usernames stay case sensitive
+	sus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, UsernameIsEmail: &f})
+	u, _, err = sus.SignUp(SignUpParams{Email: "case-carol@mail.com", Username: "Case-Carol", Password: password})
+	assert.Nil(t, err)
+	assert.Equal(t, "Case-Carol", u.Username)
+	_, err = sus.SignIn(SignInParams{Username: "Case-Carol", Password: password})
+	assert.Nil(t, err)
+	_, err = sus.SignIn(SignInParams{Username: "case-carol", Password: password})
+	assert.Equal(t, ErrNotAuth, err)
+}
+
+func TestUsers_ClaimsForAPIKey(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	kus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, APIKeyExpiry: 60, Clock: clock})
+	org, err := orgsv.Create(CreateOrgParams{Name: "Gateway"})
+	assert.Nil(t, err)
+	u, _, err := kus.SignUp(SignUpParams{Email: "gateway@mail.com", Password: "M0nk3yNutz5!", OrgId: org.Id, Role: 6})
+	assert.Nil(t, err)
+	key, err := kus.CreateAPIKey(u.Id, "gateway")
+	assert.Nil(t, err)
+
+	c, err := kus.ClaimsForAPIKey(key)
+	assert.Nil(t, err)
+	assert.Equal(t, Claims{Role: 6, OrgId: org.Id}, *c)
+	_, err = kus.ClaimsForAPIKey("wrong")
+	assert.Equal(t, ErrNotAuth, err)
+
+	assert.Nil(t, orgsv.Suspend(org.Id))
+	c, err = kus.ClaimsForAPIKey(key)
+	assert.Nil(t, err)
+	assert.True(t, c.OrgSuspended)
+	assert.Equal(t, ErrNotAuth, Authorize(c, org.Id, 6))
+	assert.Nil(t, orgsv.Restore(org.Id))
+
+	assert.Nil(t, kus.Suspend(u.Id))
+	_, err = kus.ClaimsForAPIKey(key)
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Nil(t, kus.Restore(u.Id))
+
+	keys, err := kus.ListAPIKeys(u.Id)
+	assert.Nil(t, err)
+	assert.Nil(t, kus.RevokeAPIKey(u.Id, keys[0].Id))
+	_, err = kus.ClaimsForAPIKey(key)
+	assert.Equal(t, ErrNotAuth, err)
+
+	key, err = kus.CreateAPIKey(u.Id, "expiring")
+	assert.Nil(t, err)
+	clock.advance(time.Minute)
+	_, err = kus.ClaimsForAPIKey(key)
+	assert.Equal(t, ErrAPIKeyExpired, err)
+}
+
+func TestUsers_MaxSessions(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	sus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, MaxSessions: 2, Clock: clock})
+	u, _, err := sus.SignUp(SignUpParams{Email: "max-sessions@mail.com"})
+	assert.Nil(t, err)
+	oldest, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	clock.advance(time.Second)
+	middle, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	clock.advance(time.Second)
+
+	// The cap+1 session evicts the oldest
+	newest, err := sus.CreateSession(u.Id)
+	assert.Nil(t, err)
+	_, err = sus.ValidateSession(oldest)
+	assert.Equal(t, ErrSessionInvalid, err)
+	_, err = sus.ValidateSession(middle)
+	assert.Nil(t, err)
+	_, err = sus.ValidateSession(newest)
+	assert.Nil(t, err)
+
+	// Or is rejected
+	rus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 1, MaxSessions: 2, RejectExtraSessions: true, Clock: clock})
+	_, err = rus.CreateSession(u.Id)
+	assert.Equal(t, ErrTooManySessions, err)
+	_, err = rus.ValidateSession(middle)
+	assert.Nil(t, err)
+	assert.Nil(t, rus.RevokeSession(middle))
+	_, err = rus.CreateSession(u.Id)
+	assert.Nil(t, err)
+}
+
+func TestUsers_ParallelLock(t *testing.T) {
+	pus := NewUsers(testDb, UserOpts{AuthAttempts: 3, AuthLockDuration: 60})
+	password := "M0nk3yNutz5!"
+	_, _, err := pus.SignUp(SignUpParams{Email: "parallel-lock@mail.com", Password: password})
+	assert.Nil(t, err)
+
+	// Parallel guesses can't all pass the lock check before any are recorded
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var guesses int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pus.SignIn(SignInParams{Email: "parallel-lock@mail.com", Password: "wrong"})
+			if err == ErrNotAuth {
+				mu.Lock()
+				guesses++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// Fewer may get through if they count each other's attempts, never more
+	assert.True(t, guesses <= 3, guesses)
+	_, err = pus.SignIn(SignInParams{Email: "parallel-lock@mail.com", Password: password})
+	assert.IsType(t, &RateLimitExceededError{}, err)
+}
+
+func TestUsers_SessionsOfNonLiveUsers(t *testing.T) {
+	org, err := orgsv.Create(CreateOrgParams{Name: "Session org"})
+	assert.Nil(t, err)
+	u, _, err := us.SignUp(SignUpParams{Email: "session-live@mail.com", OrgId: org.Id})
+	assert.Nil(t, err)
+	session, err := us.CreateSession(u.Id)
+	assert.Nil(t, err)
+
+	assert.Nil(t, orgsv.Suspend(org.Id))
+	_, err = us.ValidateSession(session)
+	assert.Equal(t, ErrSessionInvalid, err)
+	assert.Nil(t, orgsv.Restore(org.Id))
+	_, err = us.ValidateSession(session)
+	assert.Nil(t, err)
+
+	// Suspended or passive without the sessions being revoked
+	for _, column := range []string{"suspended", "passive"} {
+		_, err = testDb.Exec("UPDATE users SET "+column+" = 1 WHERE id = ?", u.Id)
+		assert.Nil(t, err)
+		_, err = us.ValidateSession(session)
+		assert.Equal(t, ErrSessionInvalid, err, column)
+		_, err = testDb.Exec("UPDATE users SET "+column+" = 0 WHERE id = ?", u.Id)
+		assert.Nil(t, err)
+	}
+	_, err = us.ValidateSession(session)
+	assert.Nil(t, err)
+
+	// Deleting revokes the sessions so they stay invalid if the user is restored
+	assert.Nil(t, us.Delete(u.Id))
+	_, err = us.ValidateSession(session)
+	assert.Equal(t, ErrSessionInvalid, err)
+	assert.Nil(t, us.UnDelete(u.Id))
+	_, err = us.ValidateSession(session)
+	assert.Equal(t, ErrSessionInvalid, err)
+}
+
+// returningDialect gets insert ids like PostgresDialect, with RETURNING rather than LastInsertId, and records the
+// queries it inserts with.
+type returningDialect struct {
+	Dialect
+	inserts *[]string
+}
+
+func (d returningDialect) InsertId(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	*d.inserts = append(*d.inserts, query)
+	var id int64
+	err := tx.QueryRowContext(ctx, query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+func TestDialect_RecordAttemptInsertId(t *testing.T) {
+	var inserts []string
+	dus := NewUsers(testDb, UserOpts{AuthAttempts: 5, AuthLockDuration: 60,
+		Dialect: returningDialect{Dialect: MySqlDialect, inserts: &inserts}})
+	password := "M0nk3yNutz5!"
+	u, _, err := dus.SignUp(SignUpParams{Email: "returning-attempt@mail.com", Password: password})
+	assert.Nil(t, err)
+	inserts = nil
+
+	_, err = dus.SignIn(SignInParams{Email: u.Email, Password: password})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(inserts)) {
+		assert.Contains(t, inserts[0], "INTO password_attempts")
+	}
+	// The returned id cleared the successful attempt
+	var n int
+	assert.Nil(t, testDb.QueryRow("SELECT count(id) FROM password_attempts WHERE username = ?", u.Username).Scan(&n))
+	assert.Equal(t, 0, n)
+
+	_, err = dus.SignIn(SignInParams{Email: u.Email, Password: "wrong"})
+	assert.Equal(t, ErrNotAuth, err)
+	assert.Nil(t, testDb.QueryRow("SELECT count(id) FROM password_attempts WHERE username = ?", u.Username).Scan(&n))
+	assert.Equal(t, 1, n)
+}
@@ -1,6 +1,11 @@
 package gus
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
 
 var (
 	Rgx_ValidPasswordChars = regexp.MustCompile("[a-z0-9A-Z\" !#$%&'()*+,\\-.\\/:;<=>?@\\[\\]^_\\`{\\|}~\\\\]+")
@@ -9,6 +14,7 @@ var (
 	Rgx_OneSpecial         = regexp.MustCompile("[\" !#$%&'()*+,\\-.\\/:;<=>?@\\[\\]^_\\`{\\|}~\\\\]+")
 	Rgx_OneNumeric         = regexp.MustCompile(`\d+`)
 	Rgx_PasswordLength     = regexp.MustCompile(`^.{8,30}$`)
+	Rgx_E164               = regexp.MustCompile(`^\+[1-9]\d{1,14}$`)
 )
 
 type Validator interface {
@@ -23,6 +29,12 @@ func (f CustomValidator) Validate() error {
 	return f()
 }
 
+// NormalizeEmail trims and lowercases an email so case variants of an address are one user. Provider specific
+// aliases such as gmail's dots and '+' suffixes are left alone as they're distinct addresses elsewhere.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func TestStr(input string, rgx ...*regexp.Regexp) bool {
 	for _, v := range rgx {
 		if match := v.Find([]byte(input)); len(match) == 0 {
@@ -32,6 +44,51 @@ func TestStr(input string, rgx ...*regexp.Regexp) bool {
 	return true
 }
 
+// PasswordRules is a configurable password policy, use its Check as UserOpts.PasswordPolicy.
+type PasswordRules struct {
+	MinLength int  // Minimum chars.
+	MaxLength int  // Maximum chars, zero is unlimited.
+	Upper     bool // Require an upper case letter.
+	Lower     bool // Require a lower case letter.
+	Number    bool // Require a digit.
+	Special   bool // Require one of the Rgx_OneSpecial chars.
+}
+
+// DefaultPasswordRules are the rules of ValidatePassword.
+var DefaultPasswordRules = PasswordRules{MinLength: 8, MaxLength: 30, Upper: true, Lower: true, Number: true, Special: true}
+
+// Check returns an error describing the first rule the password breaks.
+func (r PasswordRules) Check(password string) error {
+	n := utf8.RuneCountInString(password)
+	if n < r.MinLength {
+		return ErrInvalidCode("password_too_short", fmt.Sprintf("'password' must be at least %d chars.", r.MinLength))
+	}
+	if r.MaxLength > 0 && n > r.MaxLength {
+		return ErrInvalidCode("password_too_long", fmt.Sprintf("'password' can't be longer than %d chars.", r.MaxLength))
+	}
+	if r.Upper && !TestStr(password, Rgx_OneUpper) {
+		return ErrInvalidCode("password_needs_upper", "'password' must contain an upper case letter.")
+	}
+	if r.Lower && !TestStr(password, Rgx_OneLower) {
+		return ErrInvalidCode("password_needs_lower", "'password' must contain a lower case letter.")
+	}
+	if r.Number && !TestStr(password, Rgx_OneNumeric) {
+		return ErrInvalidCode("password_needs_number", "'password' must contain a number.")
+	}
+	if r.Special && !TestStr(password, Rgx_OneSpecial) {
+		return ErrInvalidCode("password_needs_special", "'password' must contain a special char.")
+	}
+	return nil
+}
+
+// defaultPasswordPolicy is the UserOpts.PasswordPolicy when none is set.
+func defaultPasswordPolicy(password string) error {
+	if !ValidatePassword(password) {
+		return ErrPasswordInvalid
+	}
+	return nil
+}
+
 func ValidatePassword(in string) bool {
 	return TestStr(in, Rgx_ValidPasswordChars) && TestStr(in, Rgx_OneLower, Rgx_OneNumeric, Rgx_OneUpper, Rgx_OneSpecial, Rgx_PasswordLength)
 }
@@ -0,0 +1,57 @@
+package gus
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestUsers_ValidatePasswords(t *testing.T) {
+	pus := &Users{UserOpts: UserOpts{PasswordPolicy: DefaultPasswordRules.Check}}
+	errs := pus.ValidatePasswords([]string{"M0nk3yNutz5!", "weak", "", "Password1!", "nouppercase1!", "NOLOWER1!"})
+	assert.Equal(t, map[int]error{
+		1: DefaultPasswordRules.Check("weak"),
+		2: ErrPasswordRequired,
+		4: DefaultPasswordRules.Check("nouppercase1!"),
+		5: DefaultPasswordRules.Check("NOLOWER1!"),
+	}, errs)
+	assert.Nil(t, pus.ValidatePasswords([]string{"M0nk3yNutz5!", "Password1!"}))
+	assert.Nil(t, pus.ValidatePasswords(nil))
+
+	// The configured policy decides, without one only missing passwords fail
+	pus.PasswordPolicy = PasswordRules{MinLength: 15}.Check
+	assert.Nil(t, pus.ValidatePasswords([]string{"correct horse battery"}))
+	assert.Equal(t, map[int]error{0: ErrPasswordRequired}, (&Users{}).ValidatePasswords([]string{"", "weak"}))
+}
+
+func TestPasswordRules_Check(t *testing.T) {
+	code := func(err error) string {
+		if v, ok := err.(*ValidationError); ok {
+			return v.Code
+		}
+		return ""
+	}
+	for _, pw := range []string{"M0nk3yNutz5!", "Password1!", "weak", "nouppercase1!", "NOLOWER1!", "NoNumber!!", "N0Special1"} {
+		assert.Equal(t, ValidatePassword(pw), DefaultPasswordRules.Check(pw) == nil, pw)
+	}
+	assert.Equal(t, "password_too_short", code(DefaultPasswordRules.Check("Ab1!")))
+	assert.Equal(t, "password_too_long", code(DefaultPasswordRules.Check("Ab1!"+strings.Repeat("a", 27))))
+	assert.Equal(t, "password_needs_upper", code(DefaultPasswordRules.Check("nouppercase1!")))
+	assert.Equal(t, "password_needs_lower", code(DefaultPasswordRules.Check("NOLOWER1!")))
+	assert.Equal(t, "password_needs_number", code(DefaultPasswordRules.Check("NoNumber!!")))
+	assert.Equal(t, "password_needs_special", code(DefaultPasswordRules.Check("N0Special1")))
+	assert.Equal(t, "'password' must be at least 8 chars.", DefaultPasswordRules.Check("Ab1!").Error())
+
+	// Length only, counted in chars rather than bytes
+	long := PasswordRules{MinLength: 15}
+	assert.Nil(t, long.Check("correct horse battery"))
+	assert.Nil(t, long.Check(strings.Repeat("é", 15)))
+	assert.Equal(t, "password_too_short", code(long.Check("Sh0rt!")))
+
+	// Classes without a maximum
+	classes := PasswordRules{MinLength: 10, Upper: true, Number: true}
+	assert.Nil(t, classes.Check("ALLUPPER123"+strings.Repeat("A", 100)))
+	assert.Equal(t, "password_needs_number", code(classes.Check("NoDigitsHere")))
+
+	assert.Nil(t, PasswordRules{}.Check(""))
+}
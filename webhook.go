@@ -0,0 +1,209 @@
+package gus
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebhookSignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the request body keyed with the webhook secret.
+const WebhookSignatureHeader = "X-Gus-Signature"
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// WebhookEvent is the JSON body POSTed by WebhookSink.
+type WebhookEvent struct {
+	Event    string `json:"event"` // sign_up, sign_in, password_changed, suspended, deleted or lockout.
+	UserId   int64  `json:"user_id,omitempty"`
+	User     *User  `json:"user,omitempty"`     // For sign_up and sign_in.
+	Username string `json:"username,omitempty"` // For lockout.
+	Attempts int64  `json:"attempts,omitempty"` // For lockout.
+	Created  int64  `json:"created"`            // Milliseconds, receivers can reject old events to prevent replays.
+}
+
+// WebhookSink is an EventSink which POSTs each event as a signed WebhookEvent, see UserOpts.WebhookURL. Delivery is
+// asynchronous so it never delays or fails the operation: events are queued for a worker, failed deliveries are
+// retried with exponential backoff and then logged. Events sent while the queue is full are dropped and logged.
+// Close stops the worker.
+type WebhookSink struct {
+	URL     string
+	Secret  []byte        // Key of the WebhookSignatureHeader HMAC.
+	Client  *http.Client  // Defaults to a client with a 5 second timeout.
+	Retries int           // Retries after a failed delivery, defaults to 3.
+	Backoff time.Duration // Wait before the first retry, it doubles with each retry. Defaults to a second.
+	Logger  Logger
+	Clock   Clock
+	// QueueSize is the number of events waiting for delivery before more are dropped, defaults to 100. Events are
+	// delivered one at a time in the order they were sent.
+	QueueSize int
+
+	startOnce sync.Once
+	mu        sync.RWMutex // Guards closed against sends to the closed queue.
+	closed    bool
+	queue     chan webhookDelivery
+	done      chan struct{} // Closed by Close to cut retries short.
+	stopped   chan struct{} // Closed when the worker has finished.
+}
+
+type webhookDelivery struct {
+	event string
+	body  []byte
+}
+
+func (w *WebhookSink) OnSignUp(u *User) {
+	w.send(WebhookEvent{Event: "sign_up", UserId: u.Id, User: u})
+}
+
+func (w *WebhookSink) OnSignIn(u *UserWithClaims) {
+	w.send(WebhookEvent{Event: "sign_in", UserId: u.Id, User: u.User})
+}
+
+func (w *WebhookSink) OnPasswordChanged(userId int64) {
+	w.send(WebhookEvent{Event: "password_changed", UserId: userId})
+}
+
+func (w *WebhookSink) OnSuspended(userId int64) {
+	w.send(WebhookEvent{Event: "suspended", UserId: userId})
+}
+
+func (w *WebhookSink) OnDeleted(userId int64) {
+	w.send(WebhookEvent{Event: "deleted", UserId: userId})
+}
+
+func (w *WebhookSink) OnLockout(username string, attempts int64) {
+	w.send(WebhookEvent{Event: "lockout", Username: username, Attempts: attempts})
+}
+
+func (w *WebhookSink) send(e WebhookEvent) {
+	clock := w.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	e.Created = Milliseconds(clock.Now())
+	// Marshalled now as the user may be changed after the event is sent
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.log().Error("encoding webhook", "error", err, "event", e.Event)
+		return
+	}
+	w.start()
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.log().Error("dropping webhook, the sink is closed", "event", e.Event)
+		return
+	}
+	select {
+	case w.queue <- webhookDelivery{event: e.Event, body: body}:
+	default:
+		w.log().Error("dropping webhook, the queue is full", "event", e.Event)
+	}
+}
+
+// start starts the worker on first use so a WebhookSink literal works.
+func (w *WebhookSink) start() {
+	w.startOnce.Do(func() {
+		size := w.QueueSize
+		if size <= 0 {
+			size = 100
+		}
+		w.queue = make(chan webhookDelivery, size)
+		w.done = make(chan struct{})
+		w.stopped = make(chan struct{})
+		go func() {
+			defer close(w.stopped)
+			for d := range w.queue {
+				w.deliver(d.event, d.body)
+			}
+		}()
+	})
+}
+
+// Close stops accepting events and waits for the queued ones to be delivered, failures are no longer retried.
+func (w *WebhookSink) Close() error {
+	w.start()
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.stopped
+	return nil
+}
+
+func (w *WebhookSink) deliver(event string, body []byte) {
+	retries, backoff := w.Retries, w.Backoff
+	if retries == 0 {
+		retries = 3
+	}
+	if backoff == 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= retries {
+			w.log().Error("delivering webhook", "error", err, "event", event, "attempts", attempt+1)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			w.log().Error("delivering webhook", "error", err, "event", event, "attempts", attempt+1)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (w *WebhookSink) post(body []byte) error {
+	client := w.Client
+	if client == nil {
+		client = webhookClient
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, "sha256="+webhookSignature(w.Secret, body))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("gus: webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+func (w *WebhookSink) log() Logger {
+	if w.Logger == nil {
+		return NopLogger{}
+	}
+	return w.Logger
+}
+
+func webhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature, the WebhookSignatureHeader of a request, is valid for its body.
+func VerifyWebhook(secret []byte, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte("sha256="+webhookSignature(secret, body)))
+}
@@ -0,0 +1,118 @@
+package gus
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookRequest struct {
+	body      []byte
+	signature string
+}
+
+// webhookServer returns a server which sends each request it receives on the channel, failing the first failures.
+func webhookServer(failures int32) (*httptest.Server, chan webhookRequest) {
+	requests := make(chan webhookRequest, 10)
+	var n int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{body: body, signature: r.Header.Get(WebhookSignatureHeader)}
+		if atomic.AddInt32(&n, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})), requests
+}
+
+func receiveWebhook(t *testing.T, requests chan webhookRequest) webhookRequest {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+		return webhookRequest{}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	server, requests := webhookServer(0)
+	defer server.Close()
+	secret := []byte("webhook-secret")
+	clock := &fakeClock{now: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w := &WebhookSink{URL: server.URL, Secret: secret, Clock: clock}
+
+	w.OnSignUp(&User{Id: 7, Email: "hook@mail.com"})
+	r := receiveWebhook(t, requests)
+	assert.True(t, VerifyWebhook(secret, r.body, r.signature))
+	assert.False(t, VerifyWebhook([]byte("other"), r.body, r.signature))
+	assert.False(t, VerifyWebhook(secret, append(r.body, ' '), r.signature))
+	var e WebhookEvent
+	assert.Nil(t, json.Unmarshal(r.body, &e))
+	assert.Equal(t, "sign_up", e.Event)
+	assert.Equal(t, int64(7), e.UserId)
+	assert.Equal(t, "hook@mail.com", e.User.Email)
+	assert.Equal(t, Milliseconds(clock.now), e.Created)
+
+	w.OnLockout("hook@mail.com", 6)
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal(receiveWebhook(t, requests).body, &fields))
+	assert.Equal(t, map[string]interface{}{"event": "lockout", "username": "hook@mail.com", "attempts": float64(6),
+		"created": float64(Milliseconds(clock.now))}, fields)
+}
+
+func TestWebhookSink_Retry(t *testing.T) {
+	server, requests := webhookServer(2)
+	defer server.Close()
+	w := &WebhookSink{URL: server.URL, Secret: []byte("webhook-secret"), Backoff: time.Millisecond}
+
+	w.OnSuspended(3)
+	for i := 0; i < 3; i++ {
+		var e WebhookEvent
+		assert.Nil(t, json.Unmarshal(receiveWebhook(t, requests).body, &e))
+		assert.Equal(t, WebhookEvent{Event: "suspended", UserId: 3, Created: e.Created}, e)
+	}
+	select {
+	case <-requests:
+		t.Fatal("delivered webhook was retried")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookSink_Queue(t *testing.T) {
+	requests := make(chan string, 10)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e WebhookEvent
+		json.NewDecoder(r.Body).Decode(&e)
+		requests <- e.Event
+		<-release
+	}))
+	defer server.Close()
+	logger := &recordingLogger{}
+	w := &WebhookSink{URL: server.URL, QueueSize: 1, Logger: logger}
+
+	// The worker is busy with the first, the second waits and the third is dropped
+	w.OnSuspended(1)
+	assert.Equal(t, "suspended", <-requests)
+	w.OnDeleted(1)
+	w.OnPasswordChanged(1)
+	assert.Equal(t, []string{"error dropping webhook, the queue is full event=password_changed"}, logger.lines)
+
+	// Close delivers the queued event then later ones are dropped
+	close(release)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, "deleted", <-requests)
+	assert.Nil(t, w.Close())
+	w.OnSuspended(2)
+	assert.Equal(t, "error dropping webhook, the sink is closed event=suspended", logger.lines[1])
+	select {
+	case e := <-requests:
+		t.Fatal("delivered after close:", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}